@@ -2,12 +2,20 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -15,68 +23,345 @@ import (
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog/v2"
 
+	"github.com/imroc/podcidr-controller/pkg/config"
 	"github.com/imroc/podcidr-controller/pkg/controller"
+	"github.com/imroc/podcidr-controller/pkg/discovery"
+	"github.com/imroc/podcidr-controller/pkg/fingerprint"
 	"github.com/imroc/podcidr-controller/pkg/selector"
-	"github.com/imroc/podcidr-controller/pkg/taint"
+	"github.com/imroc/podcidr-controller/pkg/shard"
+	"github.com/imroc/podcidr-controller/pkg/state"
+	"github.com/imroc/podcidr-controller/pkg/webhook"
 )
 
 var (
+	configFile       string
 	clusterCIDR      string
 	nodeCIDRMaskSize int
 	nodeSelectorStr  string
 	removeTaintsStr  string
+	shards           int
 	leaderElect      bool
+	separateLeases   bool
+	controllers      []string
 	leaseDuration    time.Duration
 	renewDeadline    time.Duration
 	retryPeriod      time.Duration
+	forceReconfigure bool
+
+	metricsBindAddress string
+	webhookBindAddress string
+	webhookCertDir     string
+
+	taintUnallocated    bool
+	setNetworkAvailable bool
+
+	utilizationThresholds []int
+	alertWebhookURL       string
+
+	allocationLimit       int
+	allocationLimitWindow time.Duration
+
+	excludeCIDRs          []string
+	bypassServiceAccounts []string
+	poolSource            string
+
+	allocationRecords         bool
+	allocationRecordRetention time.Duration
+
+	migrate           bool
+	migrateSkipVerify bool
+
+	discoverClusterCIDR bool
+	overlapProtection   string
+
+	allocationStrategy string
+	nodeIPSubnet       string
+	nodeIPHostBits     int
+
+	requireProviderID bool
+	absentTaints      []string
+	requiredLabels    []string
+	minNodeAge        time.Duration
+
+	priorityRulesStr string
+	oldestFirst      bool
 )
 
+// flagsReplacedByConfig cannot be combined with --config
+var flagsReplacedByConfig = []string{
+	"cluster-cidr",
+	"node-cidr-mask-size",
+	"node-selector",
+	"remove-taints",
+	"shards",
+	"leader-elect",
+	"leader-elect-lease-duration",
+	"leader-elect-renew-deadline",
+	"leader-elect-retry-period",
+	"leader-elect-separate-leases",
+	"controllers",
+	"taint-unallocated",
+	"set-network-available",
+	"utilization-thresholds",
+	"alert-webhook-url",
+	"allocation-limit",
+	"allocation-limit-window",
+	"exclude-cidrs",
+	"admission-bypass-service-accounts",
+	"pool-source",
+	"allocation-records",
+	"allocation-record-retention",
+	"migrate-from-kube-controller-manager",
+	"migration-skip-verify",
+	"discover-cluster-cidr",
+	"overlap-protection",
+	"allocation-strategy",
+	"node-ip-subnet",
+	"node-ip-host-bits",
+	"allocation-require-provider-id",
+	"allocation-absent-taints",
+	"allocation-required-labels",
+	"allocation-min-node-age",
+	"allocation-priority-rules",
+	"allocation-oldest-first",
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "podcidr-controller",
 	Short: "A lightweight Pod CIDR allocator for Kubernetes nodes",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return run()
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+		return run(cfg)
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate a configuration file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := config.Load(configFile); err != nil {
+			return fmt.Errorf("invalid configuration %s: %w", configFile, err)
+		}
+		fmt.Printf("Configuration %s is valid\n", configFile)
+		return nil
 	},
 }
 
 func init() {
-	rootCmd.Flags().StringVar(&clusterCIDR, "cluster-cidr", "", "CIDR range for pod IPs (required)")
+	rootCmd.Flags().StringVar(&configFile, "config", "", "Path to a PodCIDRControllerConfiguration file, reloaded on change")
+	rootCmd.Flags().StringVar(&clusterCIDR, "cluster-cidr", "", "CIDR range for pod IPs (required unless --config, --pool-source or --discover-cluster-cidr is set)")
 	rootCmd.Flags().IntVar(&nodeCIDRMaskSize, "node-cidr-mask-size", 24, "Mask size for node CIDR")
+	rootCmd.Flags().BoolVar(&discoverClusterCIDR, "discover-cluster-cidr", false, "Discover the cluster CIDR and node mask size from the kubeadm-config ConfigMap, the kube-controller-manager pods and the podCIDRs of existing nodes instead of --cluster-cidr")
+	rootCmd.Flags().StringVar(&poolSource, "pool-source", "", "Where pools come from instead of --cluster-cidr: PodCIDRPool or ClusterCIDR (networking.k8s.io/v1alpha1) objects")
+	rootCmd.Flags().StringSliceVar(&excludeCIDRs, "exclude-cidrs", nil, "Comma-separated ranges inside the cluster CIDR that are never allocated")
+	rootCmd.Flags().StringVar(&allocationStrategy, "allocation-strategy", config.StrategySequential, "How a node's block is picked: Sequential, NodeIP (derived from its InternalIP) or NameHash (derived from a hash of its name)")
+	rootCmd.Flags().StringVar(&nodeIPSubnet, "node-ip-subnet", "", "Node network whose addresses map to blocks with --allocation-strategy=NodeIP")
+	rootCmd.Flags().IntVar(&nodeIPHostBits, "node-ip-host-bits", 0, "Low bits of the node address ignored by the NodeIP mapping, e.g. 8 maps 192.168.3.17 to block 3 of a 192.168.0.0/16 subnet")
+	rootCmd.Flags().BoolVar(&requireProviderID, "allocation-require-provider-id", false, "Only allocate to nodes whose spec.providerID is set, i.e. initialised by the cloud provider")
+	rootCmd.Flags().StringSliceVar(&absentTaints, "allocation-absent-taints", nil, "Comma-separated taints that hold a node back from allocation while present (formats: key, key:effect, key=value:effect)")
+	rootCmd.Flags().StringSliceVar(&requiredLabels, "allocation-required-labels", nil, "Comma-separated labels, as key or key=value, that a node needs before it is allocated")
+	rootCmd.Flags().DurationVar(&minNodeAge, "allocation-min-node-age", 0, "How long after its creation a node is first allocated")
+	rootCmd.Flags().StringVar(&priorityRulesStr, "allocation-priority-rules", "", `JSON array of rules ranking the nodes waiting for a block, the first match wins and higher priorities go first, e.g. [{"priority":100,"nodeSelector":[{"key":"priority-class","operator":"In","values":["critical"]}]}]`)
+	rootCmd.Flags().BoolVar(&oldestFirst, "allocation-oldest-first", false, "Allocate the nodes waiting for a block oldest first within a priority, instead of in queue order")
+	rootCmd.Flags().StringVar(&overlapProtection, "overlap-protection", "", "Guard the pools against ServiceCIDR objects and node addresses: Exclude them from allocation, or Refuse to start while they overlap")
 	rootCmd.Flags().StringVar(&nodeSelectorStr, "node-selector", "", "JSON array of matchExpressions to filter nodes for CIDR allocation")
 	rootCmd.Flags().StringVar(&removeTaintsStr, "remove-taints", "", "Comma-separated taints to remove from nodes (formats: key, key:effect, key=value:effect)")
+	rootCmd.Flags().IntVar(&shards, "shards", 1, "Number of shards to split the cluster CIDR into, each owned by one replica (power of two)")
+	rootCmd.Flags().StringSliceVar(&controllers, "controllers", config.AllControllers, "Comma-separated sub-controllers to run: "+strings.Join(config.AllControllers, ", "))
 	rootCmd.Flags().BoolVar(&leaderElect, "leader-elect", true, "Enable leader election for HA")
 	rootCmd.Flags().DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second, "Lease duration for leader election")
 	rootCmd.Flags().DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "Renew deadline for leader election")
 	rootCmd.Flags().DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second, "Retry period for leader election")
-	_ = rootCmd.MarkFlagRequired("cluster-cidr")
+	rootCmd.Flags().BoolVar(&separateLeases, "leader-elect-separate-leases", false, "Elect the taint remover with its own Lease, so it can lead on a different replica than the CIDR allocator")
+	rootCmd.Flags().BoolVar(&taintUnallocated, "taint-unallocated", false, "Taint nodes that cannot get a CIDR with podcidr.imroc.io/unallocated:NoSchedule until one is assigned")
+	rootCmd.Flags().BoolVar(&setNetworkAvailable, "set-network-available", false, "Set the NetworkUnavailable condition to False once a node has a CIDR, for clusters without a route controller")
+	rootCmd.Flags().IntSliceVar(&utilizationThresholds, "utilization-thresholds", nil, "Comma-separated percentages of used node CIDR blocks that trigger a Warning Event and the alert webhook, e.g. 80,95")
+	rootCmd.Flags().StringVar(&alertWebhookURL, "alert-webhook-url", "", "HTTP endpoint that receives a JSON payload when a utilization threshold is crossed")
+	rootCmd.Flags().IntVar(&allocationLimit, "allocation-limit", 0, "Maximum number of nodes allocated a CIDR within --allocation-limit-window before allocation stops until acknowledged (0 disables)")
+	rootCmd.Flags().DurationVar(&allocationLimitWindow, "allocation-limit-window", 10*time.Minute, "Sliding window for --allocation-limit")
+	rootCmd.Flags().BoolVar(&allocationRecords, "allocation-records", false, "Keep a NodeCIDRAllocation object per allocation, and restore the allocator from them at startup")
+	rootCmd.Flags().DurationVar(&allocationRecordRetention, "allocation-record-retention", 7*24*time.Hour, "How long the NodeCIDRAllocation object of a released block is kept")
+	rootCmd.Flags().BoolVar(&migrate, "migrate-from-kube-controller-manager", false, "Take over CIDR allocation from kube-controller-manager: check its settings, then only observe until the migration.podcidr.imroc.io/active annotation is set on the state ConfigMap")
+	rootCmd.Flags().BoolVar(&migrateSkipVerify, "migration-skip-verify", false, "Do not check the settings of kube-controller-manager, for control planes whose pods are not visible")
+	rootCmd.Flags().StringVar(&metricsBindAddress, "metrics-bind-address", ":9441", "Address to serve Prometheus metrics on at /metrics, or 0 to disable")
+	rootCmd.Flags().StringVar(&webhookBindAddress, "webhook-bind-address", "0", "Address to serve the node admission webhooks on over TLS, or 0 to disable")
+	rootCmd.Flags().StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "Directory with the webhook serving certificate (tls.crt and tls.key), reloaded on change")
+	rootCmd.Flags().StringSliceVar(&bypassServiceAccounts, "admission-bypass-service-accounts", nil, "Comma-separated namespace/name of service accounts that the validating webhook lets set any podCIDR")
+	rootCmd.Flags().BoolVar(&forceReconfigure, "force-reconfigure", false, "Start even if a cluster CIDR or mask size change leaves existing node CIDRs out of range or overlapping")
+
+	validateCmd.Flags().StringVar(&configFile, "config", "", "Path to a PodCIDRControllerConfiguration file")
+	_ = validateCmd.MarkFlagRequired("config")
+	rootCmd.AddCommand(validateCmd)
 }
 
 func Execute() error {
 	return rootCmd.Execute()
 }
 
-func run() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// configChecksum identifies the content of --config that is running
+var configChecksum config.Checksum
 
-	config, err := rest.InClusterConfig()
+// loadConfig builds the configuration from --config or from the legacy flags
+func loadConfig(cmd *cobra.Command) (*config.Configuration, error) {
+	if configFile != "" {
+		for _, name := range flagsReplacedByConfig {
+			if cmd.Flags().Changed(name) {
+				return nil, fmt.Errorf("--%s cannot be combined with --config", name)
+			}
+		}
+		cfg, checksum, err := config.LoadWithChecksum(configFile)
+		if err != nil {
+			return nil, err
+		}
+		configChecksum = checksum
+		return cfg, nil
+	}
+
+	allocating := slices.Contains(controllers, config.CIDRAllocator)
+	if discoverClusterCIDR {
+		for _, name := range []string{"cluster-cidr", "node-cidr-mask-size", "pool-source"} {
+			if cmd.Flags().Changed(name) {
+				return nil, fmt.Errorf("--%s cannot be combined with --discover-cluster-cidr", name)
+			}
+		}
+		if allocating {
+			if err := discoverCluster(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if clusterCIDR == "" && allocating && poolSource == "" {
+		return nil, fmt.Errorf("--cluster-cidr is required unless --config, --pool-source or --discover-cluster-cidr is set")
+	}
+
+	nodeSelector, err := selector.Parse(nodeSelectorStr)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to parse node-selector: %w", err)
+	}
+
+	var removeTaints []string
+	if strings.TrimSpace(removeTaintsStr) != "" {
+		removeTaints = strings.Split(removeTaintsStr, ",")
+	}
+
+	cfg := &config.Configuration{
+		Controllers:  controllers,
+		RemoveTaints: removeTaints,
+		LeaderElection: config.LeaderElection{
+			LeaderElect:    &leaderElect,
+			LeaseDuration:  metav1.Duration{Duration: leaseDuration},
+			RenewDeadline:  metav1.Duration{Duration: renewDeadline},
+			RetryPeriod:    metav1.Duration{Duration: retryPeriod},
+			SeparateLeases: separateLeases,
+		},
+		NodeStatus: config.NodeStatus{
+			TaintUnallocated:    taintUnallocated,
+			SetNetworkAvailable: setNetworkAvailable,
+		},
+		Admission:         config.Admission{BypassServiceAccounts: bypassServiceAccounts},
+		PoolSource:        poolSource,
+		OverlapProtection: overlapProtection,
+	}
+	if allocating && poolSource == "" {
+		cfg.Pools = []config.Pool{{
+			Name:                  config.DefaultPoolName,
+			ClusterCIDR:           clusterCIDR,
+			NodeCIDRMaskSize:      nodeCIDRMaskSize,
+			NodeSelector:          nodeSelector.MatchExpressions,
+			Shards:                shards,
+			UtilizationThresholds: utilizationThresholds,
+			ExcludeCIDRs:          excludeCIDRs,
+			Strategy:              allocationStrategy,
+		}}
+		if nodeIPSubnet != "" {
+			cfg.Pools[0].NodeIP = &config.NodeIPMapping{Subnet: nodeIPSubnet, HostBits: nodeIPHostBits}
+		}
+	}
+	if requireProviderID || len(absentTaints) > 0 || len(requiredLabels) > 0 || minNodeAge > 0 {
+		cfg.AllocationPreconditions = &config.AllocationPreconditions{
+			RequireProviderID: requireProviderID,
+			AbsentTaints:      absentTaints,
+			RequiredLabels:    requiredLabels,
+			MinNodeAge:        metav1.Duration{Duration: minNodeAge},
+		}
+	}
+	if priorityRulesStr != "" || oldestFirst {
+		cfg.AllocationPriority = &config.AllocationPriority{OldestFirst: oldestFirst}
+		if priorityRulesStr != "" {
+			if err := json.Unmarshal([]byte(priorityRulesStr), &cfg.AllocationPriority.Rules); err != nil {
+				return nil, fmt.Errorf("failed to parse allocation-priority-rules: %w", err)
+			}
+		}
+	}
+	if allocationRecords {
+		cfg.AllocationRecords = &config.AllocationRecords{
+			Retention: metav1.Duration{Duration: allocationRecordRetention},
+		}
+	}
+	if migrate {
+		cfg.Migration = &config.Migration{SkipVerify: migrateSkipVerify}
+	}
+	if alertWebhookURL != "" {
+		cfg.AlertWebhook = &config.AlertWebhook{URL: alertWebhookURL}
+	}
+	if allocationLimit > 0 {
+		cfg.AllocationLimit = &config.AllocationLimit{
+			MaxAllocations: allocationLimit,
+			Window:         metav1.Duration{Duration: allocationLimitWindow},
+		}
 	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-	clientset, err := kubernetes.NewForConfig(config)
+// discoverCluster sets --cluster-cidr and --node-cidr-mask-size from the
+// cluster, and fails if the sources disagree
+func discoverCluster() error {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	if leaderElect {
-		return runWithLeaderElection(ctx, clientset)
+	found, err := discovery.Discover(ctx, clientset)
+	if err != nil {
+		return fmt.Errorf("failed to discover the cluster CIDR: %w", err)
 	}
-	return runController(ctx, clientset)
+	klog.Infof("Discovered cluster CIDR %s from %s, node mask size /%d from %s",
+		found.ClusterCIDR, strings.Join(found.ClusterCIDRSources, ", "),
+		found.NodeCIDRMaskSize, sourcesOrDefault(found.MaskSizeSources))
+	clusterCIDR, nodeCIDRMaskSize = found.ClusterCIDR, found.NodeCIDRMaskSize
+	return nil
 }
 
-func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface) error {
-	id, err := os.Hostname()
+func sourcesOrDefault(sources []string) string {
+	if len(sources) == 0 {
+		return "the kube-controller-manager default"
+	}
+	return strings.Join(sources, ", ")
+}
+
+func run(cfg *config.Configuration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		return err
 	}
@@ -86,63 +371,311 @@ func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface)
 		namespace = "kube-system"
 	}
 
-	lock := &resourcelock.LeaseLock{
-		LeaseMeta: metav1.ObjectMeta{
-			Name:      "podcidr-controller",
-			Namespace: namespace,
-		},
-		Client: clientset.CoordinationV1(),
-		LockConfig: resourcelock.ResourceLockConfig{
-			Identity: id,
-		},
+	informerFactory := informers.NewSharedInformerFactory(clientset, time.Minute*10)
+
+	ctrl, err := controller.NewController(clientset, informerFactory, cfg, namespace)
+	if err != nil {
+		return err
 	}
 
-	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock:            lock,
-		ReleaseOnCancel: true,
-		LeaseDuration:   leaseDuration,
-		RenewDeadline:   renewDeadline,
-		RetryPeriod:     retryPeriod,
-		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(ctx context.Context) {
-				if err := runController(ctx, clientset); err != nil {
-					klog.Fatalf("Controller error: %v", err)
-				}
-			},
-			OnStoppedLeading: func() {
-				klog.Info("Lost leadership")
-			},
-			OnNewLeader: func(identity string) {
-				if identity == id {
-					return
-				}
-				klog.Infof("New leader elected: %s", identity)
+	if metricsBindAddress != "0" {
+		go serveMetrics(ctx, metricsBindAddress, ctrl)
+	}
+
+	// Custom resources are read and written through the dynamic client
+	if cfg.PoolSource != "" || cfg.AllocationRecords != nil {
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+		dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Minute*10)
+		switch cfg.PoolSource {
+		case config.PoolSourcePodCIDRPool:
+			ctrl.WatchPodCIDRPools(dynamicClient, dynamicInformerFactory)
+		case config.PoolSourceClusterCIDR:
+			ctrl.WatchClusterCIDRs(dynamicInformerFactory)
+		}
+		if cfg.AllocationRecords != nil {
+			ctrl.WatchAllocationRecords(dynamicClient, dynamicInformerFactory)
+		}
+		dynamicInformerFactory.Start(ctx.Done())
+	}
+
+	if cfg.OverlapProtection != "" {
+		if servesServiceCIDRs(clientset) {
+			ctrl.WatchServiceCIDRs(informerFactory)
+		} else {
+			klog.Info("The API server does not serve ServiceCIDR objects, overlap protection only covers node addresses")
+		}
+	}
+
+	// Informers run on every replica so that standbys keep a warm copy of
+	// the allocator state and can start allocating as soon as they lead.
+	informerFactory.Start(ctx.Done())
+	if err := ctrl.Prepare(ctx); err != nil {
+		return err
+	}
+	if err := ctrl.PrepareMigration(ctx); err != nil {
+		return err
+	}
+
+	// The webhooks are served on every replica once the allocator is warm.
+	// Only the leader assigns, so the Service of the mutating webhook
+	// selects the pod labelled while leading; POD_NAME is set by the chart.
+	if webhookBindAddress != "0" {
+		if podName := os.Getenv("POD_NAME"); podName != "" {
+			if err := ctrl.SetPod(ctx, podName); err != nil {
+				klog.Warningf("Failed to clear label %s of pod %s: %v", controller.LeaderLabel, podName, err)
+			}
+		}
+		server := webhook.NewServer(webhookBindAddress, webhookCertDir)
+		server.Handle(webhook.MutateNodePath, webhook.MutateNode(ctrl))
+		server.Handle(webhook.ValidateNodePath, webhook.ValidateNode(ctrl))
+		go func() {
+			if err := server.Run(ctx); err != nil {
+				klog.Errorf("Webhook server failed: %v", err)
+			}
+		}()
+	}
+
+	store := state.NewStore(clientset, namespace)
+	allocating := tracksLayout(cfg)
+	if allocating {
+		nodes, err := informerFactory.Core().V1().Nodes().Lister().List(labels.Everything())
+		if err != nil {
+			return err
+		}
+		if err := checkLayout(ctx, store, cfg, nodes); err != nil {
+			return err
+		}
+	}
+
+	if configFile != "" {
+		go config.Watch(ctx, configFile, configChecksum, config.DefaultReloadInterval, func(newCfg *config.Configuration) {
+			if err := ctrl.ApplyConfig(newCfg); err != nil {
+				klog.Errorf("Refusing configuration change from %s: %v", configFile, err)
+				return
+			}
+			// An expansion changes the layout; keep the fingerprint current
+			if allocating && ctrl.IsLeading() {
+				recordLayout(ctx, store, newCfg)
+			}
+		})
+	}
+
+	le := cfg.LeaderElection
+	if !*le.LeaderElect {
+		if allocating {
+			recordLayout(ctx, store, ctrl.Config())
+		}
+		ctrl.SetLeading(true)
+		ctrl.SetTaintRemoverLeading(true)
+		for _, name := range ctrl.Shards() {
+			ctrl.SetShardOwned(name, true)
+		}
+		return ctrl.Run(ctx, 2)
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	// With sharding, each shard has its own Lease and shards are spread
+	// across replicas; the main Lease only covers leader-only work.
+	sharded := allocating && isSharded(cfg)
+	managerDone := make(chan struct{})
+	if sharded {
+		manager := shard.NewManager(shard.Config{
+			Client:        clientset,
+			Namespace:     namespace,
+			Identity:      id,
+			LeasePrefix:   "podcidr-controller",
+			Shards:        ctrl.Shards(),
+			LeaseDuration: le.LeaseDuration.Duration,
+			RenewDeadline: le.RenewDeadline.Duration,
+			RetryPeriod:   le.RetryPeriod.Duration,
+			Callbacks: shard.Callbacks{
+				OnStartedLeading: func(name string) { ctrl.SetShardOwned(name, true) },
+				OnStoppedLeading: func(name string) { ctrl.SetShardOwned(name, false) },
 			},
-		},
-	})
+		})
+		go func() {
+			defer close(managerDone)
+			manager.Run(ctx)
+		}()
+	} else {
+		close(managerDone)
+	}
 
-	return nil
+	go func() {
+		defer cancel()
+		runWithLeaderElection(ctx, clientset, ctrl, cfg, store, sharded, id)
+	}()
+	if le.SeparateLeases && cfg.ControllerEnabled(config.TaintRemover) {
+		go func() {
+			defer cancel()
+			runTaintRemoverElection(ctx, clientset, ctrl, cfg, namespace, id)
+		}()
+	}
+
+	err = ctrl.Run(ctx, 2)
+	<-managerDone
+	return err
 }
 
-func runController(ctx context.Context, clientset kubernetes.Interface) error {
-	nodeSelector, err := selector.Parse(nodeSelectorStr)
+// serveMetrics serves the controller's metrics until ctx is done. Every
+// replica serves them, so usage is visible from standbys as well.
+func serveMetrics(ctx context.Context, addr string, ctrl *controller.Controller) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ctrl.MetricsHandler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	klog.Infof("Serving metrics on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Metrics server failed: %v", err)
+	}
+}
+
+// servesServiceCIDRs reports whether the API server serves the
+// networking.k8s.io/v1beta1 ServiceCIDR objects
+func servesServiceCIDRs(clientset kubernetes.Interface) bool {
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion("networking.k8s.io/v1beta1")
 	if err != nil {
-		return fmt.Errorf("failed to parse node-selector: %w", err)
+		return false
+	}
+	return slices.ContainsFunc(resources.APIResources, func(r metav1.APIResource) bool { return r.Name == "servicecidrs" })
+}
+
+func isSharded(cfg *config.Configuration) bool {
+	for _, p := range cfg.Pools {
+		if p.Shards > 1 {
+			return true
+		}
 	}
+	return false
+}
+
+// tracksLayout reports whether the layout fingerprint is checked and
+// recorded. Pools read from PodCIDRPool objects are validated as they
+// change instead.
+func tracksLayout(cfg *config.Configuration) bool {
+	return cfg.ControllerEnabled(config.CIDRAllocator) && cfg.PoolSource == ""
+}
 
-	taintRemover, err := taint.NewTaintRemover(removeTaintsStr)
+// checkLayout compares the configured layout with the fingerprint stored by
+// the previous run and refuses to start if existing node CIDRs would end up
+// out of range or overlapping, unless --force-reconfigure is set
+func checkLayout(ctx context.Context, store *state.Store, cfg *config.Configuration, nodes []*corev1.Node) error {
+	previous, previousLayout, err := fingerprint.Load(ctx, store)
 	if err != nil {
-		return fmt.Errorf("failed to parse remove-taints: %w", err)
+		return fmt.Errorf("failed to load layout fingerprint: %w", err)
+	}
+	if previous == "" || previous == fingerprint.Compute(cfg) {
+		return nil
 	}
 
-	informerFactory := informers.NewSharedInformerFactory(clientset, time.Minute*10)
+	layout := fingerprint.Layout(cfg)
+	klog.Infof("Layout changed from %s to %s", previousLayout, layout)
 
-	ctrl, err := controller.NewController(clientset, informerFactory, clusterCIDR, nodeCIDRMaskSize, nodeSelector, taintRemover)
+	conflicts, err := fingerprint.Diff(previousLayout, cfg, nodes)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to compare with previous layout: %w", err)
+	}
+	if len(conflicts) == 0 {
+		return nil
 	}
 
-	informerFactory.Start(ctx.Done())
+	klog.Warningf("Layout change affects %d nodes:", len(conflicts))
+	for _, c := range conflicts {
+		klog.Warningf("  %s", c)
+	}
+	if !forceReconfigure {
+		return fmt.Errorf("layout change from %s to %s leaves %d nodes out of range or overlapping; "+
+			"restore the previous settings or restart with --force-reconfigure", previousLayout, layout, len(conflicts))
+	}
+	klog.Warningf("Continuing with the new layout because --force-reconfigure is set")
+	return nil
+}
+
+// recordLayout stores the fingerprint of the layout in use. Only the
+// leader writes it, after the startup check has accepted the layout.
+func recordLayout(ctx context.Context, store *state.Store, cfg *config.Configuration) {
+	if err := fingerprint.Save(ctx, store, cfg); err != nil {
+		klog.Errorf("Failed to record layout fingerprint: %v", err)
+	}
+}
+
+func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface, ctrl *controller.Controller, cfg *config.Configuration, store *state.Store, sharded bool, id string) {
+	allocating := tracksLayout(cfg)
+	runLease(ctx, clientset, cfg.LeaderElection, store.Namespace(), "podcidr-controller", id, leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			klog.Info("Started leading")
+			if allocating {
+				recordLayout(ctx, store, ctrl.Config())
+			}
+			ctrl.SetLeading(true)
+			if !sharded {
+				for _, name := range ctrl.Shards() {
+					ctrl.SetShardOwned(name, true)
+				}
+			}
+		},
+		OnStoppedLeading: func() {
+			klog.Info("Lost leadership")
+			ctrl.SetLeading(false)
+			if !sharded {
+				for _, name := range ctrl.Shards() {
+					ctrl.SetShardOwned(name, false)
+				}
+			}
+		},
+		OnNewLeader: func(identity string) {
+			if identity == id {
+				return
+			}
+			klog.Infof("New leader elected: %s", identity)
+		},
+	})
+}
 
-	return ctrl.Run(ctx, 2)
+// runTaintRemoverElection elects the taint remover with its own Lease, so
+// that it can lead on a different replica than the CIDR allocator
+func runTaintRemoverElection(ctx context.Context, clientset kubernetes.Interface, ctrl *controller.Controller, cfg *config.Configuration, namespace, id string) {
+	runLease(ctx, clientset, cfg.LeaderElection, namespace, "podcidr-controller-"+config.TaintRemover, id, leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(context.Context) {
+			klog.Info("Started leading the taint remover")
+			ctrl.SetTaintRemoverLeading(true)
+		},
+		OnStoppedLeading: func() {
+			klog.Info("Lost leadership of the taint remover")
+			ctrl.SetTaintRemoverLeading(false)
+		},
+	})
+}
+
+func runLease(ctx context.Context, clientset kubernetes.Interface, le config.LeaderElection, namespace, name, id string, callbacks leaderelection.LeaderCallbacks) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   le.LeaseDuration.Duration,
+		RenewDeadline:   le.RenewDeadline.Duration,
+		RetryPeriod:     le.RetryPeriod.Duration,
+		Callbacks:       callbacks,
+	})
 }
@@ -0,0 +1,100 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DefaultBackoff retries a failed delivery for about a minute
+var DefaultBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    6,
+}
+
+// Payload is the JSON body sent when a pool crosses a utilisation threshold.
+// Used, Free and Total count blocks of the pool's node CIDR mask size.
+type Payload struct {
+	Pool               string    `json:"pool"`
+	Threshold          int       `json:"threshold"`
+	Utilization        float64   `json:"utilization"`
+	Used               int       `json:"used"`
+	Free               int       `json:"free"`
+	Total              int       `json:"total"`
+	AllocationsLastDay int       `json:"allocationsLastDay"`
+	Time               time.Time `json:"time"`
+}
+
+// Webhook posts alerts to a generic HTTP endpoint
+type Webhook struct {
+	URL     string
+	Client  *http.Client
+	Backoff wait.Backoff
+}
+
+// NewWebhook creates a Webhook with the given request timeout
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{
+		URL:     url,
+		Client:  &http.Client{Timeout: timeout},
+		Backoff: DefaultBackoff,
+	}
+}
+
+// Send posts the payload, retrying with backoff on connection errors, 429
+// and 5xx responses. Other responses are not retried.
+func (w *Webhook) Send(ctx context.Context, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	err = wait.ExponentialBackoffWithContext(ctx, w.Backoff, func(ctx context.Context) (bool, error) {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			return true, nil
+		}
+		if !retry {
+			return false, err
+		}
+		lastErr = err
+		klog.V(2).Infof("Alert webhook delivery failed, retrying: %v", err)
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return fmt.Errorf("giving up on alert webhook: %w", lastErr)
+	}
+	return err
+}
+
+func (w *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
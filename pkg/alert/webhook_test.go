@@ -0,0 +1,63 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestSendRetries(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan Payload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	w := NewWebhook(server.URL, time.Second)
+	w.Backoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 5}
+
+	if err := w.Send(context.Background(), Payload{Pool: "default", Threshold: 80, Used: 205, Free: 51, Total: 256}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+	p := <-received
+	if p.Pool != "default" || p.Threshold != 80 || p.Free != 51 {
+		t.Errorf("unexpected payload %+v", p)
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	w := NewWebhook(server.URL, time.Second)
+	w.Backoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 5}
+
+	if err := w.Send(context.Background(), Payload{Pool: "default"}); err == nil {
+		t.Error("expected error for a rejected payload")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected client errors not to be retried, got %d attempts", calls.Load())
+	}
+}
@@ -0,0 +1,45 @@
+// Package clustercidr mirrors the networking.k8s.io/v1alpha1 ClusterCIDR
+// API of the upstream MultiCIDRRangeAllocator. The type left k8s.io/api
+// with Kubernetes 1.29, so objects are read through the dynamic client.
+package clustercidr
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Resource is the resource of ClusterCIDR objects
+var Resource = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1alpha1", Resource: "clustercidrs"}
+
+// ClusterCIDR is a range that nodes matching its selector receive their
+// podCIDRs from
+type ClusterCIDR struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Spec `json:"spec"`
+}
+
+// Spec is the range and the nodes of a ClusterCIDR
+type Spec struct {
+	// NodeSelector selects the nodes the range applies to, every node if
+	// nil
+	NodeSelector *corev1.NodeSelector `json:"nodeSelector,omitempty"`
+	// PerNodeHostBits is the number of host bits of a node's block, e.g. 8
+	// for a /24 from an IPv4 range
+	PerNodeHostBits int32  `json:"perNodeHostBits"`
+	IPv4            string `json:"ipv4,omitempty"`
+	IPv6            string `json:"ipv6,omitempty"`
+}
+
+// FromUnstructured converts an object read with the dynamic client
+func FromUnstructured(obj *unstructured.Unstructured) (*ClusterCIDR, error) {
+	cc := &ClusterCIDR{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
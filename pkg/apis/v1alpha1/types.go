@@ -0,0 +1,118 @@
+// Package v1alpha1 holds the podcidr.imroc.io/v1alpha1 custom resources.
+// They are read and written through the dynamic client and converted with
+// the helpers in this package, so no generated clientset is needed.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/imroc/podcidr-controller/pkg/selector"
+)
+
+const (
+	Group   = "podcidr.imroc.io"
+	Version = "v1alpha1"
+)
+
+var (
+	// PodCIDRPoolResource is the resource of PodCIDRPool objects
+	PodCIDRPoolResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "podcidrpools"}
+	// NodeCIDRAllocationResource is the resource of NodeCIDRAllocation
+	// objects
+	NodeCIDRAllocationResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "nodecidrallocations"}
+)
+
+// PodCIDRPool is a cluster-scoped pool that nodes receive their podCIDR
+// from, as an alternative to the pools of the configuration file
+type PodCIDRPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PodCIDRPoolSpec   `json:"spec"`
+	Status PodCIDRPoolStatus `json:"status,omitempty"`
+}
+
+// PodCIDRPoolSpec is the address plan of a pool
+type PodCIDRPoolSpec struct {
+	ClusterCIDR      string                `json:"clusterCIDR"`
+	NodeCIDRMaskSize int                   `json:"nodeCIDRMaskSize,omitempty"`
+	NodeSelector     []selector.Expression `json:"nodeSelector,omitempty"`
+	// Priority orders the pools a node may match; the highest wins, then
+	// the first name in alphabetical order
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// PodCIDRPoolStatus reports the usage of a pool in default-size blocks
+type PodCIDRPoolStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	TotalBlocks        int                `json:"totalBlocks"`
+	UsedBlocks         int                `json:"usedBlocks"`
+	FreeBlocks         int                `json:"freeBlocks"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// ConditionReady is True while the controller allocates from a pool
+	ConditionReady = "Ready"
+	// ConditionExhausted is True while a pool has no free block left
+	ConditionExhausted = "Exhausted"
+)
+
+// NodeLabel is set on NodeCIDRAllocation objects to the node name, when
+// the name is a valid label value
+const NodeLabel = "podcidr.imroc.io/node"
+
+// NodeCIDRAllocation is a cluster-scoped record of a block handed to a
+// node. It outlives the node until its retention expires.
+type NodeCIDRAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NodeCIDRAllocationSpec `json:"spec"`
+}
+
+// NodeCIDRAllocationSpec describes an allocation. ReleasedAt is set once
+// the node no longer holds the block.
+type NodeCIDRAllocationSpec struct {
+	NodeName string    `json:"nodeName"`
+	NodeUID  types.UID `json:"nodeUID"`
+	CIDR     string    `json:"cidr"`
+	// Pool is empty for a block outside every pool, e.g. set by another
+	// component
+	Pool        string       `json:"pool,omitempty"`
+	AllocatedAt metav1.Time  `json:"allocatedAt"`
+	ReleasedAt  *metav1.Time `json:"releasedAt,omitempty"`
+}
+
+// PodCIDRPoolFromUnstructured converts an object read with the dynamic
+// client
+func PodCIDRPoolFromUnstructured(obj *unstructured.Unstructured) (*PodCIDRPool, error) {
+	pool := &PodCIDRPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), pool); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// NodeCIDRAllocationFromUnstructured converts an object read with the
+// dynamic client
+func NodeCIDRAllocationFromUnstructured(obj *unstructured.Unstructured) (*NodeCIDRAllocation, error) {
+	allocation := &NodeCIDRAllocation{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), allocation); err != nil {
+		return nil, err
+	}
+	return allocation, nil
+}
+
+// ToUnstructured converts an object for the dynamic client
+func ToUnstructured(obj interface{}) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
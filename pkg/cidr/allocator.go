@@ -11,18 +11,36 @@ var (
 	ErrCIDRExhausted  = errors.New("CIDR range exhausted")
 	ErrCIDROutOfRange = errors.New("CIDR out of cluster range")
 	ErrInvalidCIDR    = errors.New("invalid CIDR format")
+	ErrNotSuperset    = errors.New("new cluster CIDR does not contain the current one")
 )
 
+// Allocator hands out node CIDR blocks from a cluster CIDR. Blocks are
+// naturally aligned powers of two, buddy-style, so blocks of different sizes
+// never overlap. The bitmap tracks the smallest block size allowed.
 type Allocator struct {
 	mu            sync.Mutex
 	clusterCIDR   *net.IPNet
 	maskSize      int
+	unitMaskSize  int
 	total         int
 	allocated     []bool
 	nextCandidate int
+
+	// excluded marks the units that overlap an excluded range. They are
+	// never handed out, independently of allocated.
+	exclusions []*net.IPNet
+	excluded   []bool
 }
 
 func NewAllocator(clusterCIDR string, nodeMaskSize int) (*Allocator, error) {
+	return NewVariableAllocator(clusterCIDR, nodeMaskSize, nodeMaskSize)
+}
+
+// NewVariableAllocator creates an Allocator whose default block size is
+// nodeMaskSize and that can also hand out blocks as small as maxMaskSize.
+// Larger blocks, down to one bit longer than the cluster mask, are always
+// possible.
+func NewVariableAllocator(clusterCIDR string, nodeMaskSize, maxMaskSize int) (*Allocator, error) {
 	_, ipnet, err := net.ParseCIDR(clusterCIDR)
 	if err != nil {
 		return nil, fmt.Errorf("invalid cluster CIDR: %w", err)
@@ -32,46 +50,295 @@ func NewAllocator(clusterCIDR string, nodeMaskSize int) (*Allocator, error) {
 	if nodeMaskSize <= clusterMaskSize {
 		return nil, fmt.Errorf("node mask size (%d) must be larger than cluster mask size (%d)", nodeMaskSize, clusterMaskSize)
 	}
+	if maxMaskSize < nodeMaskSize || maxMaskSize > 32 {
+		return nil, fmt.Errorf("max mask size (%d) must be between node mask size (%d) and 32", maxMaskSize, nodeMaskSize)
+	}
 
-	total := 1 << (nodeMaskSize - clusterMaskSize)
+	total := 1 << (maxMaskSize - clusterMaskSize)
 
 	return &Allocator{
 		clusterCIDR:   ipnet,
 		maskSize:      nodeMaskSize,
+		unitMaskSize:  maxMaskSize,
 		total:         total,
 		allocated:     make([]bool, total),
+		excluded:      make([]bool, total),
 		nextCandidate: 0,
 	}, nil
 }
 
+// Total returns the number of blocks of the default node mask size
 func (a *Allocator) Total() int {
-	return a.total
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.total >> (a.unitMaskSize - a.maskSize)
+}
+
+// Usage returns the number of default-size blocks that are fully or partly
+// allocated, and the total number of default-size blocks. Blocks that
+// overlap an excluded range only count while something is allocated in
+// them.
+func (a *Allocator) Usage() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	blockSize := 1 << (a.unitMaskSize - a.maskSize)
+	used, total := 0, 0
+	for idx := 0; idx < a.total; idx += blockSize {
+		allocated, excluded := false, false
+		for i := idx; i < idx+blockSize; i++ {
+			allocated = allocated || a.allocated[i]
+			excluded = excluded || a.excluded[i]
+		}
+		if allocated {
+			used++
+		}
+		if allocated || !excluded {
+			total++
+		}
+	}
+	return used, total
+}
+
+// ClusterCIDR returns the range the allocator allocates from
+func (a *Allocator) ClusterCIDR() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.clusterCIDR.String()
+}
+
+// Expand grows the allocator to a wider cluster CIDR that contains the
+// current one. Allocated and excluded blocks keep their addresses. When the
+// new range starts below the old one, every internal index shifts up by the
+// number of blocks in front of the old range, so a CIDR maps to a different
+// index than before; callers must identify blocks by CIDR, never by index.
+func (a *Allocator) Expand(newCIDR string) error {
+	_, ipnet, err := net.ParseCIDR(newCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid cluster CIDR: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkExpand(ipnet); err != nil {
+		return err
+	}
+	newMaskSize, _ := ipnet.Mask.Size()
+	oldMaskSize, _ := a.clusterCIDR.Mask.Size()
+	if newMaskSize == oldMaskSize {
+		return nil
+	}
+
+	total := 1 << (a.unitMaskSize - newMaskSize)
+	offset := int((ipToUint32(a.clusterCIDR.IP) - ipToUint32(ipnet.IP)) >> (32 - a.unitMaskSize))
+
+	allocated := make([]bool, total)
+	copy(allocated[offset:], a.allocated)
+
+	a.clusterCIDR = ipnet
+	a.total = total
+	a.allocated = allocated
+	a.nextCandidate += offset
+	a.applyExclusions()
+	return nil
+}
+
+// CheckExpand returns the error Expand would return for newCIDR, without
+// changing the allocator
+func (a *Allocator) CheckExpand(newCIDR string) error {
+	_, ipnet, err := net.ParseCIDR(newCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid cluster CIDR: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.checkExpand(ipnet)
+}
+
+func (a *Allocator) checkExpand(ipnet *net.IPNet) error {
+	newMaskSize, _ := ipnet.Mask.Size()
+	oldMaskSize, _ := a.clusterCIDR.Mask.Size()
+	if newMaskSize > oldMaskSize || !ipnet.Contains(a.clusterCIDR.IP) {
+		return fmt.Errorf("%w: %s does not contain %s", ErrNotSuperset, ipnet, a.clusterCIDR)
+	}
+	return nil
+}
+
+// ParseExclusions parses the ranges to pass to SetExclusions
+func ParseExclusions(cidrs []string) ([]*net.IPNet, error) {
+	exclusions := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCIDR, c)
+		}
+		exclusions = append(exclusions, ipnet)
+	}
+	return exclusions, nil
+}
+
+// SetExcluded replaces the ranges that are never allocated. Ranges may have
+// any size; the blocks they overlap are skipped and the parts outside the
+// cluster CIDR are ignored. Blocks already allocated stay allocated.
+func (a *Allocator) SetExcluded(cidrs []string) error {
+	exclusions, err := ParseExclusions(cidrs)
+	if err != nil {
+		return err
+	}
+	a.SetExclusions(exclusions)
+	return nil
+}
+
+// SetExclusions is SetExcluded with ranges parsed by ParseExclusions
+func (a *Allocator) SetExclusions(exclusions []*net.IPNet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.exclusions = exclusions
+	a.applyExclusions()
+}
+
+// applyExclusions rebuilds the excluded bitmap from the exclusions
+func (a *Allocator) applyExclusions() {
+	a.excluded = make([]bool, a.total)
+	clusterFirst := ipToUint32(a.clusterCIDR.IP)
+	clusterLast := lastIP(a.clusterCIDR)
+	bitsToShift := 32 - a.unitMaskSize
+	for _, ipnet := range a.exclusions {
+		first, last := max(ipToUint32(ipnet.IP), clusterFirst), min(lastIP(ipnet), clusterLast)
+		if first > last {
+			continue
+		}
+		for i := int((first - clusterFirst) >> bitsToShift); i <= int((last-clusterFirst)>>bitsToShift); i++ {
+			a.excluded[i] = true
+		}
+	}
+}
+
+// IsExcluded reports whether any part of a block is excluded
+func (a *Allocator) IsExcluded(cidr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	idx, size, err := a.cidrToRange(cidr)
+	if err != nil {
+		return false
+	}
+	for i := idx; i < idx+size; i++ {
+		if a.excluded[i] {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Allocator) AllocateNext() (string, error) {
+	return a.AllocateNextSize(a.maskSize)
+}
+
+// AllocateNextSize allocates the next free block with the given mask size.
+// Blocks smaller than the default size are packed into default-size blocks
+// that are already split, to keep whole blocks free for other nodes.
+func (a *Allocator) AllocateNextSize(maskSize int) (string, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	for i := 0; i < a.total; i++ {
-		idx := (a.nextCandidate + i) % a.total
-		if !a.allocated[idx] {
-			a.allocated[idx] = true
-			a.nextCandidate = (idx + 1) % a.total
-			return a.indexToCIDR(idx), nil
+	clusterMaskSize, _ := a.clusterCIDR.Mask.Size()
+	if maskSize <= clusterMaskSize || maskSize > a.unitMaskSize {
+		return "", fmt.Errorf("%w: mask size %d not allocatable from %s", ErrCIDROutOfRange, maskSize, a.clusterCIDR)
+	}
+
+	size := 1 << (a.unitMaskSize - maskSize)
+	if maskSize > a.maskSize {
+		if idx, ok := a.findFree(size, true); ok {
+			return a.take(idx, size, maskSize), nil
 		}
 	}
+	if idx, ok := a.findFree(size, false); ok {
+		return a.take(idx, size, maskSize), nil
+	}
 	return "", ErrCIDRExhausted
 }
 
+// AllocateFrom allocates the first free block with the given mask size at
+// or after the preferred block, counted in blocks of that size and wrapped
+// around the cluster CIDR. It also returns how many taken blocks were
+// probed before the free one.
+func (a *Allocator) AllocateFrom(preferred uint64, maskSize int) (string, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	clusterMaskSize, _ := a.clusterCIDR.Mask.Size()
+	if maskSize <= clusterMaskSize || maskSize > a.unitMaskSize {
+		return "", 0, fmt.Errorf("%w: mask size %d not allocatable from %s", ErrCIDROutOfRange, maskSize, a.clusterCIDR)
+	}
+
+	size := 1 << (a.unitMaskSize - maskSize)
+	blocks := a.total / size
+	first := int(preferred % uint64(blocks))
+	for i := 0; i < blocks; i++ {
+		idx := ((first + i) % blocks) * size
+		if a.isFree(idx, size) {
+			a.setRange(idx, size, true)
+			return a.indexToCIDR(idx, maskSize), i, nil
+		}
+	}
+	return "", blocks, ErrCIDRExhausted
+}
+
+// findFree returns the first free aligned block of size units, scanning
+// from nextCandidate. With packed set, only blocks inside a default-size
+// block that is already partly allocated are considered.
+func (a *Allocator) findFree(size int, packed bool) (int, bool) {
+	blocks := a.total / size
+	first := (a.nextCandidate + size - 1) / size
+	for i := 0; i < blocks; i++ {
+		idx := ((first + i) % blocks) * size
+		if !a.isFree(idx, size) {
+			continue
+		}
+		if packed {
+			parentSize := 1 << (a.unitMaskSize - a.maskSize)
+			if a.isFree(idx/parentSize*parentSize, parentSize) {
+				continue
+			}
+		}
+		return idx, true
+	}
+	return 0, false
+}
+
+func (a *Allocator) isFree(idx, size int) bool {
+	for i := idx; i < idx+size; i++ {
+		if a.allocated[i] || a.excluded[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Allocator) take(idx, size, maskSize int) string {
+	a.setRange(idx, size, true)
+	a.nextCandidate = (idx + size) % a.total
+	return a.indexToCIDR(idx, maskSize)
+}
+
+func (a *Allocator) setRange(idx, size int, allocated bool) {
+	for i := idx; i < idx+size; i++ {
+		a.allocated[i] = allocated
+	}
+}
+
 func (a *Allocator) MarkAllocated(cidr string) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	idx, err := a.cidrToIndex(cidr)
+	idx, size, err := a.cidrToRange(cidr)
 	if err != nil {
 		return err
 	}
-	a.allocated[idx] = true
+	a.setRange(idx, size, true)
 	return nil
 }
 
@@ -79,11 +346,11 @@ func (a *Allocator) Release(cidr string) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	idx, err := a.cidrToIndex(cidr)
+	idx, size, err := a.cidrToRange(cidr)
 	if err != nil {
 		return err
 	}
-	a.allocated[idx] = false
+	a.setRange(idx, size, false)
 	// Reset nextCandidate to allow immediate reuse of released CIDR
 	if idx < a.nextCandidate {
 		a.nextCandidate = idx
@@ -91,56 +358,80 @@ func (a *Allocator) Release(cidr string) error {
 	return nil
 }
 
+// IsAllocated reports whether the whole block is allocated
 func (a *Allocator) IsAllocated(cidr string) bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	idx, err := a.cidrToIndex(cidr)
+	idx, size, err := a.cidrToRange(cidr)
 	if err != nil {
 		return false
 	}
-	return a.allocated[idx]
+	for i := idx; i < idx+size; i++ {
+		if !a.allocated[i] {
+			return false
+		}
+	}
+	return true
 }
 
-func (a *Allocator) indexToCIDR(idx int) string {
-	ip := make(net.IP, len(a.clusterCIDR.IP))
-	copy(ip, a.clusterCIDR.IP)
+// InUse reports whether any part of a block is allocated. It returns
+// ErrCIDROutOfRange if the block cannot be allocated from this allocator.
+func (a *Allocator) InUse(cidr string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	bitsToShift := 32 - a.maskSize
+	idx, size, err := a.cidrToRange(cidr)
+	if err != nil {
+		return false, err
+	}
+	for i := idx; i < idx+size; i++ {
+		if a.allocated[i] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a *Allocator) indexToCIDR(idx, maskSize int) string {
+	bitsToShift := 32 - a.unitMaskSize
 	offset := idx << bitsToShift
 
-	ipInt := ipToUint32(ip)
+	ipInt := ipToUint32(a.clusterCIDR.IP)
 	ipInt += uint32(offset)
 	resultIP := uint32ToIP(ipInt)
 
-	return fmt.Sprintf("%s/%d", resultIP.String(), a.maskSize)
+	return fmt.Sprintf("%s/%d", resultIP.String(), maskSize)
 }
 
-func (a *Allocator) cidrToIndex(cidr string) (int, error) {
+// cidrToRange returns the first unit and the number of units of a block
+func (a *Allocator) cidrToRange(cidr string) (int, int, error) {
 	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return 0, ErrInvalidCIDR
+	if err != nil || ip.To4() == nil {
+		return 0, 0, ErrInvalidCIDR
 	}
 
 	maskSize, _ := ipnet.Mask.Size()
-	if maskSize != a.maskSize {
-		return 0, ErrCIDROutOfRange
+	clusterMaskSize, _ := a.clusterCIDR.Mask.Size()
+	if maskSize <= clusterMaskSize || maskSize > a.unitMaskSize {
+		return 0, 0, ErrCIDROutOfRange
 	}
 
-	if !a.clusterCIDR.Contains(ip) {
-		return 0, ErrCIDROutOfRange
+	if !a.clusterCIDR.Contains(ipnet.IP) {
+		return 0, 0, ErrCIDROutOfRange
 	}
 
 	clusterIP := ipToUint32(a.clusterCIDR.IP)
-	nodeIP := ipToUint32(ip.To4())
-	bitsToShift := 32 - a.maskSize
+	nodeIP := ipToUint32(ipnet.IP)
+	bitsToShift := 32 - a.unitMaskSize
 	idx := int((nodeIP - clusterIP) >> bitsToShift)
+	size := 1 << (a.unitMaskSize - maskSize)
 
-	if idx < 0 || idx >= a.total {
-		return 0, ErrCIDROutOfRange
+	if idx < 0 || idx+size > a.total {
+		return 0, 0, ErrCIDROutOfRange
 	}
 
-	return idx, nil
+	return idx, size, nil
 }
 
 func ipToUint32(ip net.IP) uint32 {
@@ -148,6 +439,41 @@ func ipToUint32(ip net.IP) uint32 {
 	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
 }
 
+// lastIP returns the last address of a range as an integer
+func lastIP(ipnet *net.IPNet) uint32 {
+	ones, _ := ipnet.Mask.Size()
+	return ipToUint32(ipnet.IP) | uint32(1<<(32-ones)-1)
+}
+
 func uint32ToIP(n uint32) net.IP {
 	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
 }
+
+// Split divides a CIDR into n equally sized sub-CIDRs. n must be a power of two.
+func Split(cidr string, n int) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %w", err)
+	}
+	if n < 1 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("split count %d is not a power of two", n)
+	}
+
+	maskSize, bits := ipnet.Mask.Size()
+	extraBits := 0
+	for 1<<extraBits < n {
+		extraBits++
+	}
+	subMaskSize := maskSize + extraBits
+	if subMaskSize > bits {
+		return nil, fmt.Errorf("cannot split %s into %d parts", cidr, n)
+	}
+
+	base := ipToUint32(ipnet.IP)
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		ip := uint32ToIP(base + uint32(i)<<(32-subMaskSize))
+		result[i] = fmt.Sprintf("%s/%d", ip.String(), subMaskSize)
+	}
+	return result, nil
+}
@@ -1,6 +1,7 @@
 package cidr
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -88,3 +89,261 @@ func TestMarkAllocatedOutOfRange(t *testing.T) {
 		t.Error("expected error for out-of-range CIDR")
 	}
 }
+
+func TestSplit(t *testing.T) {
+	parts, err := Split("10.244.0.0/16", 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"10.244.0.0/18", "10.244.64.0/18", "10.244.128.0/18", "10.244.192.0/18"}
+	if len(parts) != len(expected) {
+		t.Fatalf("expected %d parts, got %d", len(expected), len(parts))
+	}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("part %d: expected %s, got %s", i, expected[i], parts[i])
+		}
+	}
+
+	if _, err := Split("10.244.0.0/16", 3); err == nil {
+		t.Error("expected error for non power of two split")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	alloc, _ := NewAllocator("10.244.0.0/17", 24)
+	_ = alloc.MarkAllocated("10.244.0.0/24")
+	_ = alloc.MarkAllocated("10.244.127.0/24")
+
+	if err := alloc.Expand("10.244.0.0/16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if alloc.Total() != 256 {
+		t.Errorf("expected 256 subnets, got %d", alloc.Total())
+	}
+	if !alloc.IsAllocated("10.244.0.0/24") || !alloc.IsAllocated("10.244.127.0/24") {
+		t.Error("expected existing allocations to be kept")
+	}
+	if err := alloc.MarkAllocated("10.244.200.0/24"); err != nil {
+		t.Errorf("expected new range to be usable: %v", err)
+	}
+}
+
+func TestExpandShiftedBase(t *testing.T) {
+	alloc, _ := NewAllocator("10.244.128.0/17", 24)
+	_ = alloc.MarkAllocated("10.244.128.0/24")
+
+	if err := alloc.Expand("10.244.0.0/16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !alloc.IsAllocated("10.244.128.0/24") {
+		t.Error("expected existing allocation to be kept")
+	}
+
+	cidr, _ := alloc.AllocateNext()
+	if cidr != "10.244.129.0/24" {
+		t.Errorf("expected allocation to continue after existing blocks, got %s", cidr)
+	}
+}
+
+func TestExpandDownwardKeepsBlocks(t *testing.T) {
+	alloc, _ := NewVariableAllocator("10.244.128.0/17", 24, 26)
+	_ = alloc.MarkAllocated("10.244.128.0/24")
+	_ = alloc.MarkAllocated("10.244.200.64/26")
+
+	// 10.244.0.0/16 puts 128 blocks in front of the old range
+	if err := alloc.Expand("10.244.0.0/16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, cidr := range []string{"10.244.128.0/24", "10.244.200.64/26"} {
+		if !alloc.IsAllocated(cidr) {
+			t.Errorf("expected %s to stay allocated", cidr)
+		}
+	}
+	// The blocks the old indices now point at are free
+	for _, cidr := range []string{"10.244.0.0/24", "10.244.72.64/26"} {
+		if alloc.IsAllocated(cidr) {
+			t.Errorf("expected %s to be free", cidr)
+		}
+	}
+
+	for _, cidr := range []string{"10.244.128.0/24", "10.244.200.64/26"} {
+		if err := alloc.Release(cidr); err != nil {
+			t.Fatalf("unexpected error releasing %s: %v", cidr, err)
+		}
+		if alloc.IsAllocated(cidr) {
+			t.Errorf("expected %s to be released", cidr)
+		}
+	}
+	if used, _ := alloc.Usage(); used != 0 {
+		t.Errorf("expected nothing in use after releasing, got %d blocks", used)
+	}
+}
+
+func TestExpandRefused(t *testing.T) {
+	alloc, _ := NewAllocator("10.244.0.0/16", 24)
+
+	for _, cidr := range []string{"10.245.0.0/16", "10.244.0.0/17", "10.0.0.0/15"} {
+		if err := alloc.Expand(cidr); !errors.Is(err, ErrNotSuperset) {
+			t.Errorf("expected ErrNotSuperset expanding to %s, got %v", cidr, err)
+		}
+	}
+	if alloc.ClusterCIDR() != "10.244.0.0/16" {
+		t.Errorf("expected cluster CIDR to be unchanged, got %s", alloc.ClusterCIDR())
+	}
+}
+
+func TestAllocateNextSize(t *testing.T) {
+	alloc, err := NewVariableAllocator("10.244.0.0/16", 24, 26)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if alloc.Total() != 256 {
+		t.Errorf("expected 256 subnets, got %d", alloc.Total())
+	}
+
+	tests := []struct {
+		maskSize int
+		expected string
+	}{
+		{24, "10.244.0.0/24"},
+		// A /23 must be aligned and skips the rest of 10.244.0.0/23
+		{23, "10.244.2.0/23"},
+		{26, "10.244.4.0/26"},
+		// Small blocks are packed into the already split /24
+		{26, "10.244.4.64/26"},
+		{24, "10.244.5.0/24"},
+		{25, "10.244.4.128/25"},
+	}
+	for _, tt := range tests {
+		cidr, err := alloc.AllocateNextSize(tt.maskSize)
+		if err != nil {
+			t.Fatalf("unexpected error allocating /%d: %v", tt.maskSize, err)
+		}
+		if cidr != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, cidr)
+		}
+	}
+
+	if _, err := alloc.AllocateNextSize(27); !errors.Is(err, ErrCIDROutOfRange) {
+		t.Errorf("expected ErrCIDROutOfRange for a mask larger than the max, got %v", err)
+	}
+}
+
+func TestVariableSizesDoNotOverlap(t *testing.T) {
+	alloc, _ := NewVariableAllocator("10.244.0.0/22", 24, 26)
+	_ = alloc.MarkAllocated("10.244.1.64/26")
+
+	// 10.244.0.0/23 overlaps the /26 and must be skipped
+	cidr, err := alloc.AllocateNextSize(23)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cidr != "10.244.2.0/23" {
+		t.Errorf("expected 10.244.2.0/23, got %s", cidr)
+	}
+	if _, err := alloc.AllocateNextSize(23); !errors.Is(err, ErrCIDRExhausted) {
+		t.Errorf("expected ErrCIDRExhausted, got %v", err)
+	}
+
+	// Releasing the /26 frees the first /23 again
+	_ = alloc.Release("10.244.1.64/26")
+	cidr, _ = alloc.AllocateNextSize(23)
+	if cidr != "10.244.0.0/23" {
+		t.Errorf("expected 10.244.0.0/23, got %s", cidr)
+	}
+	if !alloc.IsAllocated("10.244.1.0/24") {
+		t.Error("expected a block inside an allocated /23 to be reported as allocated")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	alloc, _ := NewVariableAllocator("10.244.0.0/22", 24, 26)
+	_ = alloc.MarkAllocated("10.244.0.0/24")
+	_ = alloc.MarkAllocated("10.244.2.64/26")
+
+	used, total := alloc.Usage()
+	if used != 2 || total != 4 {
+		t.Errorf("expected 2 of 4 blocks used, got %d of %d", used, total)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	alloc, _ := NewAllocator("10.244.0.0/16", 24)
+	alloc.MarkAllocated("10.244.1.0/24")
+
+	// Ranges of any size, partly outside the cluster CIDR
+	if err := alloc.SetExcluded([]string{"10.244.0.128/25", "10.244.1.0/24", "10.243.0.0/16", "10.244.2.0/23"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !alloc.IsExcluded("10.244.0.0/24") || alloc.IsExcluded("10.244.4.0/24") {
+		t.Error("expected exactly the overlapped blocks to be excluded")
+	}
+	if inUse, _ := alloc.InUse("10.244.1.0/24"); !inUse {
+		t.Error("expected an allocated block to stay allocated when excluded")
+	}
+	if _, err := alloc.InUse("10.245.0.0/24"); !errors.Is(err, ErrCIDROutOfRange) {
+		t.Errorf("expected ErrCIDROutOfRange, got %v", err)
+	}
+
+	cidr, err := alloc.AllocateNext()
+	if err != nil || cidr != "10.244.4.0/24" {
+		t.Errorf("expected 10.244.4.0/24, got %s, %v", cidr, err)
+	}
+	if used, total := alloc.Usage(); used != 2 || total != 253 {
+		t.Errorf("expected 2 of 253 blocks used, got %d of %d", used, total)
+	}
+
+	// Released exclusions become allocatable again
+	if err := alloc.SetExcluded(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	alloc.Release("10.244.1.0/24")
+	if cidr, _ := alloc.AllocateNext(); cidr != "10.244.1.0/24" || alloc.IsExcluded("10.244.0.0/24") {
+		t.Errorf("expected 10.244.1.0/24 without exclusions, got %s", cidr)
+	}
+
+	if err := alloc.SetExcluded([]string{"fd00::/64"}); !errors.Is(err, ErrInvalidCIDR) {
+		t.Errorf("expected ErrInvalidCIDR, got %v", err)
+	}
+}
+
+func TestExcludedAfterExpand(t *testing.T) {
+	alloc, _ := NewAllocator("10.244.0.0/17", 24)
+	alloc.SetExcluded([]string{"10.244.128.0/24"})
+	if err := alloc.Expand("10.244.0.0/16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !alloc.IsExcluded("10.244.128.0/24") {
+		t.Error("expected an exclusion to apply to the expanded range")
+	}
+}
+
+func TestAllocateFrom(t *testing.T) {
+	alloc, _ := NewVariableAllocator("10.244.0.0/16", 24, 26)
+	alloc.SetExcluded([]string{"10.244.4.0/24"})
+
+	cidr, probed, err := alloc.AllocateFrom(3, 24)
+	if err != nil || cidr != "10.244.3.0/24" || probed != 0 {
+		t.Fatalf("expected 10.244.3.0/24 without probing, got %s, %d, %v", cidr, probed, err)
+	}
+	// Taken and excluded blocks are probed past
+	cidr, probed, err = alloc.AllocateFrom(3, 24)
+	if err != nil || cidr != "10.244.5.0/24" || probed != 2 {
+		t.Errorf("expected 10.244.5.0/24 after 2 probes, got %s, %d, %v", cidr, probed, err)
+	}
+	// The preferred block wraps around the cluster CIDR
+	if cidr, _, _ := alloc.AllocateFrom(256+7, 24); cidr != "10.244.7.0/24" {
+		t.Errorf("expected 10.244.7.0/24, got %s", cidr)
+	}
+	if cidr, _, _ := alloc.AllocateFrom(1023, 26); cidr != "10.244.255.192/26" {
+		t.Errorf("expected 10.244.255.192/26, got %s", cidr)
+	}
+
+	full, _ := NewAllocator("10.244.0.0/23", 24)
+	full.AllocateFrom(0, 24)
+	full.AllocateFrom(0, 24)
+	if _, _, err := full.AllocateFrom(1, 24); !errors.Is(err, ErrCIDRExhausted) {
+		t.Errorf("expected ErrCIDRExhausted, got %v", err)
+	}
+}
@@ -0,0 +1,756 @@
+package config
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/imroc/podcidr-controller/pkg/cidr"
+	"github.com/imroc/podcidr-controller/pkg/selector"
+	"github.com/imroc/podcidr-controller/pkg/taint"
+)
+
+const (
+	APIVersion = "config.podcidr.imroc.io/v1alpha1"
+	Kind       = "PodCIDRControllerConfiguration"
+
+	// DefaultPoolName is the name of the pool built from command line flags
+	DefaultPoolName = "default"
+
+	// Sub-controllers that can be enabled with controllers or --controllers
+	CIDRAllocator = "cidr-allocator"
+	TaintRemover  = "taint-remover"
+
+	// PoolSourcePodCIDRPool reads the pools from PodCIDRPool objects
+	PoolSourcePodCIDRPool = "PodCIDRPool"
+	// PoolSourceClusterCIDR reads the pools from the networking.k8s.io
+	// ClusterCIDR objects of the upstream multi-CIDR API
+	PoolSourceClusterCIDR = "ClusterCIDR"
+
+	// OverlapProtectionExclude excludes the Service CIDRs and node addresses
+	// that overlap a pool from allocation
+	OverlapProtectionExclude = "Exclude"
+	// OverlapProtectionRefuse refuses to start while they overlap a pool,
+	// and excludes overlaps that appear later
+	OverlapProtectionRefuse = "Refuse"
+
+	// StrategySequential hands out the next free block
+	StrategySequential = "Sequential"
+	// StrategyNodeIP derives the block from the node's InternalIP
+	StrategyNodeIP = "NodeIP"
+	// StrategyNameHash derives the block from a hash of the node name
+	StrategyNameHash = "NameHash"
+)
+
+// AllControllers are the sub-controllers enabled by default
+var AllControllers = []string{CIDRAllocator, TaintRemover}
+
+// Configuration is the versioned configuration file of podcidr-controller
+type Configuration struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Controllers are the sub-controllers to run, all of them by default
+	Controllers []string `json:"controllers,omitempty"`
+
+	// Pools are the cluster CIDRs to allocate from. A node receives its
+	// podCIDR from the first pool whose node selector matches it.
+	Pools []Pool `json:"pools"`
+
+	// PoolSource reads the pools from custom resources instead of Pools:
+	// PodCIDRPool or ClusterCIDR
+	PoolSource string `json:"poolSource,omitempty"`
+
+	// RemoveTaints are taint rules in the --remove-taints formats
+	RemoveTaints []string `json:"removeTaints,omitempty"`
+
+	LeaderElection LeaderElection `json:"leaderElection,omitempty"`
+
+	NodeStatus NodeStatus `json:"nodeStatus,omitempty"`
+
+	// AlertWebhook receives a JSON payload when a pool crosses one of its
+	// utilizationThresholds
+	AlertWebhook *AlertWebhook `json:"alertWebhook,omitempty"`
+
+	// AllocationLimit caps allocations across all pools
+	AllocationLimit *AllocationLimit `json:"allocationLimit,omitempty"`
+
+	// Quotas cap the blocks that groups of nodes may hold
+	Quotas []Quota `json:"quotas,omitempty"`
+
+	Admission Admission `json:"admission,omitempty"`
+
+	// AllocationRecords keeps a NodeCIDRAllocation object per allocation
+	AllocationRecords *AllocationRecords `json:"allocationRecords,omitempty"`
+
+	// Migration takes allocation over from kube-controller-manager
+	Migration *Migration `json:"migration,omitempty"`
+
+	// OverlapProtection guards the pools against ServiceCIDR objects and
+	// node addresses: Exclude or Refuse, disabled if empty
+	OverlapProtection string `json:"overlapProtection,omitempty"`
+
+	// AllocationPreconditions hold new nodes back from allocation until
+	// they are initialised
+	AllocationPreconditions *AllocationPreconditions `json:"allocationPreconditions,omitempty"`
+
+	// AllocationPriority orders the nodes waiting for a block
+	AllocationPriority *AllocationPriority `json:"allocationPriority,omitempty"`
+}
+
+// AllocationPriority orders the allocation queue, so that important nodes
+// get the remaining blocks first when capacity is scarce. Changes apply
+// live.
+type AllocationPriority struct {
+	// Rules give a node the priority of the first rule that matches it, 0
+	// if none does. Higher priorities are allocated first.
+	Rules []PriorityRule `json:"rules,omitempty"`
+	// OldestFirst orders nodes of the same priority by creation time
+	// instead of the order they were queued in
+	OldestFirst bool `json:"oldestFirst,omitempty"`
+}
+
+// PriorityRule matches nodes by label and by the pool they are allocated
+// from. Empty fields match every node.
+type PriorityRule struct {
+	Priority     int                   `json:"priority"`
+	NodeSelector []selector.Expression `json:"nodeSelector,omitempty"`
+	Pool         string                `json:"pool,omitempty"`
+}
+
+// AllocationPreconditions must all be met before a node is allocated its
+// first block. Nodes that do not meet them yet are requeued. Changes apply
+// live.
+type AllocationPreconditions struct {
+	// RequireProviderID waits for spec.providerID, set once the cloud
+	// provider has initialised the node
+	RequireProviderID bool `json:"requireProviderID,omitempty"`
+	// AbsentTaints waits until none of these taints, in the
+	// --remove-taints formats, is on the node
+	AbsentTaints []string `json:"absentTaints,omitempty"`
+	// RequiredLabels waits for these labels, as key or key=value
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+	// MinNodeAge waits until the node was created this long ago
+	MinNodeAge metav1.Duration `json:"minNodeAge,omitempty"`
+}
+
+// Migration hands CIDR allocation over from the range allocator of
+// kube-controller-manager. The controller checks that
+// kube-controller-manager uses the cluster CIDR and mask size of a pool,
+// imports the existing allocations and only observes until the
+// migration.podcidr.imroc.io/active annotation is set on the state
+// ConfigMap.
+type Migration struct {
+	// SkipVerify starts without checking the settings of
+	// kube-controller-manager, e.g. when its pod is not visible
+	SkipVerify bool `json:"skipVerify,omitempty"`
+}
+
+// AllocationRecords controls the NodeCIDRAllocation objects that record
+// every block handed to a node. Retention changes apply live.
+type AllocationRecords struct {
+	// Retention is how long the record of a released block is kept
+	Retention metav1.Duration `json:"retention,omitempty"`
+}
+
+// Admission holds the settings of the admission webhooks. Changes apply
+// live.
+type Admission struct {
+	// BypassServiceAccounts may set any podCIDR on a node, as
+	// namespace/name
+	BypassServiceAccounts []string `json:"bypassServiceAccounts,omitempty"`
+}
+
+// Quota caps the number of blocks held together by the nodes matching a
+// selector, counting extra blocks. A node matching several quotas must fit
+// in all of them.
+type Quota struct {
+	Name         string                `json:"name"`
+	NodeSelector []selector.Expression `json:"nodeSelector,omitempty"`
+	MaxBlocks    int                   `json:"maxBlocks"`
+}
+
+// AllocationLimit caps how many nodes can receive a CIDR within a sliding
+// window. Reaching it opens a circuit that holds all further allocations
+// until an operator acknowledges it.
+type AllocationLimit struct {
+	MaxAllocations int             `json:"maxAllocations"`
+	Window         metav1.Duration `json:"window"`
+}
+
+// AlertWebhook is a generic HTTP endpoint for capacity alerts
+type AlertWebhook struct {
+	URL     string          `json:"url"`
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// NodeStatus controls what the controller reports on nodes besides the
+// PodCIDRAllocated condition. Changes apply live.
+type NodeStatus struct {
+	// TaintUnallocated adds a NoSchedule taint to nodes that cannot get a
+	// CIDR, removed once one is assigned
+	TaintUnallocated bool `json:"taintUnallocated,omitempty"`
+	// SetNetworkAvailable sets NetworkUnavailable=False once a node has a
+	// CIDR, for clusters without a route controller
+	SetNetworkAvailable bool `json:"setNetworkAvailable,omitempty"`
+}
+
+// Pool is a cluster CIDR and the nodes that receive podCIDRs from it
+type Pool struct {
+	Name             string                `json:"name"`
+	ClusterCIDR      string                `json:"clusterCIDR"`
+	NodeCIDRMaskSize int                   `json:"nodeCIDRMaskSize,omitempty"`
+	NodeSelector     []selector.Expression `json:"nodeSelector,omitempty"`
+	// Shards splits the cluster CIDR into equal ranges owned by different
+	// replicas. A node only allocates from the shard its name hashes to,
+	// so a shard can run out while others still have free blocks.
+	Shards int `json:"shards,omitempty"`
+
+	// MaskSizePolicy lets nodes receive blocks other than NodeCIDRMaskSize
+	MaskSizePolicy *MaskSizePolicy `json:"maskSizePolicy,omitempty"`
+
+	// ExtraCIDRs lets a node receive more blocks once it outgrows its first
+	ExtraCIDRs *ExtraCIDRs `json:"extraCIDRs,omitempty"`
+
+	// UtilizationThresholds are percentages of used blocks at which a
+	// Warning Event is emitted and the alert webhook is called
+	UtilizationThresholds []int `json:"utilizationThresholds,omitempty"`
+
+	// AllocationLimit caps allocations from this pool
+	AllocationLimit *AllocationLimit `json:"allocationLimit,omitempty"`
+
+	// ExcludeCIDRs are ranges inside the cluster CIDR that are never
+	// allocated, e.g. addresses used by something else
+	ExcludeCIDRs []string `json:"excludeCIDRs,omitempty"`
+
+	// Strategy picks a node's block: Sequential (default), NodeIP or
+	// NameHash. The deterministic strategies probe the following blocks
+	// when the derived one is taken.
+	Strategy string `json:"strategy,omitempty"`
+
+	// NodeIP maps node addresses to blocks with the NodeIP strategy
+	NodeIP *NodeIPMapping `json:"nodeIP,omitempty"`
+}
+
+// NodeIPMapping derives a block index from a node's InternalIP: the offset
+// of the address in Subnet, shifted right by HostBits, modulo the number of
+// blocks. With subnet 192.168.0.0/16 and hostBits 8, node 192.168.3.17 gets
+// block 3, e.g. 10.244.3.0/24.
+type NodeIPMapping struct {
+	// Subnet is the node network the addresses are taken from
+	Subnet string `json:"subnet"`
+	// HostBits are the low address bits ignored by the mapping
+	HostBits int `json:"hostBits,omitempty"`
+}
+
+// Deterministic reports whether the pool derives blocks from the node
+func (p *Pool) Deterministic() bool {
+	return p.Strategy == StrategyNodeIP || p.Strategy == StrategyNameHash
+}
+
+// ExtraCIDRs controls additional blocks per node. Extra blocks have the
+// size of the node's first block and are published in the
+// podcidr.imroc.io/extra-pod-cidrs annotation.
+type ExtraCIDRs struct {
+	// MaxPerNode is the most blocks a node can hold, including the first
+	MaxPerNode int `json:"maxPerNode"`
+	// PodUtilizationThreshold is the percentage of a node's pod addresses
+	// in use at which another block is allocated. 0 only honours the
+	// podcidr.imroc.io/pod-cidr-count annotation.
+	PodUtilizationThreshold int `json:"podUtilizationThreshold,omitempty"`
+}
+
+// MaskSizePolicy decides the node CIDR mask size per node. The
+// podcidr.imroc.io/node-cidr-mask-size annotation or label wins, then the
+// instance type table, then the node's pod capacity if enabled.
+type MaskSizePolicy struct {
+	// MinNodeCIDRMaskSize is the largest block a node can receive
+	MinNodeCIDRMaskSize int `json:"minNodeCIDRMaskSize,omitempty"`
+	// MaxNodeCIDRMaskSize is the smallest block a node can receive
+	MaxNodeCIDRMaskSize int `json:"maxNodeCIDRMaskSize,omitempty"`
+	// InstanceTypes maps node.kubernetes.io/instance-type to a mask size
+	InstanceTypes map[string]int `json:"instanceTypes,omitempty"`
+	// FromPodCapacity derives the mask size from status.capacity.pods
+	FromPodCapacity bool `json:"fromPodCapacity,omitempty"`
+}
+
+func (m *NodeIPMapping) validate() error {
+	if m == nil {
+		return fmt.Errorf("required")
+	}
+	_, subnet, err := net.ParseCIDR(m.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("subnet: %q is not an IPv4 CIDR", m.Subnet)
+	}
+	ones, _ := subnet.Mask.Size()
+	if m.HostBits < 0 || m.HostBits > 32-ones {
+		return fmt.Errorf("hostBits: must be between 0 and %d", 32-ones)
+	}
+	return nil
+}
+
+// LeaderElection holds the leader election settings
+type LeaderElection struct {
+	LeaderElect   *bool           `json:"leaderElect,omitempty"`
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod,omitempty"`
+
+	// SeparateLeases elects the taint remover with its own Lease, so that
+	// it can lead on a different replica than the CIDR allocator
+	SeparateLeases bool `json:"separateLeases,omitempty"`
+}
+
+// MaskSizeRange returns the smallest and largest mask size a node of the
+// pool can receive
+func (p *Pool) MaskSizeRange() (int, int) {
+	if p.MaskSizePolicy == nil {
+		return p.NodeCIDRMaskSize, p.NodeCIDRMaskSize
+	}
+	return p.MaskSizePolicy.MinNodeCIDRMaskSize, p.MaskSizePolicy.MaxNodeCIDRMaskSize
+}
+
+// Load reads, defaults and validates a configuration file
+func Load(path string) (*Configuration, error) {
+	cfg, _, err := LoadWithChecksum(path)
+	return cfg, err
+}
+
+// Checksum identifies the content of a configuration file
+type Checksum [sha256.Size]byte
+
+// LoadWithChecksum is Load that also returns the checksum of the content it
+// parsed, so that Watch picks up any change written after it.
+func LoadWithChecksum(path string) (*Configuration, Checksum, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	return cfg, sha256.Sum256(data), nil
+}
+
+// Parse decodes, defaults and validates configuration data.
+// Unknown fields are rejected to catch typos.
+func Parse(data []byte) (*Configuration, error) {
+	cfg := &Configuration{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+	}
+	if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+		return nil, fmt.Errorf("unsupported configuration %s/%s, expected %s/%s", cfg.APIVersion, cfg.Kind, APIVersion, Kind)
+	}
+
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// SetDefaults fills in unset fields
+func (c *Configuration) SetDefaults() {
+	c.APIVersion = APIVersion
+	c.Kind = Kind
+
+	if len(c.Controllers) == 0 {
+		c.Controllers = append([]string(nil), AllControllers...)
+	}
+
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if p.NodeCIDRMaskSize == 0 {
+			p.NodeCIDRMaskSize = 24
+		}
+		if p.Shards == 0 {
+			p.Shards = 1
+		}
+		if mp := p.MaskSizePolicy; mp != nil {
+			if mp.MinNodeCIDRMaskSize == 0 {
+				mp.MinNodeCIDRMaskSize = p.NodeCIDRMaskSize
+			}
+			if mp.MaxNodeCIDRMaskSize == 0 {
+				mp.MaxNodeCIDRMaskSize = p.NodeCIDRMaskSize
+			}
+		}
+	}
+
+	if c.AllocationRecords != nil && c.AllocationRecords.Retention.Duration == 0 {
+		c.AllocationRecords.Retention.Duration = 7 * 24 * time.Hour
+	}
+
+	if c.AlertWebhook != nil && c.AlertWebhook.Timeout.Duration == 0 {
+		c.AlertWebhook.Timeout.Duration = 10 * time.Second
+	}
+
+	le := &c.LeaderElection
+	if le.LeaderElect == nil {
+		enabled := true
+		le.LeaderElect = &enabled
+	}
+	if le.LeaseDuration.Duration == 0 {
+		le.LeaseDuration.Duration = 15 * time.Second
+	}
+	if le.RenewDeadline.Duration == 0 {
+		le.RenewDeadline.Duration = 10 * time.Second
+	}
+	if le.RetryPeriod.Duration == 0 {
+		le.RetryPeriod.Duration = 2 * time.Second
+	}
+}
+
+// Validate checks the configuration for errors
+func (c *Configuration) Validate() error {
+	var errs []error
+
+	enabled := map[string]bool{}
+	for i, name := range c.Controllers {
+		if !slices.Contains(AllControllers, name) {
+			errs = append(errs, fmt.Errorf("controllers[%d]: unknown controller %q, expected one of %v", i, name, AllControllers))
+		}
+		if enabled[name] {
+			errs = append(errs, fmt.Errorf("controllers[%d]: duplicate controller %q", i, name))
+		}
+		enabled[name] = true
+	}
+
+	switch c.PoolSource {
+	case "":
+		if len(c.Pools) == 0 && c.ControllerEnabled(CIDRAllocator) {
+			errs = append(errs, fmt.Errorf("pools: at least one pool is required"))
+		}
+	case PoolSourcePodCIDRPool, PoolSourceClusterCIDR:
+		if len(c.Pools) > 0 {
+			errs = append(errs, fmt.Errorf("pools: must be empty with poolSource %s", c.PoolSource))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("poolSource: unknown source %q, expected %s or %s", c.PoolSource, PoolSourcePodCIDRPool, PoolSourceClusterCIDR))
+	}
+
+	names := map[string]bool{}
+	nets := make([]*net.IPNet, len(c.Pools))
+	for i, p := range c.Pools {
+		field := fmt.Sprintf("pools[%d]", i)
+		for _, msg := range validation.IsDNS1123Label(p.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: %s", field, msg))
+		}
+		if names[p.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate pool %q", field, p.Name))
+		}
+		names[p.Name] = true
+
+		if p.ClusterCIDR == "" {
+			errs = append(errs, fmt.Errorf("%s.clusterCIDR: required", field))
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(p.ClusterCIDR)
+		if err != nil || ipnet.IP.To4() == nil {
+			errs = append(errs, fmt.Errorf("%s.clusterCIDR: %q is not an IPv4 CIDR", field, p.ClusterCIDR))
+			continue
+		}
+		for j, other := range nets[:i] {
+			if other != nil && (other.Contains(ipnet.IP) || ipnet.Contains(other.IP)) {
+				errs = append(errs, fmt.Errorf("%s.clusterCIDR: overlaps pools[%d] (%s)", field, j, c.Pools[j].Name))
+			}
+		}
+		nets[i] = ipnet
+
+		clusterMaskSize, _ := ipnet.Mask.Size()
+		if p.NodeCIDRMaskSize <= clusterMaskSize || p.NodeCIDRMaskSize > 32 {
+			errs = append(errs, fmt.Errorf("%s.nodeCIDRMaskSize: must be between %d and 32", field, clusterMaskSize+1))
+		}
+		minMaskSize, _ := p.MaskSizeRange()
+		if mp := p.MaskSizePolicy; mp != nil {
+			if mp.MinNodeCIDRMaskSize <= clusterMaskSize || mp.MinNodeCIDRMaskSize > p.NodeCIDRMaskSize {
+				errs = append(errs, fmt.Errorf("%s.maskSizePolicy.minNodeCIDRMaskSize: must be between %d and nodeCIDRMaskSize", field, clusterMaskSize+1))
+			}
+			if mp.MaxNodeCIDRMaskSize < p.NodeCIDRMaskSize || mp.MaxNodeCIDRMaskSize > 32 {
+				errs = append(errs, fmt.Errorf("%s.maskSizePolicy.maxNodeCIDRMaskSize: must be between nodeCIDRMaskSize and 32", field))
+			}
+			for instanceType, size := range mp.InstanceTypes {
+				if size < mp.MinNodeCIDRMaskSize || size > mp.MaxNodeCIDRMaskSize {
+					errs = append(errs, fmt.Errorf("%s.maskSizePolicy.instanceTypes[%s]: %d is outside the min and max mask sizes", field, instanceType, size))
+				}
+			}
+		}
+		if ec := p.ExtraCIDRs; ec != nil {
+			if ec.MaxPerNode < 1 {
+				errs = append(errs, fmt.Errorf("%s.extraCIDRs.maxPerNode: must be at least 1", field))
+			}
+			if ec.PodUtilizationThreshold < 0 || ec.PodUtilizationThreshold > 100 {
+				errs = append(errs, fmt.Errorf("%s.extraCIDRs.podUtilizationThreshold: must be between 0 and 100", field))
+			}
+		}
+		for j, threshold := range p.UtilizationThresholds {
+			if threshold < 1 || threshold > 100 {
+				errs = append(errs, fmt.Errorf("%s.utilizationThresholds[%d]: must be between 1 and 100", field, j))
+			} else if j > 0 && threshold <= p.UtilizationThresholds[j-1] {
+				errs = append(errs, fmt.Errorf("%s.utilizationThresholds[%d]: thresholds must be in increasing order", field, j))
+			}
+		}
+		if err := p.AllocationLimit.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.allocationLimit: %w", field, err))
+		}
+		for j, excluded := range p.ExcludeCIDRs {
+			if _, exnet, err := net.ParseCIDR(excluded); err != nil || exnet.IP.To4() == nil {
+				errs = append(errs, fmt.Errorf("%s.excludeCIDRs[%d]: %q is not an IPv4 CIDR", field, j, excluded))
+			} else if !exnet.Contains(ipnet.IP) && !ipnet.Contains(exnet.IP) {
+				errs = append(errs, fmt.Errorf("%s.excludeCIDRs[%d]: %s is outside the cluster CIDR", field, j, excluded))
+			}
+		}
+		if _, err := cidr.Split(p.ClusterCIDR, p.Shards); err != nil {
+			errs = append(errs, fmt.Errorf("%s.shards: %w", field, err))
+		} else if minMaskSize-clusterMaskSize < 31 && p.Shards >= 1<<(minMaskSize-clusterMaskSize) {
+			errs = append(errs, fmt.Errorf("%s.shards: each shard must hold more than one of the largest node CIDR blocks", field))
+		}
+
+		switch p.Strategy {
+		case "", StrategySequential, StrategyNameHash:
+			if p.NodeIP != nil {
+				errs = append(errs, fmt.Errorf("%s.nodeIP: only used with strategy %s", field, StrategyNodeIP))
+			}
+		case StrategyNodeIP:
+			if err := p.NodeIP.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s.nodeIP: %w", field, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.strategy: unknown strategy %q, expected %s, %s or %s",
+				field, p.Strategy, StrategySequential, StrategyNodeIP, StrategyNameHash))
+		}
+		if p.Deterministic() && p.Shards > 1 {
+			errs = append(errs, fmt.Errorf("%s.strategy: %s cannot be combined with shards", field, p.Strategy))
+		}
+
+		sel := &selector.NodeSelector{MatchExpressions: p.NodeSelector}
+		if err := sel.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.nodeSelector: %w", field, err))
+		}
+	}
+
+	if _, err := taint.NewTaintRemoverFromList(c.RemoveTaints); err != nil {
+		errs = append(errs, fmt.Errorf("removeTaints: %w", err))
+	}
+
+	if err := c.AllocationLimit.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("allocationLimit: %w", err))
+	}
+
+	quotaNames := map[string]bool{}
+	for i, q := range c.Quotas {
+		field := fmt.Sprintf("quotas[%d]", i)
+		for _, msg := range validation.IsDNS1123Label(q.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: %s", field, msg))
+		}
+		if quotaNames[q.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate quota %q", field, q.Name))
+		}
+		quotaNames[q.Name] = true
+		if q.MaxBlocks < 0 {
+			errs = append(errs, fmt.Errorf("%s.maxBlocks: must not be negative", field))
+		}
+		sel := &selector.NodeSelector{MatchExpressions: q.NodeSelector}
+		if err := sel.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.nodeSelector: %w", field, err))
+		}
+	}
+
+	for i, sa := range c.Admission.BypassServiceAccounts {
+		namespace, name, ok := strings.Cut(sa, "/")
+		if !ok || len(validation.IsDNS1123Label(namespace)) > 0 || len(validation.IsDNS1123Subdomain(name)) > 0 {
+			errs = append(errs, fmt.Errorf("admission.bypassServiceAccounts[%d]: %q is not a namespace/name", i, sa))
+		}
+	}
+
+	switch c.OverlapProtection {
+	case "", OverlapProtectionExclude, OverlapProtectionRefuse:
+	default:
+		errs = append(errs, fmt.Errorf("overlapProtection: unknown policy %q, expected %s or %s",
+			c.OverlapProtection, OverlapProtectionExclude, OverlapProtectionRefuse))
+	}
+
+	if pre := c.AllocationPreconditions; pre != nil {
+		if _, err := taint.NewTaintRemoverFromList(pre.AbsentTaints); err != nil {
+			errs = append(errs, fmt.Errorf("allocationPreconditions.absentTaints: %w", err))
+		}
+		for i, l := range pre.RequiredLabels {
+			key, value, _ := strings.Cut(l, "=")
+			for _, msg := range append(validation.IsQualifiedName(key), validation.IsValidLabelValue(value)...) {
+				errs = append(errs, fmt.Errorf("allocationPreconditions.requiredLabels[%d]: %s", i, msg))
+			}
+		}
+		if pre.MinNodeAge.Duration < 0 {
+			errs = append(errs, fmt.Errorf("allocationPreconditions.minNodeAge: must not be negative"))
+		}
+	}
+
+	if pri := c.AllocationPriority; pri != nil {
+		for i, rule := range pri.Rules {
+			field := fmt.Sprintf("allocationPriority.rules[%d]", i)
+			sel := &selector.NodeSelector{MatchExpressions: rule.NodeSelector}
+			if err := sel.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s.nodeSelector: %w", field, err))
+			}
+			// Pools read from objects are only known at runtime
+			if rule.Pool != "" && c.PoolSource == "" && !slices.ContainsFunc(c.Pools, func(p Pool) bool { return p.Name == rule.Pool }) {
+				errs = append(errs, fmt.Errorf("%s.pool: unknown pool %q", field, rule.Pool))
+			}
+		}
+	}
+
+	if c.Migration != nil && !c.ControllerEnabled(CIDRAllocator) {
+		errs = append(errs, fmt.Errorf("migration: requires the %s controller", CIDRAllocator))
+	}
+
+	if r := c.AllocationRecords; r != nil && r.Retention.Duration < 0 {
+		errs = append(errs, fmt.Errorf("allocationRecords.retention: must not be negative"))
+	}
+
+	if w := c.AlertWebhook; w != nil {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("alertWebhook.url: %q is not an http or https URL", w.URL))
+		}
+	}
+
+	le := c.LeaderElection
+	if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+		errs = append(errs, fmt.Errorf("leaderElection: leaseDuration must be greater than renewDeadline"))
+	}
+	if le.RenewDeadline.Duration <= le.RetryPeriod.Duration {
+		errs = append(errs, fmt.Errorf("leaderElection: renewDeadline must be greater than retryPeriod"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *AllocationLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxAllocations < 1 {
+		return fmt.Errorf("maxAllocations must be at least 1")
+	}
+	if l.Window.Duration <= 0 || l.Window.Duration > 24*time.Hour {
+		return fmt.Errorf("window must be between 0 and 24h")
+	}
+	return nil
+}
+
+// CheckReload returns an error if moving from old to new changes settings
+// that cannot be applied without a restart. Node selectors, taint rules,
+// exclusions and the per-node mask size rules within the same min and max
+// may change live, and an unsharded pool's cluster CIDR may be expanded to
+// a range that contains the current one.
+func CheckReload(old, new *Configuration) error {
+	var errs []error
+
+	if len(old.Pools) != len(new.Pools) {
+		errs = append(errs, fmt.Errorf("pools: adding or removing pools requires a restart"))
+	} else {
+		for i := range old.Pools {
+			o, n := old.Pools[i], new.Pools[i]
+			field := fmt.Sprintf("pools[%d]", i)
+			if o.Name != n.Name {
+				errs = append(errs, fmt.Errorf("%s.name: renaming or reordering pools requires a restart", field))
+			}
+			if o.ClusterCIDR != n.ClusterCIDR {
+				switch {
+				case !Contains(n.ClusterCIDR, o.ClusterCIDR):
+					errs = append(errs, fmt.Errorf("%s.clusterCIDR: %s does not contain %s, only expansion can be applied live", field, n.ClusterCIDR, o.ClusterCIDR))
+				case o.Shards > 1:
+					errs = append(errs, fmt.Errorf("%s.clusterCIDR: expanding a sharded pool requires a restart", field))
+				}
+			}
+			if o.NodeCIDRMaskSize != n.NodeCIDRMaskSize {
+				errs = append(errs, fmt.Errorf("%s.nodeCIDRMaskSize: changing %d to %d is unsafe to apply live", field, o.NodeCIDRMaskSize, n.NodeCIDRMaskSize))
+			}
+			if o.Shards != n.Shards {
+				errs = append(errs, fmt.Errorf("%s.shards: changing the shard count requires a restart", field))
+			}
+			if o.Strategy != n.Strategy {
+				errs = append(errs, fmt.Errorf("%s.strategy: changes require a restart", field))
+			}
+			if !reflect.DeepEqual(o.NodeIP, n.NodeIP) {
+				errs = append(errs, fmt.Errorf("%s.nodeIP: changes require a restart", field))
+			}
+			if !reflect.DeepEqual(o.ExtraCIDRs, n.ExtraCIDRs) {
+				errs = append(errs, fmt.Errorf("%s.extraCIDRs: changes require a restart", field))
+			}
+			oMin, oMax := o.MaskSizeRange()
+			nMin, nMax := n.MaskSizeRange()
+			if oMin != nMin || oMax != nMax {
+				errs = append(errs, fmt.Errorf("%s.maskSizePolicy: changing the min or max mask size requires a restart", field))
+			}
+		}
+	}
+
+	if old.PoolSource != new.PoolSource {
+		errs = append(errs, fmt.Errorf("poolSource: changes require a restart"))
+	}
+
+	if old.OverlapProtection != new.OverlapProtection {
+		errs = append(errs, fmt.Errorf("overlapProtection: changes require a restart"))
+	}
+
+	if !reflect.DeepEqual(old.Migration, new.Migration) {
+		errs = append(errs, fmt.Errorf("migration: changes require a restart"))
+	}
+
+	if (old.AllocationRecords == nil) != (new.AllocationRecords == nil) {
+		errs = append(errs, fmt.Errorf("allocationRecords: enabling or disabling requires a restart"))
+	}
+
+	if !reflect.DeepEqual(old.Controllers, new.Controllers) {
+		errs = append(errs, fmt.Errorf("controllers: changes require a restart"))
+	}
+
+	if !reflect.DeepEqual(old.LeaderElection, new.LeaderElection) {
+		errs = append(errs, fmt.Errorf("leaderElection: changes require a restart"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ControllerEnabled reports whether a sub-controller is enabled
+func (c *Configuration) ControllerEnabled(name string) bool {
+	return slices.Contains(c.Controllers, name)
+}
+
+// WatchesPods reports whether any pool allocates extra blocks based on
+// the pods running on a node
+func (c *Configuration) WatchesPods() bool {
+	for _, p := range c.Pools {
+		if p.ExtraCIDRs != nil && p.ExtraCIDRs.PodUtilizationThreshold > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the CIDR outer contains the CIDR inner
+func Contains(outer, inner string) bool {
+	_, outerNet, err := net.ParseCIDR(outer)
+	if err != nil {
+		return false
+	}
+	_, innerNet, err := net.ParseCIDR(inner)
+	if err != nil {
+		return false
+	}
+	outerSize, _ := outerNet.Mask.Size()
+	innerSize, _ := innerNet.Mask.Size()
+	return outerSize <= innerSize && outerNet.Contains(innerNet.IP)
+}
@@ -0,0 +1,334 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validConfig = `
+apiVersion: config.podcidr.imroc.io/v1alpha1
+kind: PodCIDRControllerConfiguration
+pools:
+- name: default
+  clusterCIDR: 10.244.0.0/16
+  nodeSelector:
+  - key: node-type
+    operator: In
+    values: ["external"]
+removeTaints:
+- tke.cloud.tencent.com/eni-ip-unavailable
+- node.kubernetes.io/not-ready:NoSchedule
+leaderElection:
+  leaseDuration: 30s
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.Pools) != 1 || cfg.Pools[0].NodeCIDRMaskSize != 24 || cfg.Pools[0].Shards != 1 {
+		t.Errorf("expected defaulted pool, got %+v", cfg.Pools)
+	}
+	if len(cfg.Pools[0].NodeSelector) != 1 {
+		t.Errorf("expected 1 selector expression, got %d", len(cfg.Pools[0].NodeSelector))
+	}
+	if len(cfg.RemoveTaints) != 2 {
+		t.Errorf("expected 2 taint rules, got %d", len(cfg.RemoveTaints))
+	}
+	le := cfg.LeaderElection
+	if !*le.LeaderElect || le.LeaseDuration.Duration != 30*time.Second || le.RenewDeadline.Duration != 10*time.Second {
+		t.Errorf("unexpected leader election settings %+v", le)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name:    "wrong kind",
+			data:    "apiVersion: config.podcidr.imroc.io/v1alpha1\nkind: Other\n",
+			wantErr: "unsupported configuration",
+		},
+		{
+			name:    "unknown field",
+			data:    strings.Replace(validConfig, "clusterCIDR:", "clusterRange:", 1),
+			wantErr: "unknown field",
+		},
+		{
+			name:    "no pools",
+			data:    "apiVersion: config.podcidr.imroc.io/v1alpha1\nkind: PodCIDRControllerConfiguration\n",
+			wantErr: "at least one pool",
+		},
+		{
+			name:    "invalid cidr",
+			data:    strings.Replace(validConfig, "10.244.0.0/16", "10.244.0.0", 1),
+			wantErr: "not an IPv4 CIDR",
+		},
+		{
+			name:    "bad operator",
+			data:    strings.Replace(validConfig, "operator: In", "operator: Equals", 1),
+			wantErr: "unknown operator",
+		},
+		{
+			name:    "bad taint rule",
+			data:    strings.Replace(validConfig, "- tke.cloud.tencent.com/eni-ip-unavailable", "- =value:NoSchedule", 1),
+			wantErr: "removeTaints",
+		},
+		{
+			name:    "too many shards",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  nodeCIDRMaskSize: 17\n  shards: 4", 1),
+			wantErr: "each shard must hold more than one",
+		},
+		{
+			name:    "instance type outside mask range",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  maskSizePolicy:\n    maxNodeCIDRMaskSize: 26\n    instanceTypes:\n      edge.small: 27", 1),
+			wantErr: "instanceTypes[edge.small]",
+		},
+		{
+			name:    "extra cidrs threshold",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  extraCIDRs:\n    maxPerNode: 2\n    podUtilizationThreshold: 120", 1),
+			wantErr: "podUtilizationThreshold",
+		},
+		{
+			name:    "unordered thresholds",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  utilizationThresholds: [95, 80]", 1),
+			wantErr: "increasing order",
+		},
+		{
+			name:    "bad webhook url",
+			data:    validConfig + "alertWebhook:\n  url: alerts.example.com\n",
+			wantErr: "alertWebhook.url",
+		},
+		{
+			name:    "allocation limit window",
+			data:    validConfig + "allocationLimit:\n  maxAllocations: 50\n  window: 48h\n",
+			wantErr: "allocationLimit: window",
+		},
+		{
+			name:    "duplicate quota",
+			data:    validConfig + "quotas:\n- name: a\n  maxBlocks: 1\n- name: a\n  maxBlocks: 2\n",
+			wantErr: "duplicate quota",
+		},
+		{
+			name:    "unknown controller",
+			data:    validConfig + "controllers: [cidr-allocator, node-ipam]\n",
+			wantErr: "unknown controller",
+		},
+		{
+			name:    "exclusion outside cluster cidr",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  excludeCIDRs: [10.96.0.0/12]", 1),
+			wantErr: "excludeCIDRs[0]",
+		},
+		{
+			name:    "bypass service account",
+			data:    validConfig + "admission:\n  bypassServiceAccounts: [node-tool]\n",
+			wantErr: "not a namespace/name",
+		},
+		{
+			name:    "pools with pool source",
+			data:    validConfig + "poolSource: PodCIDRPool\n",
+			wantErr: "poolSource",
+		},
+		{
+			name:    "negative record retention",
+			data:    validConfig + "allocationRecords:\n  retention: -1h\n",
+			wantErr: "allocationRecords.retention",
+		},
+		{
+			name:    "migration without allocator",
+			data:    "apiVersion: config.podcidr.imroc.io/v1alpha1\nkind: PodCIDRControllerConfiguration\ncontrollers: [taint-remover]\nremoveTaints: [example.com/a]\nmigration: {}\n",
+			wantErr: "migration",
+		},
+		{
+			name:    "unknown overlap protection",
+			data:    validConfig + "overlapProtection: Warn\n",
+			wantErr: "overlapProtection",
+		},
+		{
+			name:    "unknown strategy",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  strategy: Random", 1),
+			wantErr: "strategy",
+		},
+		{
+			name:    "node IP strategy without mapping",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  strategy: NodeIP", 1),
+			wantErr: "nodeIP",
+		},
+		{
+			name:    "node IP mapping with host bits beyond the subnet",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  strategy: NodeIP\n  nodeIP:\n    subnet: 192.168.0.0/24\n    hostBits: 9", 1),
+			wantErr: "hostBits",
+		},
+		{
+			name:    "node IP mapping without node IP strategy",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  nodeIP:\n    subnet: 192.168.0.0/16", 1),
+			wantErr: "nodeIP",
+		},
+		{
+			name:    "hash strategy with shards",
+			data:    strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  strategy: NameHash\n  shards: 4", 1),
+			wantErr: "shards",
+		},
+		{
+			name:    "invalid required label",
+			data:    validConfig + "allocationPreconditions:\n  requiredLabels: [\"node pool=workers\"]\n",
+			wantErr: "allocationPreconditions.requiredLabels",
+		},
+		{
+			name:    "invalid absent taint",
+			data:    validConfig + "allocationPreconditions:\n  absentTaints: [\"=true:NoSchedule\"]\n",
+			wantErr: "allocationPreconditions.absentTaints",
+		},
+		{
+			name:    "priority rule for unknown pool",
+			data:    validConfig + "allocationPriority:\n  rules:\n  - priority: 10\n    pool: gpu\n",
+			wantErr: "allocationPriority.rules[0].pool",
+		},
+		{
+			name:    "priority rule with bad selector",
+			data:    validConfig + "allocationPriority:\n  rules:\n  - priority: 10\n    nodeSelector:\n    - key: priority-class\n      operator: Equals\n",
+			wantErr: "allocationPriority.rules[0].nodeSelector",
+		},
+		{
+			name:    "unknown pool source",
+			data:    "apiVersion: config.podcidr.imroc.io/v1alpha1\nkind: PodCIDRControllerConfiguration\npoolSource: Flags\n",
+			wantErr: "poolSource",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateOverlappingPools(t *testing.T) {
+	cfg := &Configuration{
+		Pools: []Pool{
+			{Name: "a", ClusterCIDR: "10.244.0.0/16"},
+			{Name: "b", ClusterCIDR: "10.244.128.0/17"},
+		},
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Errorf("expected overlap error, got %v", err)
+	}
+}
+
+func TestCheckReload(t *testing.T) {
+	old, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	safe, _ := Parse([]byte(strings.Replace(validConfig, `values: ["external"]`, `values: ["edge"]`, 1)))
+	if err := CheckReload(old, safe); err != nil {
+		t.Errorf("expected selector change to be allowed, got %v", err)
+	}
+
+	expanded, _ := Parse([]byte(strings.Replace(validConfig, "10.244.0.0/16", "10.244.0.0/15", 1)))
+	if err := CheckReload(old, expanded); err != nil {
+		t.Errorf("expected expansion to be allowed, got %v", err)
+	}
+
+	policy := "  clusterCIDR: 10.244.0.0/16\n  maskSizePolicy:\n    minNodeCIDRMaskSize: 23\n    maxNodeCIDRMaskSize: 26"
+	withPolicy, _ := Parse([]byte(strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", policy, 1)))
+	tuned, _ := Parse([]byte(strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", policy+"\n    fromPodCapacity: true", 1)))
+	if err := CheckReload(withPolicy, tuned); err != nil {
+		t.Errorf("expected mask size rule change to be allowed, got %v", err)
+	}
+
+	unsafe := []struct {
+		name string
+		data string
+	}{
+		{"cluster cidr", strings.Replace(validConfig, "10.244.0.0/16", "10.245.0.0/16", 1)},
+		{"shrink cluster cidr", strings.Replace(validConfig, "10.244.0.0/16", "10.244.0.0/17", 1)},
+		{"mask size", strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  nodeCIDRMaskSize: 25", 1)},
+		{"leader election", strings.Replace(validConfig, "30s", "20s", 1)},
+		{"mask size range", strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", policy, 1)},
+		{"strategy", strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", "  clusterCIDR: 10.244.0.0/16\n  strategy: NameHash", 1)},
+	}
+	for _, tt := range unsafe {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := CheckReload(old, cfg); err == nil {
+				t.Error("expected change to be refused")
+			}
+		})
+	}
+
+	nodeIP := "  clusterCIDR: 10.244.0.0/16\n  strategy: NodeIP\n  nodeIP:\n    subnet: 192.168.0.0/16\n    hostBits: "
+	byNodeIP, _ := Parse([]byte(strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", nodeIP+"8", 1)))
+	remapped, _ := Parse([]byte(strings.Replace(validConfig, "  clusterCIDR: 10.244.0.0/16", nodeIP+"7", 1)))
+	if err := CheckReload(byNodeIP, remapped); err == nil || !strings.Contains(err.Error(), "nodeIP") {
+		t.Errorf("expected node IP mapping change to be refused, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(validConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, loaded, err := LoadWithChecksum(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A change written before the watcher starts is still applied
+	updated := strings.Replace(validConfig, `values: ["external"]`, `values: ["edge"]`, 1)
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *Configuration, 1)
+	go Watch(ctx, path, loaded, 10*time.Millisecond, func(cfg *Configuration) { changes <- cfg })
+	select {
+	case cfg := <-changes:
+		if cfg.Pools[0].NodeSelector[0].Values[0] != "edge" {
+			t.Errorf("expected reloaded selector, got %+v", cfg.Pools[0].NodeSelector)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the change made before watching")
+	}
+
+	// Invalid content is skipped
+	if err := os.WriteFile(path, []byte("kind: Broken\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	updated = strings.Replace(validConfig, `values: ["external"]`, `values: ["cloud"]`, 1)
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cfg := <-changes:
+		if cfg.Pools[0].NodeSelector[0].Values[0] != "cloud" {
+			t.Errorf("expected reloaded selector, got %+v", cfg.Pools[0].NodeSelector)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DefaultReloadInterval is how often the configuration file is checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// Watch polls the configuration file and calls onChange with every new valid
+// configuration. Polling the content rather than watching inodes keeps it
+// working with ConfigMap volumes, which swap a symlink on update.
+// Invalid files are logged and skipped so the running configuration stays.
+// loaded is the checksum of the running configuration, as returned by
+// LoadWithChecksum.
+func Watch(ctx context.Context, path string, loaded Checksum, interval time.Duration, onChange func(*Configuration)) {
+	last := loaded
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.Warningf("Failed to read configuration file %s: %v", path, err)
+			return
+		}
+		sum := Checksum(sha256.Sum256(data))
+		if sum == last {
+			return
+		}
+		last = sum
+
+		cfg, err := Parse(data)
+		if err != nil {
+			klog.Errorf("Ignoring invalid configuration file %s: %v", path, err)
+			return
+		}
+		klog.Infof("Configuration file %s changed, reloading", path)
+		onChange(cfg)
+	}, interval)
+}
@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/cidr"
+	"github.com/imroc/podcidr-controller/pkg/config"
+)
+
+const (
+	// LeaderLabel marks the controller pod that holds the leader lease. The
+	// Service of the mutating webhook selects it, so that nodes are
+	// admitted by the replica that assigns CIDRs rather than by a standby
+	// that admits them unchanged.
+	LeaderLabel = "podcidr.imroc.io/leader"
+
+	// podLabelTimeout bounds an update of LeaderLabel
+	podLabelTimeout = 10 * time.Second
+
+	// assignmentSweepPeriod is how often assigned blocks are checked
+	// against the nodes the informer has seen
+	assignmentSweepPeriod = 30 * time.Second
+	// assignmentTimeout is how long a node may take to show up with a
+	// block assigned by the webhook before the block is released. The API
+	// server may drop the admitted node, e.g. when a later webhook rejects
+	// it.
+	assignmentTimeout = time.Minute
+)
+
+// assignment is a block handed to a node that the informer has not shown
+// on the node yet. unreserve undoes the node's quota reservation if the
+// block is released.
+type assignment struct {
+	node      string
+	at        time.Time
+	unreserve func()
+}
+
+// assignments tracks the blocks assigned by the webhook or the sync until
+// the nodes carrying them are observed. They tell the node's own block
+// apart from a block taken by someone else while the node update is in
+// flight.
+type assignments struct {
+	mu      sync.Mutex
+	byBlock map[string]assignment
+}
+
+func newAssignments() *assignments {
+	return &assignments{byBlock: map[string]assignment{}}
+}
+
+func (a *assignments) add(cidrBlock, node string, at time.Time, unreserve func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.byBlock[cidrBlock] = assignment{node: node, at: at, unreserve: unreserve}
+}
+
+func (a *assignments) remove(cidrBlock string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.byBlock, cidrBlock)
+}
+
+// assignedTo reports whether a block was assigned to a node
+func (a *assignments) assignedTo(cidrBlock, node string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.byBlock[cidrBlock]
+	return ok && b.node == node
+}
+
+// pending reports whether a block is being assigned to any node
+func (a *assignments) pending(cidrBlock string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.byBlock[cidrBlock]
+	return ok
+}
+
+// observe forgets the blocks of a node once the informer shows them on
+// the node. A block the node shows up without stays, so that the sweep
+// releases it.
+func (a *assignments) observe(node *corev1.Node) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cidrBlock := range nodeCIDRs(node) {
+		if b, ok := a.byBlock[cidrBlock]; ok && b.node == node.Name {
+			delete(a.byBlock, cidrBlock)
+		}
+	}
+}
+
+// expire removes and returns the blocks assigned before cutoff
+func (a *assignments) expire(cutoff time.Time) map[string]assignment {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expired := map[string]assignment{}
+	for cidrBlock, b := range a.byBlock {
+		if b.at.Before(cutoff) {
+			expired[cidrBlock] = b
+			delete(a.byBlock, cidrBlock)
+		}
+	}
+	return expired
+}
+
+// SetPod names the pod this replica runs in, so that it is labelled with
+// LeaderLabel while leading. A label left over from an earlier run of the
+// container is removed. It must be called before leadership starts.
+func (c *Controller) SetPod(ctx context.Context, name string) error {
+	c.podName = name
+	return c.labelPod(ctx, false)
+}
+
+// updateLeaderLabel follows a leadership change on the pod's label. Until
+// it succeeds, nodes may be admitted unchanged and get their CIDR from the
+// regular sync.
+func (c *Controller) updateLeaderLabel(leading bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), podLabelTimeout)
+	defer cancel()
+	if err := c.labelPod(ctx, leading); err != nil {
+		klog.Errorf("Failed to update label %s of pod %s: %v", LeaderLabel, c.podName, err)
+	}
+}
+
+// labelPod adds or removes LeaderLabel on the pod set by SetPod
+func (c *Controller) labelPod(ctx context.Context, leading bool) error {
+	if c.podName == "" {
+		return nil
+	}
+	var value interface{}
+	if leading {
+		value = "true"
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{LeaderLabel: value}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientset.CoreV1().Pods(c.store.Namespace()).Patch(ctx, c.podName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// AssignCIDR picks the podCIDR of a node that is being created, for the
+// mutating webhook. It only assigns on the leader, for an owned shard,
+// and returns an empty string otherwise so that the node is admitted
+// unchanged and allocated by the regular sync.
+func (c *Controller) AssignCIDR(ctx context.Context, node *corev1.Node) (string, error) {
+	if c.allocation == nil || !c.leading.Load() || c.allocationPaused.Load() || c.observing.Load() || node.Spec.PodCIDR != "" {
+		return "", nil
+	}
+	p := c.poolFor(node)
+	if p == nil {
+		return "", nil
+	}
+	// Left to the sync, which waits for the node to meet them
+	if reason, _, _ := unmetPrecondition(c.Config().AllocationPreconditions, node, time.Now()); reason != "" {
+		return "", nil
+	}
+
+	s := p.shardFor(node)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.owned {
+		return "", nil
+	}
+
+	maskSize, source, err := p.maskSize.Load().For(node)
+	if err != nil {
+		// Left to the sync, which reports it
+		return "", nil
+	}
+
+	cidrBlock, unreserve, err := c.allocateBlock(ctx, p, s, node, maskSize)
+	if stderrors.Is(err, errNoNodeAddress) {
+		// A new node has no addresses yet, the sync allocates it later
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	c.assignments.add(cidrBlock, node.Name, now, unreserve)
+	p.capacity.recordAllocation(node.Name, cidrBlock, now)
+
+	klog.Infof("Assigned CIDR %s to node %s at admission (mask size from %s)", cidrBlock, node.Name, source)
+	return cidrBlock, nil
+}
+
+// sweepAssignments releases the blocks of admitted nodes that never showed
+// up, or showed up without the block
+func (c *Controller) sweepAssignments(context.Context) {
+	expired := c.assignments.expire(time.Now().Add(-assignmentTimeout))
+	if len(expired) == 0 {
+		return
+	}
+	for cidrBlock, b := range expired {
+		name := b.node
+		// A node that turned up with the block keeps it
+		if node, err := c.nodeLister.Get(name); err == nil {
+			if hasCIDR(node, cidrBlock) {
+				continue
+			}
+		} else {
+			c.quotas.forget(name)
+		}
+		if err := c.release(cidrBlock); err != nil {
+			klog.Warningf("Failed to release CIDR %s assigned to node %s: %v", cidrBlock, name, err)
+			continue
+		}
+		// The block no longer counts against the node's quotas
+		if b.unreserve != nil {
+			b.unreserve()
+		}
+		klog.Infof("Released CIDR %s assigned to node %s, which never got it", cidrBlock, name)
+	}
+	c.wakePending()
+}
+
+// ValidatePodCIDRs checks the podCIDRs a node is created or updated with,
+// for the validating webhook. A block must belong to a pool, stay clear of
+// its excluded ranges and not be held by another node. The configured
+// service accounts may set any block.
+func (c *Controller) ValidatePodCIDRs(_ context.Context, user authenticationv1.UserInfo, node *corev1.Node, cidrs []string) error {
+	// kube-controller-manager still allocates while observing a migration
+	if c.allocation == nil || c.observing.Load() {
+		return nil
+	}
+	for _, sa := range c.Config().Admission.BypassServiceAccounts {
+		namespace, name, _ := strings.Cut(sa, "/")
+		if user.Username == "system:serviceaccount:"+namespace+":"+name {
+			klog.V(2).Infof("Admitting podCIDRs %v of node %s set by %s", cidrs, node.Name, user.Username)
+			return nil
+		}
+	}
+
+	for _, cidrBlock := range cidrs {
+		if err := c.validatePodCIDR(node.Name, cidrBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtraPodCIDRs returns the blocks of a node's extra-pod-cidrs annotation,
+// for the validating webhook
+func (c *Controller) ExtraPodCIDRs(node *corev1.Node) []string {
+	return extraCIDRs(node)
+}
+
+func (c *Controller) validatePodCIDR(nodeName, cidrBlock string) error {
+	for _, p := range c.getPools() {
+		for _, s := range p.shards {
+			inUse, err := s.allocator.InUse(cidrBlock)
+			if stderrors.Is(err, cidr.ErrCIDROutOfRange) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("podCIDR %s is invalid: %w", cidrBlock, err)
+			}
+			if s.allocator.IsExcluded(cidrBlock) {
+				return fmt.Errorf("podCIDR %s overlaps a range excluded from pool %s", cidrBlock, p.name)
+			}
+			if inUse && !c.assignments.assignedTo(cidrBlock, nodeName) {
+				if owner := c.ownerOf(nodeName, cidrBlock); owner != "" {
+					return fmt.Errorf("podCIDR %s overlaps the CIDR of node %s", cidrBlock, owner)
+				}
+				return fmt.Errorf("podCIDR %s is being assigned to another node", cidrBlock)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("podCIDR %s is not a block of any pool", cidrBlock)
+}
+
+// ownerOf returns a node other than nodeName holding a block that overlaps
+// cidrBlock, or an empty string
+func (c *Controller) ownerOf(nodeName, cidrBlock string) string {
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return ""
+	}
+	for _, node := range nodes {
+		if node.Name == nodeName {
+			continue
+		}
+		if slices.ContainsFunc(nodeCIDRs(node), func(b string) bool {
+			return config.Contains(b, cidrBlock) || config.Contains(cidrBlock, b)
+		}) {
+			return node.Name
+		}
+	}
+	return ""
+}
+
+// hasCIDR reports whether a node holds a block
+func hasCIDR(node *corev1.Node, cidrBlock string) bool {
+	for _, b := range nodeCIDRs(node) {
+		if b == cidrBlock {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/alert"
+)
+
+const (
+	// capacityCheckPeriod is how often the leader compares pool usage
+	// with the configured thresholds
+	capacityCheckPeriod = 30 * time.Second
+
+	// thresholdRearmMargin is how many percentage points usage must drop
+	// below a threshold before it can alert again, to avoid flapping
+	thresholdRearmMargin = 5
+
+	allocationRateWindow = 24 * time.Hour
+
+	// UtilizationAlertAnnotationPrefix records on the state ConfigMap the
+	// highest utilization threshold a pool alerted for, followed by the
+	// pool name, so that a new leader does not alert for it again
+	UtilizationAlertAnnotationPrefix = "utilization-alert.podcidr.imroc.io/"
+
+	ReasonPoolUtilizationHigh = "PoolUtilizationHigh"
+)
+
+// capacityState tracks recent allocations and alerted thresholds of a pool
+type capacityState struct {
+	mu sync.Mutex
+	// allocations maps the blocks handed to nodes to when they received
+	// them. Keyed by node and block so that an allocation recorded by this
+	// replica and observed again through the informer is counted once.
+	allocations map[string]time.Time
+	alerted     map[int]bool
+	// recorded is the highest alerted threshold on the state ConfigMap
+	recorded int
+}
+
+func (s *capacityState) recordAllocation(node, cidrBlock string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.allocations == nil {
+		s.allocations = map[string]time.Time{}
+	}
+	key := node + "/" + cidrBlock
+	if _, ok := s.allocations[key]; !ok {
+		s.allocations[key] = at
+	}
+}
+
+// allocationsSince returns the number of allocations in the rate window
+func (s *capacityState) allocationsSince(now time.Time) int {
+	return s.countSince(now.Add(-allocationRateWindow))
+}
+
+// countSince returns the number of allocations after cutoff, and forgets
+// those older than the rate window
+func (s *capacityState) countSince(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := time.Now().Add(-allocationRateWindow)
+	count := 0
+	for key, at := range s.allocations {
+		if at.Before(expired) {
+			delete(s.allocations, key)
+			continue
+		}
+		if at.After(cutoff) {
+			count++
+		}
+	}
+	return count
+}
+
+// crossed returns the highest threshold that utilization newly reached, or
+// 0 if none. Thresholds that utilization fell well below are re-armed.
+func (s *capacityState) crossed(utilization float64, thresholds []int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alerted == nil {
+		s.alerted = map[int]bool{}
+	}
+
+	crossed := 0
+	for _, t := range thresholds {
+		switch {
+		case utilization >= float64(t):
+			if !s.alerted[t] {
+				crossed = t
+			}
+			s.alerted[t] = true
+		case utilization < float64(t-thresholdRearmMargin):
+			s.alerted[t] = false
+		}
+	}
+	return crossed
+}
+
+// level returns the highest alerted threshold, and the one recorded on the
+// state ConfigMap. Thresholds re-arm from the top, so the highest one stands
+// for every threshold below it.
+func (s *capacityState) level() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	level := 0
+	for t, alerted := range s.alerted {
+		if alerted && t > level {
+			level = t
+		}
+	}
+	return level, s.recorded
+}
+
+func (s *capacityState) setRecorded(level int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorded = level
+}
+
+// observeAlerts follows the thresholds the pools alerted for on the state
+// ConfigMap. It runs on every replica, so a new leader knows them.
+func (c *Controller) observeAlerts(cm *corev1.ConfigMap) {
+	for _, p := range c.getPools() {
+		level := 0
+		if v, ok := cm.Annotations[UtilizationAlertAnnotationPrefix+p.name]; ok {
+			var err error
+			if level, err = strconv.Atoi(v); err != nil {
+				klog.Warningf("Ignoring annotation %s%s with invalid threshold %q", UtilizationAlertAnnotationPrefix, p.name, v)
+			}
+		}
+		p.capacity.setRecorded(level)
+	}
+}
+
+// recordAlertLevel stores the highest threshold a pool alerted for on the
+// state ConfigMap, or removes it once every threshold re-armed
+func (c *Controller) recordAlertLevel(ctx context.Context, p *pool, level int) {
+	key := UtilizationAlertAnnotationPrefix + p.name
+	if err := c.store.Update(ctx, func(cm *corev1.ConfigMap) {
+		if level == 0 {
+			delete(cm.Annotations, key)
+			return
+		}
+		cm.Annotations[key] = strconv.Itoa(level)
+	}); err != nil {
+		klog.Errorf("Failed to record the utilization alerts of pool %s: %v", p.name, err)
+		return
+	}
+	p.capacity.setRecorded(level)
+}
+
+// observeAllocation counts the blocks a node receives, its podCIDR and
+// extra blocks alike, towards their pool's allocation rate. It runs on
+// every replica, so a new leader has the rate observed since it started.
+func (c *Controller) observeAllocation(old, new interface{}) {
+	oldNode, ok := old.(*corev1.Node)
+	if !ok {
+		return
+	}
+	newNode, ok := new.(*corev1.Node)
+	if !ok {
+		return
+	}
+	held := nodeCIDRs(oldNode)
+	now := time.Now()
+	for _, cidrBlock := range nodeCIDRs(newNode) {
+		if slices.Contains(held, cidrBlock) {
+			continue
+		}
+		for _, p := range c.getPools() {
+			if p.isAllocated(cidrBlock) {
+				p.capacity.recordAllocation(newNode.Name, cidrBlock, now)
+				break
+			}
+		}
+	}
+}
+
+// checkCapacity emits a Warning Event and calls the alert webhook for every
+// pool that crossed one of its utilization thresholds. Leader only.
+func (c *Controller) checkCapacity(ctx context.Context) {
+	if !c.leading.Load() {
+		return
+	}
+
+	cfg := c.Config()
+	now := time.Now()
+	for _, p := range c.getPools() {
+		thresholds := p.settings.Load().UtilizationThresholds
+		if len(thresholds) == 0 {
+			continue
+		}
+
+		used, total := p.usage()
+		// A pool whose range is entirely excluded has nothing left to
+		// allocate
+		utilization := 100.0
+		if total > 0 {
+			utilization = float64(used) * 100 / float64(total)
+		}
+		threshold := p.capacity.crossed(utilization, thresholds)
+		level, recorded := p.capacity.level()
+		if level != recorded {
+			c.recordAlertLevel(ctx, p, level)
+		}
+		// A previous leader already alerted for it
+		if threshold == 0 || threshold <= recorded {
+			continue
+		}
+
+		payload := alert.Payload{
+			Pool:               p.name,
+			Threshold:          threshold,
+			Utilization:        utilization,
+			Used:               used,
+			Free:               total - used,
+			Total:              total,
+			AllocationsLastDay: p.capacity.allocationsSince(now),
+			Time:               now,
+		}
+		klog.Warningf("Pool %s is %.1f%% used, crossing the %d%% threshold", p.name, utilization, threshold)
+		c.recorder.Eventf(c.eventRef, corev1.EventTypeWarning, ReasonPoolUtilizationHigh,
+			"Pool %s is %.1f%% used (%d of %d blocks, %d allocations in the last day), crossing the %d%% threshold",
+			p.name, utilization, used, total, payload.AllocationsLastDay, threshold)
+
+		if w := cfg.AlertWebhook; w != nil {
+			webhook := alert.NewWebhook(w.URL, w.Timeout.Duration)
+			go func() {
+				if err := webhook.Send(ctx, payload); err != nil {
+					klog.Errorf("Failed to send capacity alert for pool %s: %v", payload.Pool, err)
+				}
+			}()
+		}
+	}
+}
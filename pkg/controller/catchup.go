@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// catchUpTimeout bounds a single list of the nodes
+	catchUpTimeout = 30 * time.Second
+	// catchUpMaxBackoff caps the wait between failed attempts
+	catchUpMaxBackoff = 30 * time.Second
+)
+
+// catchUp reserves every block the API server shows on a node. The
+// informer cache of a replica that just took over may not yet show the
+// blocks its predecessor wrote last, and allocating from it could hand
+// them out again. A list without a resourceVersion is served from etcd, so
+// it includes every write the predecessor completed.
+func (c *Controller) catchUp() error {
+	ctx, cancel := context.WithTimeout(context.Background(), catchUpTimeout)
+	defer cancel()
+	nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for i := range nodes.Items {
+		for _, cidrBlock := range nodeCIDRs(&nodes.Items[i]) {
+			// Blocks outside every pool are reported by Prepare
+			_ = c.markAllocated(cidrBlock)
+		}
+	}
+	return nil
+}
+
+// afterCatchUp runs then once the allocator holds every block of the API
+// server. It catches up inline, so that then usually runs before
+// afterCatchUp returns, and otherwise retries in the background for as
+// long as current reports that then is still wanted.
+func (c *Controller) afterCatchUp(current func() bool, then func()) {
+	err := c.catchUp()
+	if err == nil {
+		then()
+		return
+	}
+	klog.Warningf("Not allocating until the allocator caught up with the API server: %v", err)
+
+	go func() {
+		backoff := wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: 10, Cap: catchUpMaxBackoff}
+		for {
+			time.Sleep(backoff.Step())
+			if !current() {
+				return
+			}
+			if err := c.catchUp(); err != nil {
+				klog.Warningf("Not allocating until the allocator caught up with the API server: %v", err)
+				continue
+			}
+			then()
+			return
+		}
+	}()
+}
@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/state"
+)
+
+const (
+	// CircuitAnnotationPrefix marks an open allocation circuit on the state
+	// ConfigMap, followed by "global" or "pool.<name>". Removing the
+	// annotation acknowledges the circuit and resumes allocation.
+	CircuitAnnotationPrefix = "circuit.podcidr.imroc.io/"
+
+	// CircuitResetAnnotationPrefix records on the state ConfigMap when a
+	// circuit was last acknowledged, followed by its scope, so that a
+	// replica started later only counts the allocations after it
+	CircuitResetAnnotationPrefix = "circuit-reset.podcidr.imroc.io/"
+
+	globalCircuit = "global"
+
+	ReasonAllocationCircuitOpen   = "AllocationCircuitOpen"
+	ReasonAllocationCircuitClosed = "AllocationCircuitClosed"
+
+	// stateUpdateTimeout bounds a write to the state ConfigMap made outside
+	// of a sync
+	stateUpdateTimeout = 30 * time.Second
+)
+
+// errCircuitOpen holds a node back until an operator closes the circuit
+var errCircuitOpen = errors.New("allocation circuit is open")
+
+func poolCircuit(pool string) string {
+	return "pool." + pool
+}
+
+// circuitState tracks which allocation circuits are open. A circuit opened
+// by this replica is held open locally until the state ConfigMap shows the
+// annotation, so that a stale informer event is not taken as an
+// acknowledgement. Only allocations after the last acknowledgement count
+// towards the limit; the acknowledgements recorded on the state ConfigMap
+// are read back, so they survive a restart.
+type circuitState struct {
+	mu       sync.Mutex
+	tripped  map[string]bool
+	observed map[string]bool
+	resetAt  map[string]time.Time
+}
+
+func newCircuitState() *circuitState {
+	return &circuitState{
+		tripped:  map[string]bool{},
+		observed: map[string]bool{},
+		resetAt:  map[string]time.Time{},
+	}
+}
+
+func (s *circuitState) isOpen(scope string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tripped[scope] || s.observed[scope]
+}
+
+func (s *circuitState) trip(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tripped[scope] = true
+}
+
+func (s *circuitState) untrip(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tripped, scope)
+}
+
+// cutoff returns the time after which allocations count towards a limit
+func (s *circuitState) cutoff(scope string, now time.Time, window time.Duration) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-window)
+	if reset := s.resetAt[scope]; reset.After(cutoff) {
+		cutoff = reset
+	}
+	return cutoff
+}
+
+// observe updates the circuits from the state ConfigMap annotations and
+// returns the scopes that were acknowledged
+func (s *circuitState) observe(annotations map[string]string, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := map[string]bool{}
+	for key, value := range annotations {
+		if scope, ok := strings.CutPrefix(key, CircuitAnnotationPrefix); ok {
+			open[scope] = true
+			continue
+		}
+		if scope, ok := strings.CutPrefix(key, CircuitResetAnnotationPrefix); ok {
+			reset, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				klog.Warningf("Ignoring annotation %s with invalid time %q", key, value)
+				continue
+			}
+			if reset.After(s.resetAt[scope]) {
+				s.resetAt[scope] = reset
+			}
+		}
+	}
+
+	var closed []string
+	for scope := range s.observed {
+		if !open[scope] {
+			closed = append(closed, scope)
+			delete(s.tripped, scope)
+			s.resetAt[scope] = now
+		}
+	}
+	s.observed = open
+	return closed
+}
+
+// checkAllocationLimits returns errCircuitOpen if the global circuit or the
+// pool's circuit is open, opening it first if its limit has been reached
+func (c *Controller) checkAllocationLimits(ctx context.Context, p *pool) error {
+	cfg := c.Config()
+	poolLimit := p.settings.Load().AllocationLimit
+
+	now := time.Now()
+	if limit := cfg.AllocationLimit; limit != nil {
+		cutoff := c.circuits.cutoff(globalCircuit, now, limit.Window.Duration)
+		count := 0
+		for _, pp := range c.getPools() {
+			count += pp.capacity.countSince(cutoff)
+		}
+		if err := c.checkCircuit(ctx, globalCircuit, "all pools", limit, count); err != nil {
+			return err
+		}
+	}
+	if limit := poolLimit; limit != nil {
+		scope := poolCircuit(p.name)
+		count := p.capacity.countSince(c.circuits.cutoff(scope, now, limit.Window.Duration))
+		if err := c.checkCircuit(ctx, scope, "pool "+p.name, limit, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) checkCircuit(ctx context.Context, scope, what string, limit *config.AllocationLimit, count int) error {
+	if c.circuits.isOpen(scope) {
+		return fmt.Errorf("%w for %s", errCircuitOpen, what)
+	}
+	if count < limit.MaxAllocations {
+		return nil
+	}
+
+	c.circuits.trip(scope)
+	message := fmt.Sprintf("%d allocations from %s within %s reached the limit of %d; remove annotation %s%s from ConfigMap %s/%s to resume",
+		count, what, limit.Window.Duration, limit.MaxAllocations, CircuitAnnotationPrefix, scope, c.eventRef.Namespace, state.Name)
+	klog.Warningf("Opened allocation circuit: %s", message)
+	c.recorder.Event(c.eventRef, corev1.EventTypeWarning, ReasonAllocationCircuitOpen, message)
+
+	key := CircuitAnnotationPrefix + scope
+	value := fmt.Sprintf("%s: %d allocations within %s", time.Now().UTC().Format(time.RFC3339), count, limit.Window.Duration)
+	if err := c.store.Update(ctx, func(cm *corev1.ConfigMap) {
+		if _, ok := cm.Annotations[key]; !ok {
+			cm.Annotations[key] = value
+		}
+	}); err != nil {
+		// Without the annotation the circuit could not be acknowledged;
+		// the next allocation attempt trips it again and retries
+		c.circuits.untrip(scope)
+		klog.Errorf("Failed to record open allocation circuit %s: %v", scope, err)
+	}
+	return fmt.Errorf("%w for %s", errCircuitOpen, what)
+}
+
+// observeState follows the state ConfigMap: it wakes the held nodes when an
+// operator closes a circuit, applies the pause switches and keeps the
+// alerted thresholds. It runs on every replica.
+func (c *Controller) observeState(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok || cm.Name != state.Name {
+		return
+	}
+	c.observePause(cm)
+	c.observeMigration(cm)
+	c.observeAlerts(cm)
+
+	now := time.Now()
+	closed := c.circuits.observe(cm.Annotations, now)
+	for _, scope := range closed {
+		klog.Infof("Allocation circuit %s was acknowledged, resuming allocation", scope)
+		if c.leading.Load() {
+			c.recorder.Eventf(c.eventRef, corev1.EventTypeNormal, ReasonAllocationCircuitClosed,
+				"Allocation circuit %s was acknowledged, resuming allocation", scope)
+		}
+	}
+	if len(closed) > 0 {
+		if c.leading.Load() {
+			go c.recordCircuitResets(closed, now)
+		}
+		c.wakePending()
+	}
+}
+
+// recordCircuitResets stores when circuits were acknowledged on the state
+// ConfigMap, leader only
+func (c *Controller) recordCircuitResets(scopes []string, at time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateUpdateTimeout)
+	defer cancel()
+
+	value := at.UTC().Format(time.RFC3339)
+	if err := c.store.Update(ctx, func(cm *corev1.ConfigMap) {
+		for _, scope := range scopes {
+			cm.Annotations[CircuitResetAnnotationPrefix+scope] = value
+		}
+	}); err != nil {
+		klog.Errorf("Failed to record the acknowledgement of allocation circuits %v: %v", scopes, err)
+	}
+}
+
+// forgetState follows the deletion of the state ConfigMap as the removal of
+// every annotation, so that deleting it resumes what it paused
+func (c *Controller) forgetState(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	c.observeState(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: cm.Name, Namespace: cm.Namespace}})
+}
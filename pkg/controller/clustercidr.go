@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/apis/clustercidr"
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/selector"
+)
+
+// nodeNameField is the only field a ClusterCIDR selector may match on
+const nodeNameField = "metadata.name"
+
+// clusterCIDRSelector is the node selector of a ClusterCIDR. Like a node
+// affinity, its terms are ORed and the requirements of a term ANDed; a
+// ClusterCIDR without selector matches every node.
+type clusterCIDRSelector struct {
+	all   bool
+	terms []selectorTerm
+}
+
+type selectorTerm struct {
+	labels *selector.NodeSelector
+	fields *selector.NodeSelector
+	// size is the number of requirements, the specificity of a match
+	size int
+}
+
+func newClusterCIDRSelector(ns *corev1.NodeSelector) (*clusterCIDRSelector, error) {
+	if ns == nil {
+		return &clusterCIDRSelector{all: true}, nil
+	}
+	s := &clusterCIDRSelector{}
+	for i, term := range ns.NodeSelectorTerms {
+		t := selectorTerm{
+			labels: &selector.NodeSelector{MatchExpressions: toExpressions(term.MatchExpressions)},
+			fields: &selector.NodeSelector{MatchExpressions: toExpressions(term.MatchFields)},
+			size:   len(term.MatchExpressions) + len(term.MatchFields),
+		}
+		if err := t.labels.Validate(); err != nil {
+			return nil, fmt.Errorf("nodeSelectorTerms[%d].matchExpressions: %w", i, err)
+		}
+		if err := t.fields.Validate(); err != nil {
+			return nil, fmt.Errorf("nodeSelectorTerms[%d].matchFields: %w", i, err)
+		}
+		for _, f := range term.MatchFields {
+			if f.Key != nodeNameField {
+				return nil, fmt.Errorf("nodeSelectorTerms[%d].matchFields: unsupported field %q, expected %s", i, f.Key, nodeNameField)
+			}
+		}
+		s.terms = append(s.terms, t)
+	}
+	return s, nil
+}
+
+func toExpressions(reqs []corev1.NodeSelectorRequirement) []selector.Expression {
+	exprs := make([]selector.Expression, 0, len(reqs))
+	for _, r := range reqs {
+		exprs = append(exprs, selector.Expression{Key: r.Key, Operator: string(r.Operator), Values: r.Values})
+	}
+	return exprs
+}
+
+// specificity returns the number of requirements of the largest term that
+// matches the node, and whether any does. A term without requirements
+// matches no node.
+func (s *clusterCIDRSelector) specificity(node *corev1.Node) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	if s.all {
+		return 0, true
+	}
+	// Fields are matched as labels of a node that only has its name
+	fields := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{nodeNameField: node.Name}}}
+	best, matched := 0, false
+	for _, t := range s.terms {
+		if t.size == 0 || !t.labels.Matches(node) || !t.fields.Matches(fields) {
+			continue
+		}
+		if !matched || t.size > best {
+			best, matched = t.size, true
+		}
+	}
+	return best, matched
+}
+
+// mostSpecificPool picks the pool of a node with the upstream
+// MultiCIDRRangeAllocator rules: the most requirements matched, then the
+// fewest blocks, then the smallest blocks, then the first name. The pools
+// are sorted by name.
+func mostSpecificPool(pools []*pool, selectors map[string]*clusterCIDRSelector, node *corev1.Node) *pool {
+	var best *pool
+	var bestSize, bestBlocks, bestMask int
+	for _, p := range pools {
+		size, ok := selectors[p.name].specificity(node)
+		if !ok {
+			continue
+		}
+		blocks, mask := poolBlocks(p)
+		switch {
+		case best == nil, size > bestSize:
+		case size < bestSize:
+			continue
+		case blocks < bestBlocks:
+		case blocks > bestBlocks:
+			continue
+		case mask > bestMask:
+		default:
+			continue
+		}
+		best, bestSize, bestBlocks, bestMask = p, size, blocks, mask
+	}
+	return best
+}
+
+// poolBlocks returns the number of default-size blocks of a pool and their
+// mask size
+func poolBlocks(p *pool) (int, int) {
+	settings := p.settings.Load()
+	_, ipnet, err := net.ParseCIDR(settings.ClusterCIDR)
+	if err != nil {
+		return 0, settings.NodeCIDRMaskSize
+	}
+	ones, _ := ipnet.Mask.Size()
+	return 1 << (settings.NodeCIDRMaskSize - ones), settings.NodeCIDRMaskSize
+}
+
+// WatchClusterCIDRs makes the controller read its pools from ClusterCIDR
+// objects, with poolSource ClusterCIDR. It must be called before the
+// informer factory is started and before Prepare.
+func (c *Controller) WatchClusterCIDRs(factory dynamicinformer.DynamicSharedInformerFactory) {
+	informer := factory.ForResource(clustercidr.Resource)
+	c.clusterCIDRLister = informer.Lister()
+	c.clusterCIDRsSynced = informer.Informer().HasSynced
+
+	_, _ = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.syncClusterCIDRs() },
+		UpdateFunc: func(old, new interface{}) { c.syncClusterCIDRs() },
+		DeleteFunc: func(interface{}) { c.syncClusterCIDRs() },
+	})
+}
+
+// syncClusterCIDRs rebuilds the pools from the ClusterCIDR objects. Only
+// IPv4 ranges are allocated. A ClusterCIDR that cannot be used is reported
+// with a Warning Event on it.
+func (c *Controller) syncClusterCIDRs() {
+	objs, err := c.clusterCIDRLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	var ccs []*clustercidr.ClusterCIDR
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		cc, err := clustercidr.FromUnstructured(u)
+		if err != nil {
+			runtime.HandleError(fmt.Errorf("failed to decode ClusterCIDR %s: %w", u.GetName(), err))
+			continue
+		}
+		ccs = append(ccs, cc)
+	}
+	sort.Slice(ccs, func(i, j int) bool { return ccs[i].Name < ccs[j].Name })
+
+	rejected := map[string]error{}
+	selectors := map[string]*clusterCIDRSelector{}
+	configs := make([]config.Pool, 0, len(ccs))
+	for _, cc := range ccs {
+		if cc.Spec.IPv4 == "" {
+			rejected[cc.Name] = fmt.Errorf("only IPv4 ranges are supported")
+			continue
+		}
+		if cc.Spec.IPv6 != "" {
+			klog.V(2).Infof("Ignoring IPv6 range %s of ClusterCIDR %s", cc.Spec.IPv6, cc.Name)
+		}
+		s, err := newClusterCIDRSelector(cc.Spec.NodeSelector)
+		if err != nil {
+			rejected[cc.Name] = fmt.Errorf("nodeSelector: %w", err)
+			continue
+		}
+		selectors[cc.Name] = s
+		configs = append(configs, config.Pool{
+			Name:             cc.Name,
+			ClusterCIDR:      cc.Spec.IPv4,
+			NodeCIDRMaskSize: 32 - int(cc.Spec.PerNodeHostBits),
+		})
+	}
+
+	// Selectors first, so that a new pool is never seen without one
+	c.poolsMu.Lock()
+	c.poolSelectors = selectors
+	c.publishPoolsLocked()
+	c.poolsMu.Unlock()
+	for name, err := range c.setPools(configs) {
+		rejected[name] = err
+	}
+	c.poolsMu.Lock()
+	c.poolErrors = rejected
+	c.poolsMu.Unlock()
+	c.syncOverlaps()
+
+	if c.leading.Load() {
+		for _, cc := range ccs {
+			if err := rejected[cc.Name]; err != nil {
+				ref := &corev1.ObjectReference{
+					APIVersion: clustercidr.Resource.GroupVersion().String(),
+					Kind:       "ClusterCIDR",
+					Name:       cc.Name,
+					UID:        cc.UID,
+				}
+				c.recorder.Eventf(ref, corev1.EventTypeWarning, "ClusterCIDRRejected", "Not allocating from %s: %v", cc.Name, err)
+			}
+		}
+	}
+
+	if c.allocation != nil {
+		c.enqueueAll(c.allocation)
+	}
+}
@@ -2,82 +2,271 @@ package controller
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	corelister "k8s.io/client-go/listers/core/v1"
+	networkinglister "k8s.io/client-go/listers/networking/v1beta1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"github.com/imroc/podcidr-controller/pkg/cidr"
-	"github.com/imroc/podcidr-controller/pkg/selector"
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/metrics"
+	"github.com/imroc/podcidr-controller/pkg/state"
 	"github.com/imroc/podcidr-controller/pkg/taint"
 )
 
 type Controller struct {
-	clientset     kubernetes.Interface
-	nodeLister    corelister.NodeLister
-	nodeSynced    cache.InformerSynced
-	workqueue     workqueue.TypedRateLimitingInterface[string]
-	allocator     *cidr.Allocator
-	clusterCIDR   string
-	nodeSelector  *selector.NodeSelector
-	taintRemover  *taint.TaintRemover
+	clientset    kubernetes.Interface
+	nodeLister   corelister.NodeLister
+	nodeSynced   cache.InformerSynced
+	podIndexer   cache.Indexer
+	podSynced    cache.InformerSynced
+	pending      *pendingNodes
+	circuits     *circuitState
+	quotas       *quotaState
+	assignments  *assignments
+	taintRemover atomic.Pointer[taint.TaintRemover]
+	// priority orders the allocation queue. It is not read through Config,
+	// whose lock is held while queueing.
+	priority atomic.Pointer[config.AllocationPriority]
+
+	// pools are the pools nodes try in order, see getPools. poolErrors
+	// holds the PodCIDRPool or ClusterCIDR objects whose settings were
+	// rejected. poolSelectors replaces the pool selectors with poolSource
+	// ClusterCIDR.
+	poolsMu       sync.RWMutex
+	pools         []*pool
+	poolErrors    map[string]error
+	poolSelectors map[string]*clusterCIDRSelector
+	// poolView is published whenever pools or poolSelectors change. It is
+	// read by poolFor without poolsMu, as the allocation queue ranks nodes
+	// by pool under its own lock.
+	poolView atomic.Pointer[poolView]
+
+	// poolClient and the PodCIDRPool lister are set with poolSource
+	// PodCIDRPool
+	poolClient        dynamic.Interface
+	poolLister        cache.GenericLister
+	poolObjectsSynced cache.InformerSynced
+
+	// clusterCIDRLister is set with poolSource ClusterCIDR
+	clusterCIDRLister  cache.GenericLister
+	clusterCIDRsSynced cache.InformerSynced
+
+	// serviceCIDRLister is set with overlapProtection where the API server
+	// serves ServiceCIDR objects
+	serviceCIDRLister  networkinglister.ServiceCIDRLister
+	serviceCIDRsSynced cache.InformerSynced
+
+	// overlaps are the protected ranges found inside a pool, to log new ones
+	overlapsMu sync.Mutex
+	overlaps   map[string]bool
+
+	// recordClient and the NodeCIDRAllocation lister are set with
+	// allocationRecords
+	recordClient  dynamic.Interface
+	recordLister  cache.GenericLister
+	recordsSynced cache.InformerSynced
+
+	// allocation and taintRemoval are the sub-controllers, nil if disabled
+	allocation   *reconciler
+	taintRemoval *reconciler
+	reconcilers  []*reconciler
+
+	// store and the state informer give access to the state ConfigMap,
+	// which holds the allocation circuits and the pause switches
+	store                *state.Store
+	stateInformerFactory informers.SharedInformerFactory
+	stateSynced          cache.InformerSynced
+
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
+	eventRef         *corev1.ObjectReference
+
+	metrics             *metrics.Registry
+	syncs               *metrics.CounterVec
+	observedAllocations *metrics.CounterVec
+	collisions          *metrics.CounterVec
+
+	configMu sync.Mutex
+	config   *config.Configuration
+
+	// allocationPaused and taintRemovalPaused follow the pause annotations
+	// of the state ConfigMap
+	allocationPaused   atomic.Bool
+	taintRemovalPaused atomic.Bool
+	// observing is true during the observe-only phase of a migration from
+	// kube-controller-manager, until the active annotation is set
+	observing atomic.Bool
+
+	// leading is true while this replica holds the leader lease. Standby
+	// replicas keep the allocator in sync with the informer but never write.
+	// CIDR allocation is additionally gated by shard ownership.
+	leading atomic.Bool
+	// taintLeading gates taint removal. It follows leading unless the
+	// taint remover is elected with its own Lease.
+	taintLeading atomic.Bool
+	// leadingMu serializes leadership changes, and leaderGeneration tells
+	// a catch-up whether the change it completes was superseded
+	leadingMu        sync.Mutex
+	leaderGeneration atomic.Uint64
+	// podName is the pod this replica runs in, labelled with LeaderLabel
+	// while leading. Empty when the pod is not labelled.
+	podName string
 }
 
 func NewController(
 	clientset kubernetes.Interface,
 	informerFactory informers.SharedInformerFactory,
-	clusterCIDR string,
-	nodeMaskSize int,
-	nodeSelector *selector.NodeSelector,
-	taintRemover *taint.TaintRemover,
+	cfg *config.Configuration,
+	namespace string,
 ) (*Controller, error) {
-	allocator, err := cidr.NewAllocator(clusterCIDR, nodeMaskSize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create CIDR allocator: %w", err)
-	}
-
 	nodeInformer := informerFactory.Core().V1().Nodes()
+	eventBroadcaster, recorder := newEventRecorder(clientset)
 
 	c := &Controller{
-		clientset:    clientset,
-		nodeLister:   nodeInformer.Lister(),
-		nodeSynced:   nodeInformer.Informer().HasSynced,
-		workqueue:    workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
-		allocator:    allocator,
-		clusterCIDR:  clusterCIDR,
-		nodeSelector: nodeSelector,
-		taintRemover: taintRemover,
+		clientset:   clientset,
+		nodeLister:  nodeInformer.Lister(),
+		nodeSynced:  nodeInformer.Informer().HasSynced,
+		pending:     newPendingNodes(),
+		circuits:    newCircuitState(),
+		quotas:      newQuotaState(),
+		assignments: newAssignments(),
+		store:       state.NewStore(clientset, namespace),
+		config:      cfg,
+
+		eventBroadcaster: eventBroadcaster,
+		recorder:         recorder,
+		eventRef:         stateReference(namespace),
+
+		metrics: metrics.NewRegistry(),
+		syncs: metrics.NewCounterVec("podcidr_syncs_total",
+			"Node syncs per sub-controller and result (success, error or parked)", "controller", "result"),
+		observedAllocations: metrics.NewCounterVec("podcidr_migration_observed_allocations_total",
+			"Nodes allocated a podCIDR by another allocator while observing a migration, per pool", "pool"),
+		collisions: metrics.NewCounterVec("podcidr_allocation_collisions_total",
+			"Allocations whose block derived from the node was taken, per pool", "pool"),
 	}
+	c.observing.Store(cfg.Migration != nil)
+	c.priority.Store(cfg.AllocationPriority)
+
+	if cfg.ControllerEnabled(config.CIDRAllocator) {
+		c.allocation = newReconciler(config.CIDRAllocator, c.syncs, c.syncAllocation, newPriorityQueue(c.rankNode))
+		c.allocation.park = c.parkNode
+		c.reconcilers = append(c.reconcilers, c.allocation)
+	}
+	if cfg.ControllerEnabled(config.TaintRemover) {
+		c.taintRemoval = newReconciler(config.TaintRemover, c.syncs, c.syncTaints, nil)
+		c.reconcilers = append(c.reconcilers, c.taintRemoval)
+	}
+
+	for _, poolConfig := range cfg.Pools {
+		p, err := newPool(poolConfig)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", poolConfig.Name, err)
+		}
+		c.pools = append(c.pools, p)
+	}
+	c.publishPoolsLocked()
+
+	taintRemover, err := taint.NewTaintRemoverFromList(cfg.RemoveTaints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse remove-taints: %w", err)
+	}
+	c.taintRemover.Store(taintRemover)
+	c.registerMetrics()
 
 	_, _ = nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: c.enqueueNode,
+		AddFunc: func(obj interface{}) {
+			c.observeNode(obj)
+			c.observeNodeAddresses(nil, obj)
+			c.enqueueNode(obj)
+		},
 		UpdateFunc: func(old, new interface{}) {
+			c.observeNode(new)
+			c.releaseDroppedCIDRs(old, new)
+			c.observeAllocation(old, new)
+			c.reportObservedAllocation(old, new)
+			c.observeNodeAddresses(old, new)
 			c.enqueueNode(new)
 		},
 		DeleteFunc: c.handleNodeDelete,
 	})
 
+	// The state ConfigMap is watched on its own, in the controller's namespace
+	c.stateInformerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", state.Name).String()
+		}))
+	stateInformer := c.stateInformerFactory.Core().V1().ConfigMaps().Informer()
+	c.stateSynced = stateInformer.HasSynced
+	_, _ = stateInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.observeState,
+		UpdateFunc: func(old, new interface{}) { c.observeState(new) },
+		DeleteFunc: c.forgetState,
+	})
+
+	// Pods are only watched when extra blocks depend on pod counts
+	if c.allocation != nil && cfg.WatchesPods() {
+		podInformer := informerFactory.Core().V1().Pods().Informer()
+		if err := podInformer.AddIndexers(cache.Indexers{podNodeNameIndex: podIndexFunc}); err != nil {
+			return nil, fmt.Errorf("failed to index pods: %w", err)
+		}
+		c.podIndexer = podInformer.GetIndexer()
+		c.podSynced = podInformer.HasSynced
+		_, _ = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.enqueuePodNode,
+			UpdateFunc: func(old, new interface{}) { c.enqueuePodNode(new) },
+		})
+	}
+
 	return c, nil
 }
 
+// enqueueNode queues a node for every enabled sub-controller
 func (c *Controller) enqueueNode(obj interface{}) {
 	key, err := cache.MetaNamespaceKeyFunc(obj)
 	if err != nil {
 		runtime.HandleError(err)
 		return
 	}
-	c.workqueue.Add(key)
+	for _, r := range c.reconcilers {
+		r.queue.Add(key)
+	}
+}
+
+// observeNode mirrors a node's blocks into the allocator so that the
+// in-memory state stays current on standby replicas as well as on the leader.
+func (c *Controller) observeNode(obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+	c.quotas.observe(node)
+	c.assignments.observe(node)
+	for _, cidrBlock := range nodeCIDRs(node) {
+		if err := c.markAllocated(cidrBlock); err != nil {
+			klog.V(4).Infof("Ignoring CIDR %s of node %s: %v", cidrBlock, node.Name, err)
+		}
+	}
 }
 
 func (c *Controller) handleNodeDelete(obj interface{}) {
@@ -95,33 +284,339 @@ func (c *Controller) handleNodeDelete(obj interface{}) {
 		}
 	}
 
-	if node.Spec.PodCIDR != "" {
-		if err := c.allocator.Release(node.Spec.PodCIDR); err != nil {
-			klog.Warningf("Failed to release CIDR %s for deleted node %s: %v", node.Spec.PodCIDR, node.Name, err)
+	c.pending.remove(node.Name)
+	c.quotas.forget(node.Name)
+	c.observeNodeAddresses(node, nil)
+	released := false
+	for _, cidrBlock := range nodeCIDRs(node) {
+		c.assignments.remove(cidrBlock)
+		if err := c.release(cidrBlock); err != nil {
+			klog.Warningf("Failed to release CIDR %s for deleted node %s: %v", cidrBlock, node.Name, err)
 		} else {
-			klog.Infof("Released CIDR %s from deleted node %s", node.Spec.PodCIDR, node.Name)
+			klog.Infof("Released CIDR %s from deleted node %s", cidrBlock, node.Name)
+			released = true
 		}
 	}
+	if released {
+		c.wakePending()
+	}
 }
 
-func (c *Controller) Run(ctx context.Context, workers int) error {
-	defer runtime.HandleCrash()
-	defer c.workqueue.ShutDown()
-
-	klog.Info("Starting podcidr-controller")
-
+// Prepare waits for the informer caches to sync and rebuilds the allocator
+// state from existing nodes. It performs no writes, so it is run on every
+// replica before leader election to keep standbys ready to take over.
+func (c *Controller) Prepare(ctx context.Context) error {
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.nodeSynced); !ok {
+	c.stateInformerFactory.Start(ctx.Done())
+	synced := []cache.InformerSynced{c.nodeSynced, c.stateSynced}
+	if c.podSynced != nil {
+		synced = append(synced, c.podSynced)
+	}
+	if c.poolObjectsSynced != nil {
+		synced = append(synced, c.poolObjectsSynced)
+	}
+	if c.recordsSynced != nil {
+		synced = append(synced, c.recordsSynced)
+	}
+	if c.clusterCIDRsSynced != nil {
+		synced = append(synced, c.clusterCIDRsSynced)
+	}
+	if c.serviceCIDRsSynced != nil {
+		synced = append(synced, c.serviceCIDRsSynced)
+	}
+	if ok := cache.WaitForCacheSync(ctx.Done(), synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	if c.poolLister != nil {
+		c.syncPodCIDRPools()
+	}
+	if c.clusterCIDRLister != nil {
+		c.syncClusterCIDRs()
+	}
 
 	if err := c.syncExistingNodes(); err != nil {
 		return fmt.Errorf("failed to sync existing nodes: %w", err)
 	}
+	if c.recordLister != nil {
+		if err := c.restoreFromRecords(); err != nil {
+			return fmt.Errorf("failed to restore allocation records: %w", err)
+		}
+	}
+
+	overlaps := c.syncOverlaps()
+	if len(overlaps) > 0 && c.Config().OverlapProtection == config.OverlapProtectionRefuse {
+		return fmt.Errorf("refusing to start, protected ranges overlap the pools: %s", strings.Join(overlaps, "; "))
+	}
+	return nil
+}
+
+// Shards returns the names of the shards that CIDR allocation is split into
+func (c *Controller) Shards() []string {
+	var names []string
+	for _, p := range c.getPools() {
+		for _, s := range p.shards {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+// Config returns the configuration currently in effect
+func (c *Controller) Config() *config.Configuration {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	return c.config
+}
+
+// IsLeading reports whether this replica holds the leader lease
+func (c *Controller) IsLeading() bool {
+	return c.leading.Load()
+}
+
+// ApplyConfig applies a reloaded configuration. Node selectors, mask size
+// rules, exclusions and taint rules are swapped, and pools whose cluster
+// CIDR was widened are expanded in place. Any other change is refused as a
+// whole: every pool is checked before any of them changes.
+func (c *Controller) ApplyConfig(cfg *config.Configuration) error {
+	expanded, err := c.swapConfig(cfg)
+	if err != nil {
+		return err
+	}
+	klog.Info("Applied new node selectors, mask size rules, exclusions and taint rules")
+
+	// A widened pool may now contain protected ranges
+	if expanded {
+		c.syncOverlaps()
+	}
+	c.enqueueAll()
+	return nil
+}
+
+// swapConfig checks a reloaded configuration against every pool, then
+// applies it. It reports whether a pool was expanded.
+func (c *Controller) swapConfig(cfg *config.Configuration) (bool, error) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	if err := config.CheckReload(c.config, cfg); err != nil {
+		return false, err
+	}
+
+	taintRemover, err := taint.NewTaintRemoverFromList(cfg.RemoveTaints)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse remove-taints: %w", err)
+	}
+
+	// Pools read from PodCIDRPool objects are not in the configuration
+	pools := c.getPools()
+	if cfg.PoolSource != "" {
+		pools = nil
+	}
+	updates := make([]*poolUpdate, len(pools))
+	for i, p := range pools {
+		if updates[i], err = p.prepare(cfg.Pools[i]); err != nil {
+			return false, fmt.Errorf("pool %s: %w", p.name, err)
+		}
+	}
+
+	expanded := false
+	for i, p := range pools {
+		p.commit(updates[i])
+		expanded = expanded || updates[i].expand
+	}
+	c.taintRemover.Store(taintRemover)
+	c.priority.Store(cfg.AllocationPriority)
+	c.config = cfg
+	return expanded, nil
+}
+
+// poolView is a snapshot of the pools and their ClusterCIDR selectors
+type poolView struct {
+	pools     []*pool
+	selectors map[string]*clusterCIDRSelector
+}
+
+// publishPoolsLocked publishes the current pools and selectors to poolFor.
+// poolsMu must be held for writing.
+func (c *Controller) publishPoolsLocked() {
+	c.poolView.Store(&poolView{pools: c.pools, selectors: c.poolSelectors})
+}
+
+// poolFor returns the first pool whose selector matches the node, or nil.
+// ClusterCIDR pools are picked by the most specific selector instead. It
+// takes no lock.
+func (c *Controller) poolFor(node *corev1.Node) *pool {
+	view := c.poolView.Load()
+	if view == nil {
+		return nil
+	}
+	if view.selectors != nil {
+		return mostSpecificPool(view.pools, view.selectors, node)
+	}
+
+	for _, p := range view.pools {
+		if p.selector.Load().Matches(node) {
+			return p
+		}
+	}
+	return nil
+}
+
+// markAllocated reserves a CIDR in whichever pool contains it
+func (c *Controller) markAllocated(cidrBlock string) error {
+	for _, p := range c.getPools() {
+		if err := p.markAllocated(cidrBlock); err != cidr.ErrCIDROutOfRange {
+			return err
+		}
+	}
+	return cidr.ErrCIDROutOfRange
+}
+
+// release frees a CIDR in whichever pool contains it
+func (c *Controller) release(cidrBlock string) error {
+	for _, p := range c.getPools() {
+		if err := p.release(cidrBlock); err != cidr.ErrCIDROutOfRange {
+			return err
+		}
+	}
+	return cidr.ErrCIDROutOfRange
+}
+
+// isAllocated reports whether a CIDR is reserved in any pool
+func (c *Controller) isAllocated(cidrBlock string) bool {
+	for _, p := range c.getPools() {
+		if p.isAllocated(cidrBlock) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLeading marks whether this replica holds the leader lease. Leader-only
+// work such as taint removal is skipped while not leading. A new leader
+// only starts once its allocator caught up with the API server.
+func (c *Controller) SetLeading(leading bool) {
+	generation := c.leaderGeneration.Add(1)
+	apply := func() {
+		c.leadingMu.Lock()
+		defer c.leadingMu.Unlock()
+		if c.leaderGeneration.Load() != generation {
+			return
+		}
+		leadingChanged := c.leading.Swap(leading) != leading
+		changed := leadingChanged
+		if !c.Config().LeaderElection.SeparateLeases {
+			changed = c.taintLeading.Swap(leading) != leading || changed
+		}
+		if changed && leading {
+			c.enqueueAll()
+		}
+		if leadingChanged {
+			c.updateLeaderLabel(leading)
+		}
+	}
+	if !leading {
+		apply()
+		return
+	}
+	c.afterCatchUp(func() bool { return c.leaderGeneration.Load() == generation }, apply)
+}
+
+// SetTaintRemoverLeading marks whether this replica holds the taint
+// remover's own Lease, when leaderElection.separateLeases is set
+func (c *Controller) SetTaintRemoverLeading(leading bool) {
+	if c.taintLeading.Swap(leading) != leading && leading && c.taintRemoval != nil {
+		c.enqueueAll(c.taintRemoval)
+	}
+}
 
-	klog.Info("Starting workers")
-	for i := 0; i < workers; i++ {
-		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+// SetShardOwned marks whether this replica may allocate from a shard.
+// Dropping ownership blocks until in-flight allocations on the shard finish.
+// A new owner only allocates once its allocator caught up with the API
+// server, as the previous owner may have handed over right after a write.
+func (c *Controller) SetShardOwned(name string, owned bool) {
+	for _, p := range c.getPools() {
+		for _, s := range p.shards {
+			if s.name != name {
+				continue
+			}
+			generation := s.generation.Add(1)
+			if !owned {
+				s.setOwned(false)
+				return
+			}
+			c.afterCatchUp(func() bool { return s.generation.Load() == generation }, func() {
+				s.mu.Lock()
+				if s.generation.Load() == generation {
+					s.owned = true
+				}
+				s.mu.Unlock()
+				if c.allocation != nil {
+					c.enqueueAll(c.allocation)
+				}
+			})
+			return
+		}
+	}
+}
+
+// wakePending queues the nodes waiting for capacity, oldest first
+func (c *Controller) wakePending() {
+	if c.allocation == nil {
+		return
+	}
+	names := c.pending.drain()
+	if len(names) > 0 {
+		klog.V(2).Infof("Waking %d nodes waiting for a free CIDR", len(names))
+	}
+	for _, name := range names {
+		c.allocation.queue.Add(name)
+	}
+}
+
+// enqueueAll queues every node for the given sub-controllers, or for all
+// of them, used to catch up after gaining leadership or ownership
+func (c *Controller) enqueueAll(reconcilers ...*reconciler) {
+	if len(reconcilers) == 0 {
+		reconcilers = c.reconcilers
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, node := range nodes {
+		for _, r := range reconcilers {
+			r.queue.Add(node.Name)
+		}
+	}
+}
+
+// Run starts the workers. It must only be called once Prepare has
+// returned. Workers only write for the leader and for owned shards.
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer runtime.HandleCrash()
+	defer c.eventBroadcaster.Shutdown()
+
+	klog.Info("Starting podcidr-controller")
+
+	for _, r := range c.reconcilers {
+		defer r.queue.ShutDown()
+		klog.Infof("Starting %s workers", r.name)
+		for i := 0; i < workers; i++ {
+			go wait.UntilWithContext(ctx, r.run, time.Second)
+		}
+	}
+	if c.allocation != nil {
+		go wait.UntilWithContext(ctx, func(context.Context) { c.wakePending() }, pendingResyncPeriod)
+		go wait.UntilWithContext(ctx, c.checkCapacity, capacityCheckPeriod)
+		go wait.UntilWithContext(ctx, c.sweepAssignments, assignmentSweepPeriod)
+	}
+	if c.poolClient != nil {
+		go wait.UntilWithContext(ctx, c.updatePodCIDRPoolStatus, poolStatusPeriod)
+	}
+	if c.recordClient != nil {
+		go wait.UntilWithContext(ctx, c.sweepRecords, recordSweepPeriod)
 	}
 
 	klog.Info("Started workers")
@@ -138,13 +633,13 @@ func (c *Controller) syncExistingNodes() error {
 	}
 
 	for _, node := range nodes {
-		if node.Spec.PodCIDR != "" {
-			// Reserve all existing CIDRs regardless of selector to prevent conflicts
-			if err := c.allocator.MarkAllocated(node.Spec.PodCIDR); err != nil {
-				klog.Warningf("Node %s has podCIDR %s which is not in cluster CIDR %s: %v",
-					node.Name, node.Spec.PodCIDR, c.clusterCIDR, err)
+		// Reserve all existing CIDRs regardless of selector to prevent conflicts
+		for _, cidrBlock := range nodeCIDRs(node) {
+			if err := c.markAllocated(cidrBlock); err != nil {
+				klog.Warningf("Node %s has CIDR %s which is not in any pool: %v",
+					node.Name, cidrBlock, err)
 			} else {
-				klog.Infof("Marked existing CIDR %s as allocated for node %s", node.Spec.PodCIDR, node.Name)
+				klog.Infof("Marked existing CIDR %s as allocated for node %s", cidrBlock, node.Name)
 			}
 		}
 	}
@@ -152,30 +647,42 @@ func (c *Controller) syncExistingNodes() error {
 	return nil
 }
 
-func (c *Controller) runWorker(ctx context.Context) {
-	for c.processNextWorkItem(ctx) {
+// parkNode takes nodes waiting for capacity, held by an open circuit or
+// over quota out of the allocation queue instead of backing off; a release
+// or an acknowledgement wakes them
+func (c *Controller) parkNode(key string, err error) bool {
+	if !stderrors.Is(err, cidr.ErrCIDRExhausted) && !stderrors.Is(err, errCircuitOpen) && !stderrors.Is(err, errQuotaExceeded) {
+		return false
 	}
-}
-
-func (c *Controller) processNextWorkItem(ctx context.Context) bool {
-	key, shutdown := c.workqueue.Get()
-	if shutdown {
+	node, getErr := c.nodeLister.Get(key)
+	if getErr != nil {
 		return false
 	}
-	defer c.workqueue.Done(key)
+	klog.Infof("Node %s is waiting: %v", key, err)
+	c.pending.park(key, node.CreationTimestamp.Time)
+	return true
+}
 
-	err := c.syncNode(ctx, key)
-	if err == nil {
-		c.workqueue.Forget(key)
-		return true
+// syncTaints removes the configured taints from a node, leader only
+func (c *Controller) syncTaints(ctx context.Context, key string) error {
+	node, err := c.nodeLister.Get(key)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	runtime.HandleError(fmt.Errorf("error syncing node %s: %v", key, err))
-	c.workqueue.AddRateLimited(key)
-	return true
+	taintRemover := c.taintRemover.Load()
+	if taintRemover == nil || !c.taintLeading.Load() || c.taintRemovalPaused.Load() {
+		return nil
+	}
+	return c.removeTaints(ctx, taintRemover, node)
 }
 
-func (c *Controller) syncNode(ctx context.Context, key string) error {
+// syncAllocation assigns a CIDR to a node, or extra blocks to a node that
+// outgrew its first, and reports the outcome on the node
+func (c *Controller) syncAllocation(ctx context.Context, key string) error {
 	node, err := c.nodeLister.Get(key)
 	if errors.IsNotFound(err) {
 		return nil
@@ -184,45 +691,155 @@ func (c *Controller) syncNode(ctx context.Context, key string) error {
 		return err
 	}
 
-	// Handle taint removal (independent of CIDR allocation)
-	if c.taintRemover != nil {
-		if err := c.removeTaints(ctx, node); err != nil {
-			return err
+	// Observing a migration from kube-controller-manager writes nothing
+	if c.observing.Load() {
+		klog.V(4).Infof("Observing a migration, skipping node %s", node.Name)
+		return nil
+	}
+
+	// Pick the first pool whose selector matches the node
+	p := c.poolFor(node)
+
+	// Clear the failure signals of nodes that got a CIDR, on the replica
+	// that reports their failures, and record their blocks, leader only
+	if node.Spec.PodCIDR != "" {
+		if c.reportsFor(p, node) {
+			if err := c.reportAllocated(ctx, node); err != nil {
+				return err
+			}
+		}
+		if c.leading.Load() {
+			if err := c.recordAllocations(ctx, node); err != nil {
+				return err
+			}
 		}
 	}
 
-	// Already has CIDR
+	// A node that already has a CIDR only needs work if its pool hands out
+	// extra blocks
+	if node.Spec.PodCIDR != "" && (p == nil || p.extraCIDRs == nil) {
+		return nil
+	}
+	if p == nil {
+		klog.V(4).Infof("Node %s does not match any pool selector, skipping", node.Name)
+		return nil
+	}
+
+	if c.allocationPaused.Load() {
+		klog.V(4).Infof("CIDR allocation is paused, skipping node %s", node.Name)
+		return nil
+	}
+
+	// Only the owner of the node's shard may allocate
+	s := p.shardFor(node)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.owned {
+		klog.V(4).Infof("Shard %s of node %s is not owned by this replica, skipping", s.name, node.Name)
+		return nil
+	}
+
 	if node.Spec.PodCIDR != "" {
+		return c.syncExtraCIDRs(ctx, p, s, node)
+	}
+
+	// Nodes still being initialised are requeued until they meet the
+	// preconditions. They are synced often while waiting, so this is only
+	// logged verbosely; the waiting nodes are exported as a metric.
+	if reason, detail, wait := unmetPrecondition(c.Config().AllocationPreconditions, node, time.Now()); reason != "" {
+		klog.V(2).Infof("Node %s does not meet the allocation preconditions yet (%s): %s", node.Name, reason, detail)
+		c.allocation.queue.AddAfter(key, wait)
 		return nil
 	}
 
-	// Check if node matches selector
-	if !c.nodeSelector.Matches(node) {
-		klog.V(4).Infof("Node %s does not match selector, skipping", node.Name)
+	maskSize, source, err := p.maskSize.Load().For(node)
+	if err != nil {
+		// Not retried: fixing the annotation or label updates the node
+		klog.Warningf("Node %s requests an invalid mask size, skipping: %v", node.Name, err)
 		return nil
 	}
 
-	cidrBlock, err := c.allocator.AllocateNext()
+	cidrBlock, unreserve, err := c.allocateBlock(ctx, p, s, node, maskSize)
 	if err != nil {
-		return fmt.Errorf("failed to allocate CIDR for node %s: %w", node.Name, err)
+		if stderrors.Is(err, errNoNodeAddress) {
+			klog.V(4).Infof("Node %s has no InternalIP yet, waiting for it", node.Name)
+			return nil
+		}
+		// Hold the node without signalling a failure while it is over
+		// quota or a circuit is open
+		if !stderrors.Is(err, errQuotaExceeded) && !stderrors.Is(err, errCircuitOpen) {
+			if reportErr := c.reportAllocationFailure(ctx, node, err); reportErr != nil {
+				klog.Warningf("Failed to report allocation failure on node %s: %v", node.Name, reportErr)
+			}
+		}
+		return err
 	}
 
 	nodeCopy := node.DeepCopy()
 	nodeCopy.Spec.PodCIDR = cidrBlock
 	nodeCopy.Spec.PodCIDRs = []string{cidrBlock}
+	nodeCopy.Spec.Taints = taint.FilterOutTaints(nodeCopy.Spec.Taints, []corev1.Taint{unallocatedTaint})
 
+	// Recorded before the update so that the validating webhook knows
+	// the block is the node's own
+	c.assignments.add(cidrBlock, node.Name, time.Now(), unreserve)
 	_, err = c.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
 	if err != nil {
-		_ = c.allocator.Release(cidrBlock)
+		c.assignments.remove(cidrBlock)
+		_ = s.allocator.Release(cidrBlock)
+		unreserve()
+		c.wakePending()
 		return fmt.Errorf("failed to update node %s with CIDR %s: %w", node.Name, cidrBlock, err)
 	}
+	p.capacity.recordAllocation(node.Name, cidrBlock, time.Now())
 
-	klog.Infof("Allocated CIDR %s to node %s", cidrBlock, node.Name)
+	klog.Infof("Allocated CIDR %s to node %s (mask size from %s)", cidrBlock, node.Name, source)
 	return nil
 }
 
-func (c *Controller) removeTaints(ctx context.Context, node *corev1.Node) error {
-	taintsToRemove := c.taintRemover.GetTaintsToRemove(node)
+// allocateBlock takes a block of the given mask size from the node's shard,
+// once the node's quotas and the allocation limits allow it. The caller
+// holds the shard lock and calls unreserve if it cannot use the block.
+func (c *Controller) allocateBlock(ctx context.Context, p *pool, s *cidrShard, node *corev1.Node, maskSize int) (string, func(), error) {
+	unreserve, err := c.reserveQuota(node, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.checkAllocationLimits(ctx, p); err != nil {
+		unreserve()
+		return "", nil, err
+	}
+
+	settings := p.settings.Load()
+	if !settings.Deterministic() {
+		cidrBlock, err := s.allocator.AllocateNextSize(maskSize)
+		if err != nil {
+			unreserve()
+			return "", nil, fmt.Errorf("failed to allocate CIDR for node %s from shard %s: %w", node.Name, s.name, err)
+		}
+		return cidrBlock, unreserve, nil
+	}
+
+	// Deterministic strategies start from the block derived from the node
+	// and probe the following ones
+	preferred, err := preferredBlock(settings, node)
+	if err != nil {
+		unreserve()
+		return "", nil, err
+	}
+	cidrBlock, probed, err := s.allocator.AllocateFrom(preferred, maskSize)
+	if err != nil {
+		unreserve()
+		return "", nil, fmt.Errorf("failed to allocate CIDR for node %s from shard %s: %w", node.Name, s.name, err)
+	}
+	if probed > 0 {
+		c.reportCollision(p, node, cidrBlock, probed)
+	}
+	return cidrBlock, unreserve, nil
+}
+
+func (c *Controller) removeTaints(ctx context.Context, taintRemover *taint.TaintRemover, node *corev1.Node) error {
+	taintsToRemove := taintRemover.GetTaintsToRemove(node)
 	if len(taintsToRemove) == 0 {
 		return nil
 	}
@@ -234,7 +851,7 @@ func (c *Controller) removeTaints(ctx context.Context, node *corev1.Node) error
 	}
 
 	// Recalculate taints to remove based on fresh node
-	taintsToRemove = c.taintRemover.GetTaintsToRemove(freshNode)
+	taintsToRemove = taintRemover.GetTaintsToRemove(freshNode)
 	if len(taintsToRemove) == 0 {
 		return nil
 	}
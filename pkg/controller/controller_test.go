@@ -0,0 +1,2234 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/imroc/podcidr-controller/pkg/alert"
+	"github.com/imroc/podcidr-controller/pkg/apis/clustercidr"
+	"github.com/imroc/podcidr-controller/pkg/apis/v1alpha1"
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/masksize"
+	"github.com/imroc/podcidr-controller/pkg/selector"
+	"github.com/imroc/podcidr-controller/pkg/taint"
+)
+
+func newTestNode(name, podCIDR string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+	}
+}
+
+func newTestController(ctx context.Context, t *testing.T, nodes ...*corev1.Node) (*Controller, *fake.Clientset) {
+	t.Helper()
+	return newShardedTestController(ctx, t, 1, nodes...)
+}
+
+func newShardedTestController(ctx context.Context, t *testing.T, shards int, nodes ...*corev1.Node) (*Controller, *fake.Clientset) {
+	t.Helper()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16", Shards: shards}},
+	}
+	cfg.SetDefaults()
+	return newTestControllerWithConfig(ctx, t, cfg, nodes...)
+}
+
+func newTestControllerWithConfig(ctx context.Context, t *testing.T, cfg *config.Configuration, nodes ...*corev1.Node) (*Controller, *fake.Clientset) {
+	t.Helper()
+
+	objs := make([]runtime.Object, 0, len(nodes))
+	for _, n := range nodes {
+		objs = append(objs, n)
+	}
+	clientset := fake.NewSimpleClientset(objs...)
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+
+	c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	informerFactory.Start(ctx.Done())
+	if err := c.Prepare(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c, clientset
+}
+
+func TestPrepareMirrorsExistingCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, _ := newTestController(ctx, t, newTestNode("node-1", "10.244.0.0/24"))
+
+	if !c.isAllocated("10.244.0.0/24") {
+		t.Error("expected existing CIDR to be reserved on standby")
+	}
+}
+
+func TestStandbyDoesNotWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t, newTestNode("node-1", ""))
+
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if node.Spec.PodCIDR != "" {
+		t.Errorf("expected standby not to allocate, got %s", node.Spec.PodCIDR)
+	}
+}
+
+func TestStandbyTracksDeletes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t, newTestNode("node-1", "10.244.3.0/24"))
+
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := waitFor(func() bool { return !c.isAllocated("10.244.3.0/24") }); err != nil {
+		t.Error("expected CIDR of deleted node to be released on standby")
+	}
+}
+
+func TestLeaderAllocates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t, newTestNode("node-1", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if node.Spec.PodCIDR != "10.244.0.0/24" {
+		t.Errorf("expected 10.244.0.0/24, got %q", node.Spec.PodCIDR)
+	}
+}
+
+// hideNodeFromCache makes the API server list a node with a block that the
+// informer cache of c has not seen, as when the previous leader or shard
+// owner wrote it just before handing over
+func hideNodeFromCache(clientset *fake.Clientset, node *corev1.Node, failures int) {
+	clientset.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failures > 0 {
+			failures--
+			return true, nil, fmt.Errorf("injected error")
+		}
+		return true, &corev1.NodeList{Items: []corev1.Node{*node}}, nil
+	})
+}
+
+func TestLeaderCatchesUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t)
+	hideNodeFromCache(clientset, newTestNode("node-0", "10.244.0.0/24"), 1)
+
+	// Leading waits for a list of the nodes to succeed
+	c.SetLeading(true)
+	if c.IsLeading() {
+		t.Fatal("expected leadership to wait for the allocator to catch up")
+	}
+	if err := waitFor(c.IsLeading); err != nil {
+		t.Fatal("expected leadership once the nodes could be listed")
+	}
+	if !c.isAllocated("10.244.0.0/24") {
+		t.Error("expected the block written by the previous leader to be reserved")
+	}
+
+	// Losing leadership meanwhile cancels a pending catch-up
+	c.SetLeading(false)
+	hideNodeFromCache(clientset, newTestNode("node-0", "10.244.0.0/24"), 1)
+	c.SetLeading(true)
+	c.SetLeading(false)
+	time.Sleep(1500 * time.Millisecond)
+	if c.IsLeading() {
+		t.Error("expected a superseded catch-up not to take leadership")
+	}
+}
+
+func TestShardOwnerCatchesUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newShardedTestController(ctx, t, 2)
+	c.SetLeading(true)
+	hideNodeFromCache(clientset, newTestNode("node-0", "10.244.0.0/24"), 1)
+
+	s := c.getPools()[0].shards[0]
+	owned := func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.owned
+	}
+	c.SetShardOwned(s.name, true)
+	if owned() {
+		t.Fatal("expected ownership to wait for the allocator to catch up")
+	}
+	if err := waitFor(owned); err != nil {
+		t.Fatal("expected ownership once the nodes could be listed")
+	}
+	if !c.isAllocated("10.244.0.0/24") {
+		t.Error("expected the block written by the previous owner to be reserved")
+	}
+}
+
+func TestShardOwnership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newShardedTestController(ctx, t, 2, newTestNode("node-a", ""), newTestNode("node-b", ""))
+	c.SetLeading(true)
+	if len(c.Shards()) != 2 {
+		t.Fatalf("expected 2 shards, got %v", c.Shards())
+	}
+
+	owned := c.pools[0].shardFor(newTestNode("node-a", ""))
+	owned.setOwned(true)
+
+	for _, name := range []string{"node-a", "node-b"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for _, name := range []string{"node-a", "node-b"} {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		s := c.pools[0].shardFor(node)
+		switch {
+		case s == owned && !s.allocator.IsAllocated(node.Spec.PodCIDR):
+			t.Errorf("expected %s to get a CIDR from owned shard %s, got %q", name, s.name, node.Spec.PodCIDR)
+		case s != owned && node.Spec.PodCIDR != "":
+			t.Errorf("expected %s in unowned shard %s to be skipped, got %s", name, s.name, node.Spec.PodCIDR)
+		}
+	}
+}
+
+func TestShardOwnerReportsAllocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tainted := func(name, podCIDR string) *corev1.Node {
+		node := newTestNode(name, podCIDR)
+		node.Spec.Taints = []corev1.Taint{unallocatedTaint}
+		return node
+	}
+	c, clientset := newShardedTestController(ctx, t, 2, tainted("node-a", "10.244.0.0/24"), tainted("node-b", "10.244.128.0/24"))
+
+	// The owner of a shard reports the nodes of its shard, without leading
+	owned := c.pools[0].shardFor(newTestNode("node-a", ""))
+	if c.pools[0].shardFor(newTestNode("node-b", "")) == owned {
+		t.Fatal("expected the nodes to be in different shards")
+	}
+	owned.setOwned(true)
+	for _, name := range []string{"node-a", "node-b"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for _, name := range []string{"node-a", "node-b"} {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		reported := !taint.HasTaint(node.Spec.Taints, unallocatedTaint)
+		if s := c.pools[0].shardFor(node); reported != (s == owned) {
+			t.Errorf("expected %s in shard %s to be reported only by its owner, got reported=%v", name, s.name, reported)
+		}
+	}
+}
+
+func TestPoolSelection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{
+			{
+				Name:        "edge",
+				ClusterCIDR: "10.245.0.0/16",
+				NodeSelector: []selector.Expression{
+					{Key: "node-type", Operator: "In", Values: []string{"edge"}},
+				},
+			},
+			{Name: "default", ClusterCIDR: "10.244.0.0/16"},
+		},
+	}
+	cfg.SetDefaults()
+
+	edge := newTestNode("edge-1", "")
+	edge.Labels = map[string]string{"node-type": "edge"}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, edge, newTestNode("node-1", ""))
+	c.SetLeading(true)
+	for _, name := range c.Shards() {
+		c.SetShardOwned(name, true)
+	}
+
+	for _, name := range []string{"edge-1", "node-1"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expected := map[string]string{"edge-1": "10.245.0.0/24", "node-1": "10.244.0.0/24"}
+	for name, want := range expected {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if node.Spec.PodCIDR != want {
+			t.Errorf("expected %s to get %s, got %q", name, want, node.Spec.PodCIDR)
+		}
+	}
+}
+
+func TestMaskSizePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:        "default",
+			ClusterCIDR: "10.244.0.0/16",
+			MaskSizePolicy: &config.MaskSizePolicy{
+				MinNodeCIDRMaskSize: 23,
+				MaxNodeCIDRMaskSize: 26,
+				InstanceTypes:       map[string]int{"edge.small": 26},
+			},
+		}},
+	}
+	cfg.SetDefaults()
+
+	edge := newTestNode("edge-1", "")
+	edge.Labels = map[string]string{masksize.InstanceTypeLabel: "edge.small"}
+	metal := newTestNode("metal-1", "")
+	metal.Annotations = map[string]string{masksize.Key: "23"}
+	invalid := newTestNode("invalid-1", "")
+	invalid.Annotations = map[string]string{masksize.Key: "16"}
+
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, edge, metal, invalid)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	for _, name := range []string{"edge-1", "metal-1", "invalid-1"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expected := map[string]string{"edge-1": "10.244.0.0/26", "metal-1": "10.244.2.0/23", "invalid-1": ""}
+	for name, want := range expected {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if node.Spec.PodCIDR != want {
+			t.Errorf("expected %s to get %q, got %q", name, want, node.Spec.PodCIDR)
+		}
+	}
+}
+
+func TestExtraCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:        "default",
+			ClusterCIDR: "10.244.0.0/16",
+			ExtraCIDRs:  &config.ExtraCIDRs{MaxPerNode: 3},
+		}},
+	}
+	cfg.SetDefaults()
+
+	node := newTestNode("node-1", "10.244.0.0/24")
+	node.Annotations = map[string]string{PodCIDRCountAnnotation: "5"}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	// One block is added per sync, up to the pool's maximum
+	for i := 0; i < 3; i++ {
+		updated, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		if err := waitFor(func() bool {
+			cached, err := c.nodeLister.Get("node-1")
+			return err == nil && cached.Annotations[ExtraPodCIDRsAnnotation] == updated.Annotations[ExtraPodCIDRsAnnotation]
+		}); err != nil {
+			t.Fatal("timed out waiting for informer")
+		}
+		if err := c.syncAllocation(ctx, "node-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	updated, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if got := updated.Annotations[ExtraPodCIDRsAnnotation]; got != "10.244.1.0/24,10.244.2.0/24" {
+		t.Fatalf("expected two extra blocks, got %q", got)
+	}
+
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return !c.isAllocated("10.244.2.0/24") }); err != nil {
+		t.Error("expected extra blocks to be released on delete")
+	}
+	if c.isAllocated("10.244.0.0/24") || c.isAllocated("10.244.1.0/24") {
+		t.Error("expected every block of the node to be released")
+	}
+}
+
+func TestExtraCIDRsReleasedWhenDropped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:        "default",
+			ClusterCIDR: "10.244.0.0/16",
+			ExtraCIDRs:  &config.ExtraCIDRs{MaxPerNode: 3},
+		}},
+	}
+	cfg.SetDefaults()
+
+	node := newTestNode("node-1", "10.244.0.0/24")
+	node.Annotations = map[string]string{ExtraPodCIDRsAnnotation: "10.244.1.0/24,10.244.2.0/24"}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	if !c.isAllocated("10.244.2.0/24") {
+		t.Fatal("expected the extra blocks to be reserved")
+	}
+
+	node.Annotations[ExtraPodCIDRsAnnotation] = "10.244.1.0/24"
+	if _, err := clientset.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return !c.isAllocated("10.244.2.0/24") }); err != nil {
+		t.Error("expected the dropped block to be released")
+	}
+	if !c.isAllocated("10.244.0.0/24") || !c.isAllocated("10.244.1.0/24") {
+		t.Error("expected the blocks the node still holds to stay reserved")
+	}
+}
+
+func TestExtraCIDRsFromPods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:             "default",
+			ClusterCIDR:      "10.244.0.0/16",
+			NodeCIDRMaskSize: 29,
+			ExtraCIDRs:       &config.ExtraCIDRs{MaxPerNode: 2, PodUtilizationThreshold: 50},
+		}},
+	}
+	cfg.SetDefaults()
+
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, newTestNode("node-1", "10.244.0.0/29"))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	// 4 pods fill half of the /29; host network pods do not count
+	for i, hostNetwork := range []bool{false, false, false, true, false} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i), Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: "node-1", HostNetwork: hostNetwork},
+		}
+		if _, err := clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := waitFor(func() bool { _, ok, _ := c.podIndexer.GetByKey("default/" + pod.Name); return ok }); err != nil {
+			t.Fatal("timed out waiting for informer")
+		}
+
+		if err := c.syncAllocation(ctx, "node-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		extra := node.Annotations[ExtraPodCIDRsAnnotation]
+		if i < 4 && extra != "" {
+			t.Fatalf("expected no extra block with %d pods, got %q", i+1, extra)
+		}
+		if i == 4 && extra != "10.244.0.8/29" {
+			t.Errorf("expected an extra block once half full, got %q", extra)
+		}
+	}
+}
+
+func TestAllocationFailureSignals(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools:      []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/23"}},
+		NodeStatus: config.NodeStatus{TaintUnallocated: true, SetNetworkAvailable: true},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", "10.244.0.0/24"), newTestNode("node-2", "10.244.1.0/24"), newTestNode("node-3", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	if err := c.syncAllocation(ctx, "node-3"); err == nil {
+		t.Fatal("expected pool to be exhausted")
+	}
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-3", metav1.GetOptions{})
+	cond := findCondition(node.Status.Conditions, ConditionPodCIDRAllocated)
+	if cond == nil || cond.Status != corev1.ConditionFalse || cond.Reason != ReasonCIDRExhausted {
+		t.Fatalf("expected PodCIDRAllocated=False with reason %s, got %+v", ReasonCIDRExhausted, cond)
+	}
+	if len(node.Spec.Taints) != 1 || node.Spec.Taints[0].Key != UnallocatedTaintKey {
+		t.Fatalf("expected unallocated taint, got %v", node.Spec.Taints)
+	}
+
+	// Freeing a block lets the node allocate, which clears both signals
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		cached, err := c.nodeLister.Get("node-3")
+		return !c.isAllocated("10.244.0.0/24") && err == nil && len(cached.Status.Conditions) > 0
+	}); err != nil {
+		t.Fatal("timed out waiting for informer")
+	}
+	if err := c.syncAllocation(ctx, "node-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		cached, err := c.nodeLister.Get("node-3")
+		return err == nil && cached.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("timed out waiting for informer")
+	}
+	if err := c.syncAllocation(ctx, "node-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node, _ = clientset.CoreV1().Nodes().Get(ctx, "node-3", metav1.GetOptions{})
+	if node.Spec.PodCIDR != "10.244.0.0/24" || len(node.Spec.Taints) != 0 {
+		t.Errorf("expected CIDR without taint, got %q %v", node.Spec.PodCIDR, node.Spec.Taints)
+	}
+	if cond := findCondition(node.Status.Conditions, ConditionPodCIDRAllocated); cond == nil || cond.Status != corev1.ConditionTrue {
+		t.Errorf("expected PodCIDRAllocated=True, got %+v", cond)
+	}
+	if cond := findCondition(node.Status.Conditions, corev1.NodeNetworkUnavailable); cond == nil || cond.Status != corev1.ConditionFalse {
+		t.Errorf("expected NetworkUnavailable=False, got %+v", cond)
+	}
+}
+
+func TestPendingNodesWakeOnRelease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/23"}},
+	}
+	cfg.SetDefaults()
+
+	now := time.Now()
+	newer := newTestNode("node-a", "")
+	newer.CreationTimestamp = metav1.NewTime(now)
+	older := newTestNode("node-b", "")
+	older.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", "10.244.0.0/24"), newTestNode("node-2", "10.244.1.0/24"), newer, older)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	if err := waitFor(func() bool { return c.pending.len() == 2 }); err != nil {
+		t.Fatalf("expected both nodes to be parked, got %d", c.pending.len())
+	}
+	if n := c.allocation.queue.NumRequeues("node-a"); n != 0 {
+		t.Errorf("expected parked node not to be rate limited, got %d requeues", n)
+	}
+
+	// The released block goes to the oldest pending node
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-b", metav1.GetOptions{})
+		return node.Spec.PodCIDR == "10.244.0.0/24"
+	}); err != nil {
+		t.Fatal("expected the oldest pending node to get the released CIDR")
+	}
+	if err := waitFor(func() bool { return c.pending.len() == 1 }); err != nil {
+		t.Errorf("expected the other node to stay parked, got %d", c.pending.len())
+	}
+}
+
+func TestCapacityAlerts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payloads := make(chan alert.Payload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p alert.Payload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer server.Close()
+
+	cfg := &config.Configuration{
+		Pools:        []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/22", UtilizationThresholds: []int{50, 75}}},
+		AlertWebhook: &config.AlertWebhook{URL: server.URL},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", "10.244.0.0/24"), newTestNode("node-2", "10.244.1.0/24"), newTestNode("node-3", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	c.checkCapacity(ctx)
+	select {
+	case p := <-payloads:
+		if p.Pool != "default" || p.Threshold != 50 || p.Used != 2 || p.Free != 2 {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+
+	// A threshold alerts once
+	c.checkCapacity(ctx)
+
+	if err := c.syncAllocation(ctx, "node-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return c.pools[0].capacity.allocationsSince(time.Now()) == 1 }); err != nil {
+		t.Fatal("expected the allocation to be counted")
+	}
+	c.checkCapacity(ctx)
+	select {
+	case p := <-payloads:
+		if p.Threshold != 75 || p.AllocationsLastDay != 1 {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+
+	if err := waitFor(func() bool {
+		events, _ := clientset.CoreV1().Events("kube-system").List(ctx, metav1.ListOptions{})
+		return len(events.Items) == 2
+	}); err != nil {
+		t.Error("expected a Warning Event per crossed threshold")
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+	if err != nil || cm.Annotations[UtilizationAlertAnnotationPrefix+"default"] != "75" {
+		t.Errorf("expected the alerted threshold to be recorded in the state ConfigMap, got %v", err)
+	}
+}
+
+func TestCapacityAlertsOncePerLeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payloads := make(chan alert.Payload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p alert.Payload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer server.Close()
+
+	cfg := &config.Configuration{
+		Pools:        []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/22", UtilizationThresholds: []int{50, 75}}},
+		AlertWebhook: &config.AlertWebhook{URL: server.URL},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", "10.244.0.0/24"), newTestNode("node-2", "10.244.1.0/24"))
+
+	// A previous leader alerted for 50%
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:        "podcidr-controller",
+		Namespace:   "kube-system",
+		Annotations: map[string]string{UtilizationAlertAnnotationPrefix + "default": "50"},
+	}}
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { _, recorded := c.pools[0].capacity.level(); return recorded == 50 }); err != nil {
+		t.Fatal("expected the alerted threshold to be read from the state ConfigMap")
+	}
+
+	c.SetLeading(true)
+	c.checkCapacity(ctx)
+	select {
+	case p := <-payloads:
+		t.Errorf("expected no second alert for the same threshold, got %+v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+	events, _ := clientset.CoreV1().Events("kube-system").List(ctx, metav1.ListOptions{})
+	if len(events.Items) != 0 {
+		t.Errorf("expected no Event for the threshold a previous leader alerted for, got %d", len(events.Items))
+	}
+
+	// Freeing blocks re-arms the threshold
+	for _, name := range []string{"node-1", "node-2"} {
+		if err := clientset.CoreV1().Nodes().Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := waitFor(func() bool { used, _ := c.pools[0].usage(); return used == 0 }); err != nil {
+		t.Fatal("expected the blocks to be released")
+	}
+	c.checkCapacity(ctx)
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v, ok := cm.Annotations[UtilizationAlertAnnotationPrefix+"default"]; ok {
+		t.Errorf("expected the re-armed threshold to be removed from the state ConfigMap, got %q", v)
+	}
+}
+
+func TestCapacityAlertsWithoutAllocatableBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:                  "default",
+			ClusterCIDR:           "10.244.0.0/22",
+			ExcludeCIDRs:          []string{"10.244.0.0/22"},
+			UtilizationThresholds: []int{90},
+		}},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg)
+	c.SetLeading(true)
+
+	c.checkCapacity(ctx)
+	if err := waitFor(func() bool {
+		events, _ := clientset.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+		for _, e := range events.Items {
+			if e.Reason == ReasonPoolUtilizationHigh && strings.Contains(e.Message, "100.0% used (0 of 0 blocks") {
+				return true
+			}
+		}
+		return false
+	}); err != nil {
+		t.Error("expected a pool without allocatable blocks to alert as full")
+	}
+}
+
+func TestAllocationCircuit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:            "default",
+			ClusterCIDR:     "10.244.0.0/16",
+			AllocationLimit: &config.AllocationLimit{MaxAllocations: 2, Window: metav1.Duration{Duration: time.Hour}},
+		}},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", ""), newTestNode("node-2", ""), newTestNode("node-3", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	allocated := func() int {
+		count := 0
+		nodes, _ := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		for _, n := range nodes.Items {
+			if n.Spec.PodCIDR != "" {
+				count++
+			}
+		}
+		return count
+	}
+
+	key := CircuitAnnotationPrefix + "pool.default"
+	if err := waitFor(func() bool {
+		cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+		return err == nil && cm.Annotations[key] != "" && c.pending.len() == 1
+	}); err != nil {
+		t.Fatalf("expected the circuit to open and hold a node, pending %d", c.pending.len())
+	}
+	if n := allocated(); n != 2 {
+		t.Fatalf("expected 2 allocations before the circuit opened, got %d", n)
+	}
+
+	// Acknowledging the circuit resumes allocation
+	cm, _ := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+	delete(cm.Annotations, key)
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return allocated() == 3 }); err != nil {
+		t.Fatal("expected the held node to be allocated after acknowledgement")
+	}
+
+	// The acknowledgement is kept for replicas started later
+	var reset time.Time
+	if err := waitFor(func() bool {
+		cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		reset, err = time.Parse(time.RFC3339, cm.Annotations[CircuitResetAnnotationPrefix+"pool.default"])
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the acknowledgement to be recorded in the state ConfigMap")
+	}
+	restarted := newCircuitState()
+	restarted.observe(map[string]string{CircuitResetAnnotationPrefix + "pool.default": reset.Format(time.RFC3339)}, time.Now())
+	if cutoff := restarted.cutoff("pool.default", time.Now(), time.Hour); !cutoff.Equal(reset) {
+		t.Errorf("expected a restarted replica to count allocations after %s, got %s", reset, cutoff)
+	}
+}
+
+func TestAllocationCircuitExtraCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:            "default",
+			ClusterCIDR:     "10.244.0.0/16",
+			ExtraCIDRs:      &config.ExtraCIDRs{MaxPerNode: 5},
+			AllocationLimit: &config.AllocationLimit{MaxAllocations: 2, Window: metav1.Duration{Duration: time.Hour}},
+		}},
+	}
+	cfg.SetDefaults()
+	node := newTestNode("node-1", "10.244.0.0/24")
+	node.Annotations = map[string]string{PodCIDRCountAnnotation: "5"}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	var err error
+	for i := 0; i < 4 && err == nil; i++ {
+		updated, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		if waitErr := waitFor(func() bool {
+			cached, err := c.nodeLister.Get("node-1")
+			return err == nil && cached.Annotations[ExtraPodCIDRsAnnotation] == updated.Annotations[ExtraPodCIDRsAnnotation]
+		}); waitErr != nil {
+			t.Fatal("timed out waiting for informer")
+		}
+		err = c.syncAllocation(ctx, "node-1")
+	}
+	if !stderrors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected extra blocks to open the circuit, got %v", err)
+	}
+
+	updated, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if got := updated.Annotations[ExtraPodCIDRsAnnotation]; got != "10.244.1.0/24,10.244.2.0/24" {
+		t.Errorf("expected two extra blocks before the circuit opened, got %q", got)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "podcidr-controller", metav1.GetOptions{})
+	if err != nil || cm.Annotations[CircuitAnnotationPrefix+"pool.default"] == "" {
+		t.Errorf("expected the circuit to be recorded in the state ConfigMap, got %v", err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		Quotas: []config.Quota{{
+			Name:         "tenant-a",
+			NodeSelector: []selector.Expression{{Key: "tenant", Operator: "In", Values: []string{"a"}}},
+			MaxBlocks:    1,
+		}},
+	}
+	cfg.SetDefaults()
+
+	tenantNode := func(name, podCIDR string) *corev1.Node {
+		node := newTestNode(name, podCIDR)
+		node.Labels = map[string]string{"tenant": "a"}
+		return node
+	}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		tenantNode("node-1", "10.244.0.0/24"), tenantNode("node-2", ""), newTestNode("node-3", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	// Nodes outside the group are not limited
+	if err := waitFor(func() bool {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-3", metav1.GetOptions{})
+		return node.Spec.PodCIDR != "" && c.pending.len() == 1
+	}); err != nil {
+		t.Fatalf("expected node-3 to be allocated and node-2 to wait, pending %d", c.pending.len())
+	}
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-2", metav1.GetOptions{})
+	if node.Spec.PodCIDR != "" {
+		t.Fatalf("expected node-2 to stay unallocated, got %s", node.Spec.PodCIDR)
+	}
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`podcidr_quota_blocks_used{quota="tenant-a"} 1`, `podcidr_quota_blocks_max{quota="tenant-a"} 1`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, rec.Body.String())
+		}
+	}
+
+	// Freeing a block of the group lets the waiting node in
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-2", metav1.GetOptions{})
+		return node.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("expected node-2 to be allocated once its group had room")
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools:        []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		RemoveTaints: []string{"example.com/not-ready"},
+	}
+	cfg.SetDefaults()
+	node := newTestNode("node-1", "")
+	node.Spec.Taints = []corev1.Taint{{Key: "example.com/not-ready", Effect: corev1.TaintEffectNoSchedule}}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg)
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:      "podcidr-controller",
+		Namespace: "kube-system",
+		Annotations: map[string]string{
+			PauseAllocationAnnotation:   "network migration",
+			PauseTaintRemovalAnnotation: "",
+		},
+	}}
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Create(ctx, cm, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return c.allocationPaused.Load() && c.taintRemovalPaused.Load() }); err != nil {
+		t.Fatal("expected both operations to be paused")
+	}
+
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	if err := waitFor(func() bool {
+		_, err := c.nodeLister.Get("node-1")
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the node to reach the cache")
+	}
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.syncTaints(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if got.Spec.PodCIDR != "" || len(got.Spec.Taints) != 1 {
+		t.Fatalf("expected a paused controller not to write, got podCIDR %q and taints %v", got.Spec.PodCIDR, got.Spec.Taints)
+	}
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `podcidr_paused{operation="allocation"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+
+	// Resuming allocation alone leaves the taint in place
+	go func() { _ = c.Run(ctx, 1) }()
+	delete(cm.Annotations, PauseAllocationAnnotation)
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		return got.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("expected allocation to resume")
+	}
+	got, _ = clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if len(got.Spec.Taints) != 1 {
+		t.Errorf("expected taint removal to stay paused, got taints %v", got.Spec.Taints)
+	}
+}
+
+func TestPauseEndsWithStateConfigMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t)
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:        "podcidr-controller",
+		Namespace:   "kube-system",
+		Annotations: map[string]string{PauseAllocationAnnotation: "network migration"},
+	}}
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(c.allocationPaused.Load); err != nil {
+		t.Fatal("expected allocation to be paused")
+	}
+
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, newTestNode("node-1", ""), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	// Deleting the ConfigMap removes the pause with it
+	if err := clientset.CoreV1().ConfigMaps("kube-system").Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		return got.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("expected allocation to resume once the state ConfigMap was deleted")
+	}
+}
+
+func TestTaintRemoverOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Controllers:  []string{config.TaintRemover},
+		RemoveTaints: []string{"example.com/not-ready"},
+	}
+	cfg.SetDefaults()
+	node := newTestNode("node-1", "")
+	node.Spec.Taints = []corev1.Taint{{Key: "example.com/not-ready", Effect: corev1.TaintEffectNoSchedule}}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	if c.allocation != nil {
+		t.Fatal("expected the CIDR allocator to be disabled")
+	}
+	c.SetLeading(true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	if err := waitFor(func() bool {
+		got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		return len(got.Spec.Taints) == 0
+	}); err != nil {
+		t.Fatal("expected the taint to be removed")
+	}
+	got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if got.Spec.PodCIDR != "" {
+		t.Errorf("expected no CIDR to be allocated, got %s", got.Spec.PodCIDR)
+	}
+}
+
+func TestTaintRemovalErrorDoesNotBlockAllocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools:        []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		RemoveTaints: []string{"example.com/not-ready"},
+	}
+	cfg.SetDefaults()
+	node := newTestNode("node-1", "")
+	node.Spec.Taints = []corev1.Taint{{Key: "example.com/not-ready", Effect: corev1.TaintEffectNoSchedule}}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	clientset.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("injected error")
+	})
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	go func() { _ = c.Run(ctx, 1) }()
+
+	if err := waitFor(func() bool { return c.syncs.Value(config.CIDRAllocator, "success") > 0 }); err != nil {
+		t.Fatal("expected the allocator to sync the node")
+	}
+	if err := waitFor(func() bool { return c.syncs.Value(config.TaintRemover, "error") > 0 }); err != nil {
+		t.Fatal("expected the taint remover to fail")
+	}
+	if err := waitFor(func() bool {
+		got, _ := c.nodeLister.Get("node-1")
+		return got.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("expected the node to get a CIDR despite the taint removal error")
+	}
+}
+
+func TestAssignCIDR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, clientset := newTestController(ctx, t)
+
+	// Standbys admit nodes unchanged
+	if cidrBlock, err := c.AssignCIDR(ctx, newTestNode("node-1", "")); err != nil || cidrBlock != "" {
+		t.Fatalf("expected standby not to assign, got %q, %v", cidrBlock, err)
+	}
+
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	cidrBlock, err := c.AssignCIDR(ctx, newTestNode("node-1", ""))
+	if err != nil || cidrBlock != "10.244.0.0/24" {
+		t.Fatalf("expected 10.244.0.0/24, got %q, %v", cidrBlock, err)
+	}
+
+	// The admitted node shows up with its block
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, newTestNode("node-1", cidrBlock), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		c.assignments.mu.Lock()
+		defer c.assignments.mu.Unlock()
+		return len(c.assignments.byBlock) == 0
+	}); err != nil {
+		t.Fatal("expected the admission to be settled once the node is observed")
+	}
+
+	// A node dropped after admission gives its block back on the sweep
+	lost, err := c.AssignCIDR(ctx, newTestNode("node-2", ""))
+	if err != nil || lost != "10.244.1.0/24" {
+		t.Fatalf("expected 10.244.1.0/24, got %q, %v", lost, err)
+	}
+	c.sweepAssignments(ctx)
+	if !c.isAllocated(lost) {
+		t.Fatal("expected a recent admission to be kept")
+	}
+	backdateAssignment(c, lost, time.Now().Add(-2*assignmentTimeout))
+	c.sweepAssignments(ctx)
+	if c.isAllocated(lost) || !c.isAllocated(cidrBlock) {
+		t.Error("expected only the block of the missing node to be released")
+	}
+}
+
+// backdateAssignment moves the assignment of a block back in time
+func backdateAssignment(c *Controller, cidrBlock string, at time.Time) {
+	c.assignments.mu.Lock()
+	defer c.assignments.mu.Unlock()
+	b := c.assignments.byBlock[cidrBlock]
+	b.at = at
+	c.assignments.byBlock[cidrBlock] = b
+}
+
+func TestAssignCIDRSweepReleasesQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quota := config.Quota{
+		Name:         "tenant-a",
+		NodeSelector: []selector.Expression{{Key: "tenant", Operator: "In", Values: []string{"a"}}},
+		MaxBlocks:    1,
+	}
+	cfg := &config.Configuration{
+		Pools:  []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		Quotas: []config.Quota{quota},
+	}
+	cfg.SetDefaults()
+	tenantNode := func(name string) *corev1.Node {
+		node := newTestNode(name, "")
+		node.Labels = map[string]string{"tenant": "a"}
+		return node
+	}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	cidrBlock, err := c.AssignCIDR(ctx, tenantNode("node-1"))
+	if err != nil || cidrBlock == "" {
+		t.Fatalf("expected a block, got %q, %v", cidrBlock, err)
+	}
+
+	// The node is created, but the patch carrying its block was rejected
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, tenantNode("node-1"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		_, err := c.nodeLister.Get("node-1")
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the node to be observed")
+	}
+	if used, _ := c.quotaUsage(quota); used != 1 {
+		t.Fatalf("expected the assigned block to count against the quota, got %d", used)
+	}
+
+	backdateAssignment(c, cidrBlock, time.Now().Add(-2*assignmentTimeout))
+	c.sweepAssignments(ctx)
+	if c.isAllocated(cidrBlock) {
+		t.Fatal("expected the block the node never got to be released")
+	}
+	if used, _ := c.quotaUsage(quota); used != 0 {
+		t.Errorf("expected the released block to leave the quota, got %d", used)
+	}
+	if cidrBlock, err := c.AssignCIDR(ctx, tenantNode("node-2")); err != nil || cidrBlock == "" {
+		t.Errorf("expected the quota to admit another node, got %q, %v", cidrBlock, err)
+	}
+}
+
+func TestValidatePodCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:         "default",
+			ClusterCIDR:  "10.244.0.0/16",
+			ExcludeCIDRs: []string{"10.244.255.0/24"},
+		}},
+		Admission: config.Admission{BypassServiceAccounts: []string{"kube-system/node-tool"}},
+	}
+	cfg.SetDefaults()
+	c, _ := newTestControllerWithConfig(ctx, t, cfg, newTestNode("node-1", "10.244.0.0/24"))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	assigned, err := c.AssignCIDR(ctx, newTestNode("node-2", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	kubelet := authenticationv1.UserInfo{Username: "system:node:node-3"}
+	tests := []struct {
+		user    authenticationv1.UserInfo
+		node    string
+		cidr    string
+		wantErr string
+	}{
+		{user: kubelet, node: "node-3", cidr: "10.244.5.0/24"},
+		{user: kubelet, node: "node-3", cidr: "10.245.0.0/24", wantErr: "not a block of any pool"},
+		{user: kubelet, node: "node-3", cidr: "10.244.255.0/24", wantErr: "excluded"},
+		{user: kubelet, node: "node-3", cidr: "10.244.0.0/23", wantErr: "node node-1"},
+		{user: kubelet, node: "node-3", cidr: assigned, wantErr: "being assigned to another node"},
+		{user: kubelet, node: "node-2", cidr: assigned},
+		{user: authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:node-tool"}, node: "node-3", cidr: "10.244.0.0/24"},
+	}
+	for _, tt := range tests {
+		err := c.ValidatePodCIDRs(ctx, tt.user, newTestNode(tt.node, tt.cidr), []string{tt.cidr})
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s on %s: unexpected error: %v", tt.cidr, tt.node, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s on %s: expected error containing %q, got %v", tt.cidr, tt.node, tt.wantErr, err)
+		}
+	}
+}
+
+func TestAdmissionReachesLeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	controllerPod := func(name string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system", Labels: labels}}
+	}
+	// controller-b still carries the label from an earlier run
+	clientset := fake.NewSimpleClientset(
+		controllerPod("controller-a", map[string]string{"name": "podcidr-controller"}),
+		controllerPod("controller-b", map[string]string{"name": "podcidr-controller", LeaderLabel: "true"}))
+	cfg := &config.Configuration{Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}}}
+	cfg.SetDefaults()
+
+	replicas := map[string]*Controller{}
+	for _, name := range []string{"controller-a", "controller-b"} {
+		informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+		c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		informerFactory.Start(ctx.Done())
+		if err := c.Prepare(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := c.SetPod(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		replicas[name] = c
+	}
+
+	// The Service of the mutating webhook selects the labelled pods
+	admitting := func() []string {
+		pods, _ := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{LabelSelector: LeaderLabel + "=true"})
+		var names []string
+		for _, pod := range pods.Items {
+			names = append(names, pod.Name)
+		}
+		return names
+	}
+	if got := admitting(); len(got) != 0 {
+		t.Fatalf("expected no pod to receive admission before leading, got %v", got)
+	}
+
+	replicas["controller-a"].SetLeading(true)
+	replicas["controller-a"].SetShardOwned("default-0", true)
+	got := admitting()
+	if fmt.Sprint(got) != "[controller-a]" {
+		t.Fatalf("expected only the leader to receive admission, got %v", got)
+	}
+	if cidrBlock, err := replicas[got[0]].AssignCIDR(ctx, newTestNode("node-1", "")); err != nil || cidrBlock == "" {
+		t.Errorf("expected the replica receiving admission to assign, got %q, %v", cidrBlock, err)
+	}
+	if cidrBlock, _ := replicas["controller-b"].AssignCIDR(ctx, newTestNode("node-2", "")); cidrBlock != "" {
+		t.Errorf("expected the standby not to assign, got %q", cidrBlock)
+	}
+
+	// Admission follows a failover
+	replicas["controller-a"].SetShardOwned("default-0", false)
+	replicas["controller-a"].SetLeading(false)
+	replicas["controller-b"].SetLeading(true)
+	if got := admitting(); fmt.Sprint(got) != "[controller-b]" {
+		t.Errorf("expected admission to move to the new leader, got %v", got)
+	}
+}
+
+func TestValidateExtraPodCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:        "default",
+			ClusterCIDR: "10.244.0.0/16",
+			ExtraCIDRs:  &config.ExtraCIDRs{MaxPerNode: 3},
+		}},
+	}
+	cfg.SetDefaults()
+	node := newTestNode("node-1", "10.244.0.0/24")
+	node.Annotations = map[string]string{ExtraPodCIDRsAnnotation: "10.244.1.0/24", PodCIDRCountAnnotation: "3"}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, node)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	// Another node cannot claim an extra block of node-1
+	other := newTestNode("node-2", "10.244.2.0/24")
+	other.Annotations = map[string]string{ExtraPodCIDRsAnnotation: "10.244.1.0/24"}
+	err := c.ValidatePodCIDRs(ctx, authenticationv1.UserInfo{}, other, c.ExtraPodCIDRs(other))
+	if err == nil || !strings.Contains(err.Error(), "node node-1") {
+		t.Errorf("expected the extra block of another node to be refused, got %v", err)
+	}
+
+	// The controller's own extra blocks pass the webhook
+	clientset.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updated := action.(k8stesting.UpdateAction).GetObject().(*corev1.Node)
+		var added []string
+		for _, cidrBlock := range c.ExtraPodCIDRs(updated) {
+			if !slices.Contains(nodeCIDRs(node), cidrBlock) {
+				added = append(added, cidrBlock)
+			}
+		}
+		if err := c.ValidatePodCIDRs(ctx, authenticationv1.UserInfo{}, updated, added); err != nil {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("expected the controller's extra block to be admitted, got %v", err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, _ := newTestController(ctx, t)
+
+	cfg := *c.config
+	cfg.Pools = []config.Pool{cfg.Pools[0]}
+	cfg.Pools[0].NodeSelector = []selector.Expression{{Key: "node-type", Operator: "Exists"}}
+	cfg.RemoveTaints = []string{"example.com/not-ready"}
+	if err := c.ApplyConfig(&cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.poolFor(newTestNode("node-1", "")) != nil {
+		t.Error("expected reloaded selector to exclude unlabeled node")
+	}
+	if c.taintRemover.Load() == nil {
+		t.Error("expected reloaded taint rules to be applied")
+	}
+
+	unsafe := cfg
+	unsafe.Pools = []config.Pool{cfg.Pools[0]}
+	unsafe.Pools[0].ClusterCIDR = "10.245.0.0/16"
+	if err := c.ApplyConfig(&unsafe); err == nil {
+		t.Error("expected cluster CIDR change to be refused")
+	}
+}
+
+func TestApplyConfigExpand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/23"}},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNode("node-1", "10.244.0.0/24"), newTestNode("node-2", "10.244.1.0/24"), newTestNode("node-3", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	if err := c.syncAllocation(ctx, "node-3"); err == nil {
+		t.Fatal("expected pool to be exhausted")
+	}
+
+	expanded := *cfg
+	expanded.Pools = []config.Pool{cfg.Pools[0]}
+	expanded.Pools[0].ClusterCIDR = "10.244.0.0/22"
+	if err := c.ApplyConfig(&expanded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := c.syncAllocation(ctx, "node-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	node, _ := clientset.CoreV1().Nodes().Get(ctx, "node-3", metav1.GetOptions{})
+	if node.Spec.PodCIDR != "10.244.2.0/24" {
+		t.Errorf("expected 10.244.2.0/24 from the expanded range, got %q", node.Spec.PodCIDR)
+	}
+
+	shrunk := expanded
+	shrunk.Pools = []config.Pool{expanded.Pools[0]}
+	shrunk.Pools[0].ClusterCIDR = "10.244.0.0/23"
+	if err := c.ApplyConfig(&shrunk); err == nil {
+		t.Error("expected shrinking the cluster CIDR to be refused")
+	}
+}
+
+func TestApplyConfigIsAtomic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{
+			{Name: "default", ClusterCIDR: "10.244.0.0/23"},
+			{Name: "edge", ClusterCIDR: "10.245.0.0/16"},
+		},
+	}
+	cfg.SetDefaults()
+	c, _ := newTestControllerWithConfig(ctx, t, cfg)
+
+	// The second pool fails after the first one could have been expanded
+	broken := *cfg
+	broken.Pools = slices.Clone(cfg.Pools)
+	broken.Pools[0].ClusterCIDR = "10.244.0.0/22"
+	broken.Pools[1].ExcludeCIDRs = []string{"fd00::/64"}
+	if err := c.ApplyConfig(&broken); err == nil {
+		t.Fatal("expected an invalid exclusion to be refused")
+	}
+	if got := c.getPools()[0].shards[0].allocator.ClusterCIDR(); got != "10.244.0.0/23" {
+		t.Errorf("expected the first pool to keep its range, got %s", got)
+	}
+	if got := c.getPools()[0].settings.Load().ClusterCIDR; got != "10.244.0.0/23" {
+		t.Errorf("expected the first pool to keep its settings, got %s", got)
+	}
+	if c.Config() != cfg {
+		t.Error("expected the configuration to be kept")
+	}
+}
+
+func TestApplyConfigExpandReportsOverlaps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools:             []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/23"}},
+		OverlapProtection: config.OverlapProtectionExclude,
+	}
+	cfg.SetDefaults()
+	c, _ := newTestControllerWithConfig(ctx, t, cfg, newTestNodeWithIP("node-1", "", "10.244.3.7"))
+	c.overlapsMu.Lock()
+	if len(c.overlaps) != 0 {
+		t.Errorf("expected no overlaps before the expansion, got %v", c.overlaps)
+	}
+	c.overlapsMu.Unlock()
+
+	expanded := *cfg
+	expanded.Pools = []config.Pool{cfg.Pools[0]}
+	expanded.Pools[0].ClusterCIDR = "10.244.0.0/22"
+	if err := c.ApplyConfig(&expanded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.overlapsMu.Lock()
+	defer c.overlapsMu.Unlock()
+	if want := "node node-1 10.244.3.7/32 overlaps pool default (10.244.0.0/22)"; !c.overlaps[want] {
+		t.Errorf("expected %q to be reported, got %v", want, c.overlaps)
+	}
+}
+
+func newTestPodCIDRPool(t *testing.T, name, clusterCIDR string, priority int32, nodeSelector ...selector.Expression) *unstructured.Unstructured {
+	t.Helper()
+	u, err := v1alpha1.ToUnstructured(&v1alpha1.PodCIDRPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.Group + "/" + v1alpha1.Version, Kind: "PodCIDRPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Generation: 1},
+		Spec:       v1alpha1.PodCIDRPoolSpec{ClusterCIDR: clusterCIDR, NodeSelector: nodeSelector, Priority: priority},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return u
+}
+
+func TestPodCIDRPools(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	edgeSelector := selector.Expression{Key: "node-type", Operator: "In", Values: []string{"edge"}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.PodCIDRPoolResource: "PodCIDRPoolList"},
+		newTestPodCIDRPool(t, "edge", "10.245.0.0/16", 10, edgeSelector),
+		newTestPodCIDRPool(t, "default", "10.244.0.0/16", 0),
+		// Overlaps default, which comes first by name
+		newTestPodCIDRPool(t, "overlap", "10.244.128.0/17", 0),
+	)
+
+	edge := newTestNode("edge-1", "")
+	edge.Labels = map[string]string{"node-type": "edge"}
+	clientset := fake.NewSimpleClientset(edge, newTestNode("node-1", ""), newTestNode("node-2", "10.244.0.0/24"))
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	poolInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+
+	cfg := &config.Configuration{PoolSource: config.PoolSourcePodCIDRPool}
+	cfg.SetDefaults()
+	c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.WatchPodCIDRPools(dynamicClient, poolInformerFactory)
+	informerFactory.Start(ctx.Done())
+	poolInformerFactory.Start(ctx.Done())
+	if err := c.Prepare(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.SetLeading(true)
+	for _, name := range c.Shards() {
+		c.SetShardOwned(name, true)
+	}
+
+	for _, name := range []string{"edge-1", "node-1"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// node-2 holds the first block of default
+	expected := map[string]string{"edge-1": "10.245.0.0/24", "node-1": "10.244.1.0/24"}
+	for name, want := range expected {
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if node.Spec.PodCIDR != want {
+			t.Errorf("expected %s to get %s, got %q", name, want, node.Spec.PodCIDR)
+		}
+	}
+
+	c.updatePodCIDRPoolStatus(ctx)
+	status := func(name string) v1alpha1.PodCIDRPoolStatus {
+		u, err := dynamicClient.Resource(v1alpha1.PodCIDRPoolResource).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		p, err := v1alpha1.PodCIDRPoolFromUnstructured(u)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return p.Status
+	}
+	if s := status("default"); s.UsedBlocks != 2 || s.TotalBlocks != 256 || s.FreeBlocks != 254 ||
+		!meta.IsStatusConditionTrue(s.Conditions, v1alpha1.ConditionReady) {
+		t.Errorf("unexpected status of default: %+v", s)
+	}
+	if s := status("overlap"); meta.IsStatusConditionTrue(s.Conditions, v1alpha1.ConditionReady) ||
+		!strings.Contains(meta.FindStatusCondition(s.Conditions, v1alpha1.ConditionReady).Message, "overlaps") {
+		t.Errorf("expected the overlapping pool not to be ready, got %+v", s)
+	}
+
+	// A deleted pool stops allocating
+	if err := dynamicClient.Resource(v1alpha1.PodCIDRPoolResource).Delete(ctx, "edge", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return c.poolFor(edge) != nil && c.poolFor(edge).name == "default" }); err != nil {
+		t.Error("expected edge nodes to fall back to the default pool once edge is deleted")
+	}
+}
+
+func newTestRecord(t *testing.T, node, uid, cidrBlock string, releasedAt *metav1.Time) *unstructured.Unstructured {
+	t.Helper()
+	u, err := v1alpha1.ToUnstructured(&v1alpha1.NodeCIDRAllocation{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.Group + "/" + v1alpha1.Version, Kind: "NodeCIDRAllocation"},
+		ObjectMeta: metav1.ObjectMeta{Name: recordName(cidrBlock, uid)},
+		Spec: v1alpha1.NodeCIDRAllocationSpec{
+			NodeName:    node,
+			NodeUID:     types.UID(uid),
+			CIDR:        cidrBlock,
+			AllocatedAt: metav1.NewTime(time.Now().Add(-time.Hour)),
+			ReleasedAt:  releasedAt,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return u
+}
+
+func TestAllocationRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	longAgo := metav1.NewTime(time.Now().Add(-30 * 24 * time.Hour))
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.NodeCIDRAllocationResource: "NodeCIDRAllocationList"},
+		// A node deleted while no replica was running
+		newTestRecord(t, "gone-1", "uid-gone", "10.244.5.0/24", nil),
+		newTestRecord(t, "gone-2", "uid-expired", "10.244.6.0/24", &longAgo),
+	)
+
+	node := newTestNode("node-1", "")
+	node.UID = "uid-1"
+	clientset := fake.NewSimpleClientset(node)
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+
+	cfg := &config.Configuration{
+		Pools:             []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		AllocationRecords: &config.AllocationRecords{},
+	}
+	cfg.SetDefaults()
+	c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.WatchAllocationRecords(dynamicClient, dynamicInformerFactory)
+	informerFactory.Start(ctx.Done())
+	dynamicInformerFactory.Start(ctx.Done())
+	if err := c.Prepare(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !c.pools[0].isAllocated("10.244.5.0/24") {
+		t.Fatal("expected the recorded block to be reserved at startup")
+	}
+	c.SetLeading(true)
+	for _, name := range c.Shards() {
+		c.SetShardOwned(name, true)
+	}
+
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		n, err := c.nodeLister.Get("node-1")
+		return err == nil && n.Spec.PodCIDR != ""
+	}); err != nil {
+		t.Fatal("expected the informer to show the allocated CIDR")
+	}
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records := dynamicClient.Resource(v1alpha1.NodeCIDRAllocationResource)
+	u, err := records.Get(ctx, recordName("10.244.0.0/24", "uid-1"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the allocation to be recorded: %v", err)
+	}
+	record, _ := v1alpha1.NodeCIDRAllocationFromUnstructured(u)
+	if record.Spec.NodeName != "node-1" || record.Spec.Pool != "default" || record.Spec.ReleasedAt != nil ||
+		record.Labels[v1alpha1.NodeLabel] != "node-1" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	// Wait for the informer to show the new record before sweeping
+	if err := waitFor(func() bool {
+		_, err := c.recordLister.Get(record.Name)
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the informer to show the new record")
+	}
+	c.sweepRecords(ctx)
+
+	u, err = records.Get(ctx, recordName("10.244.5.0/24", "uid-gone"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gone, _ := v1alpha1.NodeCIDRAllocationFromUnstructured(u); gone.Spec.ReleasedAt == nil {
+		t.Error("expected the record of the gone node to be released")
+	}
+	if c.pools[0].isAllocated("10.244.5.0/24") {
+		t.Error("expected the block of the gone node to be released")
+	}
+	if _, err := records.Get(ctx, recordName("10.244.6.0/24", "uid-expired"), metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the expired record to be deleted, got %v", err)
+	}
+	if u, _ = records.Get(ctx, record.Name, metav1.GetOptions{}); u != nil {
+		if r, _ := v1alpha1.NodeCIDRAllocationFromUnstructured(u); r.Spec.ReleasedAt != nil {
+			t.Error("expected the record of node-1 to stay unreleased")
+		}
+	}
+}
+
+func newTestClusterCIDR(name, ipv4, ipv6 string, hostBits int32, terms ...corev1.NodeSelectorTerm) *unstructured.Unstructured {
+	spec := map[string]interface{}{"perNodeHostBits": int64(hostBits)}
+	if ipv4 != "" {
+		spec["ipv4"] = ipv4
+	}
+	if ipv6 != "" {
+		spec["ipv6"] = ipv6
+	}
+	if len(terms) > 0 {
+		selector, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(&corev1.NodeSelector{NodeSelectorTerms: terms})
+		spec["nodeSelector"] = selector
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1alpha1",
+		"kind":       "ClusterCIDR",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+}
+
+func TestClusterCIDRs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rack := corev1.NodeSelectorRequirement{Key: "rack", Operator: corev1.NodeSelectorOpIn, Values: []string{"rack1"}}
+	gpu := corev1.NodeSelectorRequirement{Key: "gpu", Operator: corev1.NodeSelectorOpExists}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{clustercidr.Resource: "ClusterCIDRList"},
+		newTestClusterCIDR("default", "10.244.0.0/16", "fd00::/48", 8),
+		newTestClusterCIDR("rack1", "10.245.0.0/16", "", 8,
+			corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{rack}}),
+		newTestClusterCIDR("rack1-gpu", "10.246.0.0/24", "", 4,
+			corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{rack, gpu}}),
+		// Overlaps default, which comes first by name
+		newTestClusterCIDR("overlap", "10.244.128.0/17", "", 8),
+		newTestClusterCIDR("v6", "", "fd01::/48", 16),
+	)
+
+	plain := newTestNode("node-1", "")
+	inRack := newTestNode("rack-1", "")
+	inRack.Labels = map[string]string{"rack": "rack1"}
+	withGPU := newTestNode("gpu-1", "")
+	withGPU.Labels = map[string]string{"rack": "rack1", "gpu": "true"}
+	clientset := fake.NewSimpleClientset(plain, inRack, withGPU)
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+
+	cfg := &config.Configuration{PoolSource: config.PoolSourceClusterCIDR}
+	cfg.SetDefaults()
+	c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.WatchClusterCIDRs(dynamicInformerFactory)
+	informerFactory.Start(ctx.Done())
+	dynamicInformerFactory.Start(ctx.Done())
+	if err := c.Prepare(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.SetLeading(true)
+	for _, name := range c.Shards() {
+		c.SetShardOwned(name, true)
+	}
+
+	if len(c.getPools()) != 3 {
+		t.Fatalf("expected 3 usable ClusterCIDRs, got %d", len(c.getPools()))
+	}
+	for _, name := range []string{"overlap", "v6"} {
+		if c.poolErrors[name] == nil {
+			t.Errorf("expected ClusterCIDR %s to be rejected", name)
+		}
+	}
+
+	// The most specific selector wins
+	expected := map[string]string{"node-1": "10.244.0.0/24", "rack-1": "10.245.0.0/24", "gpu-1": "10.246.0.0/28"}
+	for name, want := range expected {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		node, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if node.Spec.PodCIDR != want {
+			t.Errorf("expected %s to get %s, got %q", name, want, node.Spec.PodCIDR)
+		}
+	}
+}
+
+func newTestKubeControllerManager(args ...string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-controller-manager-master-1",
+			Namespace: "kube-system",
+			Labels:    map[string]string{"component": "kube-controller-manager"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "kube-controller-manager",
+			Command: append([]string{"kube-controller-manager"}, args...),
+		}}},
+	}
+}
+
+func TestMigration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools:     []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		Migration: &config.Migration{},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg, newTestNode("node-1", "10.244.0.0/24"))
+
+	if err := c.PrepareMigration(ctx); err == nil {
+		t.Fatal("expected an error without a kube-controller-manager pod")
+	}
+	kcm := newTestKubeControllerManager("--allocate-node-cidrs=true", "--cluster-cidr=10.244.0.0/16", "--node-cidr-mask-size=25")
+	kcm, err := clientset.CoreV1().Pods("kube-system").Create(ctx, kcm, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.PrepareMigration(ctx); err == nil {
+		t.Fatal("expected an error for a different mask size")
+	}
+	kcm.Spec.Containers[0].Command[3] = "--node-cidr-mask-size=24"
+	if _, err := clientset.CoreV1().Pods("kube-system").Update(ctx, kcm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.PrepareMigration(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Observing writes nothing, not even through the webhooks
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	node, err := clientset.CoreV1().Nodes().Create(ctx, newTestNode("node-2", ""), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		_, err := c.nodeLister.Get("node-2")
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the node to reach the cache")
+	}
+	if err := c.syncAllocation(ctx, "node-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-2", metav1.GetOptions{}); got.Spec.PodCIDR != "" {
+		t.Fatalf("expected an observing controller not to allocate, got %q", got.Spec.PodCIDR)
+	}
+	if cidrBlock, err := c.AssignCIDR(ctx, newTestNode("node-3", "")); err != nil || cidrBlock != "" {
+		t.Fatalf("expected an observing controller not to assign, got %q, %v", cidrBlock, err)
+	}
+	if err := c.ValidatePodCIDRs(ctx, authenticationv1.UserInfo{}, node, []string{"10.244.0.0/24"}); err != nil {
+		t.Fatalf("expected an observing controller to admit any podCIDR, got %v", err)
+	}
+
+	// An allocation by kube-controller-manager is mirrored and reported
+	node.Spec.PodCIDR = "10.244.1.0/24"
+	node.Spec.PodCIDRs = []string{"10.244.1.0/24"}
+	if _, err := clientset.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return c.isAllocated("10.244.1.0/24") }); err != nil {
+		t.Fatal("expected the observed allocation to be mirrored")
+	}
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`podcidr_migration_observing 1`,
+		`podcidr_migration_observed_allocations_total{pool="default"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+
+	// The annotation hands allocation over
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:        "podcidr-controller",
+		Namespace:   "kube-system",
+		Annotations: map[string]string{MigrationActiveAnnotation: ""},
+	}}
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return !c.observing.Load() }); err != nil {
+		t.Fatal("expected the controller to become active")
+	}
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, newTestNode("node-3", ""), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool {
+		_, err := c.nodeLister.Get("node-3")
+		return err == nil
+	}); err != nil {
+		t.Fatal("expected the node to reach the cache")
+	}
+	if err := c.syncAllocation(ctx, "node-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-3", metav1.GetOptions{}); got.Spec.PodCIDR != "10.244.2.0/24" {
+		t.Errorf("expected 10.244.2.0/24 after the handover, got %q", got.Spec.PodCIDR)
+	}
+}
+
+func newTestNodeWithIP(name, podCIDR, ip string) *corev1.Node {
+	node := newTestNode(name, podCIDR)
+	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+	return node
+}
+
+func TestOverlapProtection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceCIDR := &networkingv1beta1.ServiceCIDR{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes"},
+		Spec:       networkingv1beta1.ServiceCIDRSpec{CIDRs: []string{"10.244.8.0/22", "fd00::/108"}},
+	}
+	newController := func(policy string) (*Controller, *fake.Clientset, error) {
+		clientset := fake.NewSimpleClientset(serviceCIDR, newTestNodeWithIP("node-1", "", "10.244.0.5"))
+		informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+		cfg := &config.Configuration{
+			Pools:             []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+			OverlapProtection: policy,
+		}
+		cfg.SetDefaults()
+		c, err := NewController(clientset, informerFactory, cfg, "kube-system")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c.WatchServiceCIDRs(informerFactory)
+		informerFactory.Start(ctx.Done())
+		return c, clientset, c.Prepare(ctx)
+	}
+
+	if _, _, err := newController(config.OverlapProtectionRefuse); err == nil || !strings.Contains(err.Error(), "ServiceCIDR kubernetes") {
+		t.Fatalf("expected Refuse to fail on the overlaps, got %v", err)
+	}
+
+	c, clientset, err := newController(config.OverlapProtectionExclude)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, cidrBlock := range []string{"10.244.0.0/24", "10.244.8.0/24", "10.244.11.0/24"} {
+		if !c.getPools()[0].shards[0].allocator.IsExcluded(cidrBlock) {
+			t.Errorf("expected %s to be excluded", cidrBlock)
+		}
+	}
+
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if got.Spec.PodCIDR != "10.244.1.0/24" {
+		t.Fatalf("expected the block of the node address to be skipped, got %q", got.Spec.PodCIDR)
+	}
+
+	// A joining node whose address is inside the pool is excluded and warned
+	// about, and the exclusion goes away with the node
+	joined := newTestNodeWithIP("node-2", "", "10.244.1.9")
+	if _, err := clientset.CoreV1().Nodes().Create(ctx, joined, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return c.getPools()[0].shards[0].allocator.IsExcluded("10.244.1.0/24") }); err != nil {
+		t.Fatal("expected the block of the new node address to be excluded")
+	}
+	if err := waitFor(func() bool {
+		events, _ := clientset.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+		for _, e := range events.Items {
+			if e.Reason == ReasonNodeAddressInPool && e.InvolvedObject.Name == "node-2" &&
+				strings.Contains(e.Message, "podCIDR of node node-1") {
+				return true
+			}
+		}
+		return false
+	}); err != nil {
+		t.Error("expected a Warning Event naming the node holding the block")
+	}
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-2", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := waitFor(func() bool { return !c.getPools()[0].shards[0].allocator.IsExcluded("10.244.1.0/24") }); err != nil {
+		t.Error("expected the exclusion to be dropped with the node")
+	}
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{
+			Name:        "default",
+			ClusterCIDR: "10.244.0.0/16",
+			Strategy:    config.StrategyNodeIP,
+			NodeIP:      &config.NodeIPMapping{Subnet: "192.168.0.0/16", HostBits: 8},
+		}},
+	}
+	cfg.SetDefaults()
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newTestNodeWithIP("node-1", "", "192.168.3.17"),
+		newTestNodeWithIP("node-2", "", "192.168.3.18"),
+		newTestNode("node-3", ""),
+	)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+	}
+	for name, want := range map[string]string{
+		"node-1": "10.244.3.0/24",
+		// Derived block taken by node-1, probed to the next one
+		"node-2": "10.244.4.0/24",
+		// Waiting for its InternalIP, without a failure
+		"node-3": "",
+	} {
+		got, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if got.Spec.PodCIDR != want {
+			t.Errorf("expected %s to get %q, got %q", name, want, got.Spec.PodCIDR)
+		}
+		if cond := findCondition(got.Status.Conditions, ConditionPodCIDRAllocated); name == "node-3" && cond != nil {
+			t.Errorf("expected no failure condition on a node waiting for its address, got %+v", cond)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `podcidr_allocation_collisions_total{pool="default"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+
+	// A node of a NameHash pool gets the same block when it comes back
+	cfg = &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16", Strategy: config.StrategyNameHash}},
+	}
+	cfg.SetDefaults()
+	c, clientset = newTestControllerWithConfig(ctx, t, cfg, newTestNode("node-1", ""))
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+	if err := c.syncAllocation(ctx, "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, _ := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if err := c.release(first.Spec.PodCIDR); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, err := c.AssignCIDR(ctx, newTestNode("node-1", ""))
+	if err != nil || again != first.Spec.PodCIDR || again == "10.244.0.0/24" {
+		t.Errorf("expected the hashed block %s again, got %q, %v", first.Spec.PodCIDR, again, err)
+	}
+}
+
+func TestAllocationPreconditions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		AllocationPreconditions: &config.AllocationPreconditions{
+			RequireProviderID: true,
+			AbsentTaints:      []string{"node.cloudprovider.kubernetes.io/uninitialized"},
+			RequiredLabels:    []string{"node-pool=workers"},
+			MinNodeAge:        metav1.Duration{Duration: time.Hour},
+		},
+	}
+	cfg.SetDefaults()
+
+	newNode := func(name, providerID string, age time.Duration, labels map[string]string, taints ...corev1.Taint) *corev1.Node {
+		node := newTestNode(name, "")
+		node.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+		node.Spec.ProviderID = providerID
+		node.Spec.Taints = taints
+		node.Labels = labels
+		return node
+	}
+	workers := map[string]string{"node-pool": "workers"}
+	uninitialized := corev1.Taint{Key: "node.cloudprovider.kubernetes.io/uninitialized", Value: "true", Effect: corev1.TaintEffectNoSchedule}
+	c, clientset := newTestControllerWithConfig(ctx, t, cfg,
+		newNode("ready", "cloud://ready", 2*time.Hour, workers),
+		newNode("no-provider-id", "", 2*time.Hour, workers, uninitialized),
+		newNode("tainted", "cloud://tainted", 2*time.Hour, workers, uninitialized),
+		newNode("unlabelled", "cloud://unlabelled", 2*time.Hour, map[string]string{"node-pool": "system"}),
+		newNode("young", "cloud://young", time.Minute, workers),
+	)
+	c.SetLeading(true)
+	c.SetShardOwned("default-0", true)
+
+	for _, name := range []string{"ready", "no-provider-id", "tainted", "unlabelled", "young"} {
+		if err := c.syncAllocation(ctx, name); err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+		got, _ := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if allocated := got.Spec.PodCIDR != ""; allocated != (name == "ready") {
+			t.Errorf("expected only the ready node to be allocated, %s got %q", name, got.Spec.PodCIDR)
+		}
+		if cond := findCondition(got.Status.Conditions, ConditionPodCIDRAllocated); cond != nil && cond.Status == corev1.ConditionFalse {
+			t.Errorf("expected no failure condition on %s, got %+v", name, cond)
+		}
+	}
+
+	young, _ := c.nodeLister.Get("young")
+	if reason, _, wait := unmetPrecondition(cfg.AllocationPreconditions, young, time.Now()); reason != PreconditionNodeAge ||
+		wait <= 58*time.Minute || wait > time.Hour {
+		t.Errorf("expected the young node to wait about 59m for its age, got %s after %s", reason, wait)
+	}
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`podcidr_nodes_awaiting_preconditions{reason="NoProviderID"} 1`,
+		`podcidr_nodes_awaiting_preconditions{reason="Tainted"} 1`,
+		`podcidr_nodes_awaiting_preconditions{reason="MissingLabel"} 1`,
+		`podcidr_nodes_awaiting_preconditions{reason="TooYoung"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+
+	// Nodes being admitted are left to the sync
+	if got, err := c.AssignCIDR(ctx, newNode("new", "", 0, workers, uninitialized)); err != nil || got != "" {
+		t.Errorf("expected no CIDR at admission, got %q, %v", got, err)
+	}
+}
+
+func TestAllocationPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{
+			{
+				Name:         "gpu",
+				ClusterCIDR:  "10.245.0.0/16",
+				NodeSelector: []selector.Expression{{Key: "node-type", Operator: "In", Values: []string{"gpu"}}},
+			},
+			{Name: "default", ClusterCIDR: "10.244.0.0/16"},
+		},
+		AllocationPriority: &config.AllocationPriority{
+			Rules: []config.PriorityRule{
+				{Priority: 100, NodeSelector: []selector.Expression{{Key: "priority-class", Operator: "In", Values: []string{"critical"}}}},
+				{Priority: 10, Pool: "gpu"},
+			},
+			OldestFirst: true,
+		},
+	}
+	cfg.SetDefaults()
+
+	newNode := func(name string, age time.Duration, labels map[string]string) *corev1.Node {
+		node := newTestNode(name, "")
+		node.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+		node.Labels = labels
+		return node
+	}
+	c, _ := newTestControllerWithConfig(ctx, t, cfg,
+		newNode("batch-new", time.Hour, nil),
+		newNode("critical", time.Minute, map[string]string{"priority-class": "critical"}),
+		newNode("batch-old", 3*time.Hour, nil),
+		newNode("gpu", 2*time.Hour, map[string]string{"node-type": "gpu"}),
+	)
+	queue := c.allocation.queue
+	if err := waitFor(func() bool { return queue.Len() == 4 }); err != nil {
+		t.Fatalf("expected 4 queued nodes, got %d", queue.Len())
+	}
+
+	var order []string
+	for queue.Len() > 0 {
+		key, _ := queue.Get()
+		order = append(order, key)
+		queue.Done(key)
+	}
+	if got, want := strings.Join(order, ","), "critical,gpu,batch-old,batch-new"; got != want {
+		t.Errorf("expected allocation order %s, got %s", want, got)
+	}
+
+	// Without a policy, nodes keep the order they were queued in, and a
+	// queued node is re-ranked when queued again
+	q := newPriorityQueue(func(key string) nodeRank { return nodeRank{} })
+	for _, key := range []string{"b", "a", "c"} {
+		q.Push(key)
+	}
+	q.rank = func(key string) nodeRank {
+		if key == "c" {
+			return nodeRank{priority: 1}
+		}
+		return nodeRank{}
+	}
+	q.Touch("c")
+	order = nil
+	for q.Len() > 0 {
+		order = append(order, q.Pop())
+	}
+	if got, want := strings.Join(order, ","), "c,b,a"; got != want {
+		t.Errorf("expected order %s, got %s", want, got)
+	}
+}
+
+func TestAllocationPriorityWithPoolsLocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: "10.244.0.0/16"}},
+		AllocationPriority: &config.AllocationPriority{
+			Rules: []config.PriorityRule{{Priority: 10, Pool: "default"}},
+		},
+	}
+	cfg.SetDefaults()
+	c, _ := newTestControllerWithConfig(ctx, t, cfg, newTestNode("node-1", ""))
+
+	// Ranking a node must not wait for the pools lock, e.g. while the pools
+	// are being replaced
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+	queued := make(chan struct{})
+	go func() {
+		c.allocation.queue.Add("node-2")
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queueing a node blocked on the pools lock")
+	}
+	if got := c.rankNode("node-1"); got.priority != 10 {
+		t.Errorf("expected the pool rule to rank node-1, got %+v", got)
+	}
+}
+
+func waitFor(cond func() bool) error {
+	return wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true,
+		func(context.Context) (bool, error) { return cond(), nil })
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/imroc/podcidr-controller/pkg/state"
+)
+
+const componentName = "podcidr-controller"
+
+// newEventRecorder starts recording Events to the API server
+func newEventRecorder(clientset kubernetes.Interface) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: componentName})
+	return broadcaster, recorder
+}
+
+// stateReference is the object that controller-wide Events, such as pool
+// capacity alerts, are reported on: the state ConfigMap
+func stateReference(namespace string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Namespace:  namespace,
+		Name:       state.Name,
+	}
+}
@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ExtraPodCIDRsAnnotation lists the blocks a node holds beyond its
+	// podCIDR, comma-separated. The API server does not allow a second
+	// IPv4 CIDR in Spec.PodCIDRs, so the CNI reads them from here.
+	ExtraPodCIDRsAnnotation = "podcidr.imroc.io/extra-pod-cidrs"
+
+	// PodCIDRCountAnnotation requests a total number of blocks for a node
+	PodCIDRCountAnnotation = "podcidr.imroc.io/pod-cidr-count"
+
+	// podNodeNameIndex indexes pods by the node they run on
+	podNodeNameIndex = "spec.nodeName"
+)
+
+// nodeCIDRs returns every block a node holds: its podCIDR followed by the
+// extra blocks from the annotation
+func nodeCIDRs(node *corev1.Node) []string {
+	var cidrs []string
+	if node.Spec.PodCIDR != "" {
+		cidrs = append(cidrs, node.Spec.PodCIDR)
+	}
+	return append(cidrs, extraCIDRs(node)...)
+}
+
+func extraCIDRs(node *corev1.Node) []string {
+	var cidrs []string
+	for _, c := range strings.Split(node.Annotations[ExtraPodCIDRsAnnotation], ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			cidrs = append(cidrs, c)
+		}
+	}
+	return cidrs
+}
+
+// releaseDroppedCIDRs frees the blocks a node no longer holds after an
+// update, such as an extra block removed from the annotation by hand
+func (c *Controller) releaseDroppedCIDRs(old, new interface{}) {
+	oldNode, ok := old.(*corev1.Node)
+	if !ok {
+		return
+	}
+	newNode, ok := new.(*corev1.Node)
+	if !ok {
+		return
+	}
+
+	held := nodeCIDRs(newNode)
+	released := false
+	for _, cidrBlock := range nodeCIDRs(oldNode) {
+		if slices.Contains(held, cidrBlock) {
+			continue
+		}
+		c.assignments.remove(cidrBlock)
+		if err := c.release(cidrBlock); err != nil {
+			klog.Warningf("Failed to release CIDR %s dropped from node %s: %v", cidrBlock, newNode.Name, err)
+		} else {
+			klog.Infof("Released CIDR %s dropped from node %s", cidrBlock, newNode.Name)
+			released = true
+		}
+	}
+	if released {
+		c.wakePending()
+	}
+}
+
+// podIndexFunc indexes pods that take an address from the node's blocks
+func podIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !usesPodCIDR(pod) {
+		return nil, nil
+	}
+	return []string{pod.Spec.NodeName}, nil
+}
+
+func usesPodCIDR(pod *corev1.Pod) bool {
+	return pod.Spec.NodeName != "" && !pod.Spec.HostNetwork &&
+		pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+func (c *Controller) enqueuePodNode(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" || pod.Spec.HostNetwork {
+		return
+	}
+	c.allocation.queue.Add(pod.Spec.NodeName)
+}
+
+// wantedCIDRs returns how many blocks a node should hold: the count it
+// requests by annotation, or one more than it has once its pods fill the
+// threshold, capped by the pool's maximum
+func (c *Controller) wantedCIDRs(p *pool, node *corev1.Node, current []string) int {
+	ec := p.extraCIDRs
+	if ec == nil {
+		return 1
+	}
+
+	wanted := len(current)
+	if v, ok := node.Annotations[PodCIDRCountAnnotation]; ok {
+		count, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Warningf("Node %s has invalid %s %q", node.Name, PodCIDRCountAnnotation, v)
+		} else if count > wanted {
+			wanted = count
+		}
+	}
+
+	if ec.PodUtilizationThreshold > 0 && c.podIndexer != nil {
+		pods, err := c.podIndexer.ByIndex(podNodeNameIndex, node.Name)
+		if err == nil && len(pods)*100 >= ec.PodUtilizationThreshold*addresses(current) {
+			wanted = max(wanted, len(current)+1)
+		}
+	}
+
+	return min(wanted, ec.MaxPerNode)
+}
+
+// addresses returns the number of addresses in a list of blocks
+func addresses(cidrs []string) int {
+	total := 0
+	for _, c := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(c); err == nil {
+			ones, bits := ipnet.Mask.Size()
+			total += 1 << (bits - ones)
+		}
+	}
+	return total
+}
+
+// syncExtraCIDRs allocates one more block to a node that wants it. One
+// block is added per sync; the node update requeues the node for the next.
+// Blocks are never taken back while the node exists, as pods may use them;
+// releaseDroppedCIDRs frees those removed from the annotation by hand.
+func (c *Controller) syncExtraCIDRs(ctx context.Context, p *pool, s *cidrShard, node *corev1.Node) error {
+	current := nodeCIDRs(node)
+	if len(current) >= c.wantedCIDRs(p, node, current) {
+		return nil
+	}
+
+	_, primary, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return fmt.Errorf("node %s has invalid podCIDR %s: %w", node.Name, node.Spec.PodCIDR, err)
+	}
+	maskSize, _ := primary.Mask.Size()
+
+	unreserve, err := c.reserveQuota(node, len(current)+1)
+	if err != nil {
+		return err
+	}
+	// Extra blocks drain the pool as fast as first ones, so they count
+	// against the same allocation limits
+	if err := c.checkAllocationLimits(ctx, p); err != nil {
+		unreserve()
+		return err
+	}
+
+	cidrBlock, err := s.allocator.AllocateNextSize(maskSize)
+	if err != nil {
+		unreserve()
+		return fmt.Errorf("failed to allocate extra CIDR for node %s from shard %s: %w", node.Name, s.name, err)
+	}
+
+	nodeCopy := node.DeepCopy()
+	if nodeCopy.Annotations == nil {
+		nodeCopy.Annotations = map[string]string{}
+	}
+	nodeCopy.Annotations[ExtraPodCIDRsAnnotation] = strings.Join(append(extraCIDRs(node), cidrBlock), ",")
+
+	// Recorded before the update so that the validating webhook knows
+	// the block is the node's own
+	c.assignments.add(cidrBlock, node.Name, time.Now(), unreserve)
+	_, err = c.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		c.assignments.remove(cidrBlock)
+		_ = s.allocator.Release(cidrBlock)
+		unreserve()
+		c.wakePending()
+		return fmt.Errorf("failed to update node %s with extra CIDR %s: %w", node.Name, cidrBlock, err)
+	}
+	p.capacity.recordAllocation(node.Name, cidrBlock, time.Now())
+
+	klog.Infof("Allocated extra CIDR %s to node %s (%d of %d blocks)", cidrBlock, node.Name, len(current)+1, p.extraCIDRs.MaxPerNode)
+	return nil
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"net/http"
+
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/metrics"
+)
+
+// registerMetrics exposes the sub-controllers' syncs and queues, pool and
+// quota usage and the pause switches
+func (c *Controller) registerMetrics() {
+	c.metrics.MustRegister(
+		c.syncs,
+		c.observedAllocations,
+		c.collisions,
+		metrics.NewGaugeFunc("podcidr_workqueue_depth",
+			"Nodes waiting in the queue of a sub-controller",
+			[]string{"controller"}, func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, r := range c.reconcilers {
+					samples = append(samples, metrics.Sample{LabelValues: []string{r.name}, Value: float64(r.queue.Len())})
+				}
+				return samples
+			}),
+		metrics.NewGaugeFunc("podcidr_pool_blocks_used",
+			"Node CIDR blocks of the default size in use, per pool",
+			[]string{"pool"}, func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, p := range c.getPools() {
+					used, _ := p.usage()
+					samples = append(samples, metrics.Sample{LabelValues: []string{p.name}, Value: float64(used)})
+				}
+				return samples
+			}),
+		metrics.NewGaugeFunc("podcidr_pool_blocks_total",
+			"Node CIDR blocks of the default size, per pool",
+			[]string{"pool"}, func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, p := range c.getPools() {
+					_, total := p.usage()
+					samples = append(samples, metrics.Sample{LabelValues: []string{p.name}, Value: float64(total)})
+				}
+				return samples
+			}),
+		metrics.NewGaugeFunc("podcidr_quota_blocks_used",
+			"Blocks held by the nodes matching a quota",
+			[]string{"quota"}, func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, q := range c.Config().Quotas {
+					used, err := c.quotaUsage(q)
+					if err != nil {
+						klog.Warningf("Failed to compute usage of quota %s: %v", q.Name, err)
+						continue
+					}
+					samples = append(samples, metrics.Sample{LabelValues: []string{q.Name}, Value: float64(used)})
+				}
+				return samples
+			}),
+		metrics.NewGaugeFunc("podcidr_quota_blocks_max",
+			"Most blocks the nodes matching a quota may hold",
+			[]string{"quota"}, func() []metrics.Sample {
+				var samples []metrics.Sample
+				for _, q := range c.Config().Quotas {
+					samples = append(samples, metrics.Sample{LabelValues: []string{q.Name}, Value: float64(q.MaxBlocks)})
+				}
+				return samples
+			}),
+		metrics.NewGaugeFunc("podcidr_paused",
+			"Whether an operation is paused by an annotation on the state ConfigMap",
+			[]string{"operation"}, func() []metrics.Sample {
+				return []metrics.Sample{
+					{LabelValues: []string{"allocation"}, Value: boolValue(c.allocationPaused.Load())},
+					{LabelValues: []string{"taint-removal"}, Value: boolValue(c.taintRemovalPaused.Load())},
+				}
+			}),
+		metrics.NewGaugeFunc("podcidr_nodes_awaiting_preconditions",
+			"Nodes without a podCIDR that do not meet the allocation preconditions yet, per reason",
+			[]string{"reason"}, c.awaitingPreconditions),
+		metrics.NewGaugeFunc("podcidr_migration_observing",
+			"Whether the controller only observes allocations during a migration from kube-controller-manager",
+			nil, func() []metrics.Sample {
+				return []metrics.Sample{{Value: boolValue(c.observing.Load())}}
+			}),
+	)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MetricsHandler serves the controller's metrics in the Prometheus text
+// format
+func (c *Controller) MetricsHandler() http.Handler {
+	return c.metrics
+}
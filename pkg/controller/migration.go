@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/kcm"
+)
+
+const (
+	// MigrationActiveAnnotation on the state ConfigMap ends the
+	// observe-only phase of a migration from kube-controller-manager while
+	// present. Removing it returns to observing.
+	MigrationActiveAnnotation = "migration.podcidr.imroc.io/active"
+
+	ReasonMigrationActive       = "MigrationActive"
+	ReasonMigrationObserving    = "MigrationObserving"
+	ReasonObservedAllocation    = "ObservedAllocation"
+	ReasonAllocatedOutsidePools = "AllocatedOutsidePools"
+)
+
+// PrepareMigration runs the first two steps of a migration from
+// kube-controller-manager, once Prepare has imported the CIDRs of existing
+// nodes. It checks that kube-controller-manager allocates from the cluster
+// CIDR and mask size of a pool, and reports the imported allocations. It
+// performs no writes.
+func (c *Controller) PrepareMigration(ctx context.Context) error {
+	if c.Config().Migration == nil {
+		return nil
+	}
+	if err := c.verifyKubeControllerManager(ctx); err != nil {
+		return err
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	imported, outside := 0, 0
+	for _, node := range nodes {
+		for _, cidrBlock := range nodeCIDRs(node) {
+			if c.poolOf(cidrBlock) == "" {
+				klog.Warningf("Node %s has CIDR %s outside every pool, it is not tracked", node.Name, cidrBlock)
+				outside++
+				continue
+			}
+			imported++
+		}
+	}
+	klog.Infof("Imported %d allocations of %d nodes, %d CIDRs are outside every pool", imported, len(nodes), outside)
+	if c.observing.Load() {
+		klog.Infof("Observing allocations until the %s annotation is set on the state ConfigMap", MigrationActiveAnnotation)
+	}
+	return nil
+}
+
+func (c *Controller) verifyKubeControllerManager(ctx context.Context) error {
+	if c.Config().Migration.SkipVerify {
+		klog.Info("Skipping the check of the kube-controller-manager settings")
+		return nil
+	}
+	settings, err := kcm.Find(ctx, c.clientset)
+	if errors.Is(err, kcm.ErrNotFound) {
+		return fmt.Errorf("%w in kube-system, set migration.skipVerify to migrate without checking its settings", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the kube-controller-manager settings: %w", err)
+	}
+	if !settings.AllocateNodeCIDRs {
+		klog.Infof("kube-controller-manager pod %s does not allocate node CIDRs, nothing to hand over", settings.Pod)
+		return nil
+	}
+
+	for _, p := range c.getPools() {
+		cfg := p.settings.Load()
+		if cfg.ClusterCIDR == settings.ClusterCIDR && cfg.NodeCIDRMaskSize == settings.NodeCIDRMaskSize {
+			klog.Infof("kube-controller-manager pod %s allocates from pool %s (%s, /%d)",
+				settings.Pod, p.name, cfg.ClusterCIDR, cfg.NodeCIDRMaskSize)
+			return nil
+		}
+	}
+	return fmt.Errorf("kube-controller-manager pod %s allocates /%d blocks from %s, which matches no pool",
+		settings.Pod, settings.NodeCIDRMaskSize, settings.ClusterCIDR)
+}
+
+// observeMigration follows the active annotation of the state ConfigMap.
+// Switching to active requeues every node.
+func (c *Controller) observeMigration(cm *corev1.ConfigMap) {
+	if c.Config().Migration == nil {
+		return
+	}
+	_, active := cm.Annotations[MigrationActiveAnnotation]
+	if c.observing.Swap(!active) == !active {
+		return
+	}
+	if !active {
+		klog.Warningf("Observing allocations again, the %s annotation was removed", MigrationActiveAnnotation)
+		if c.leading.Load() {
+			c.recorder.Eventf(c.eventRef, corev1.EventTypeNormal, ReasonMigrationObserving, "Observing allocations, CIDR allocation is left to kube-controller-manager")
+		}
+		return
+	}
+	observed := 0
+	for _, s := range c.observedAllocations.Collect() {
+		observed += int(s.Value)
+	}
+	klog.Infof("Took over CIDR allocation, %d nodes were allocated by kube-controller-manager while observing", observed)
+	if c.leading.Load() {
+		c.recorder.Eventf(c.eventRef, corev1.EventTypeNormal, ReasonMigrationActive,
+			"Took over CIDR allocation, %d nodes were allocated by kube-controller-manager while observing", observed)
+	}
+	c.enqueueAll()
+}
+
+// reportObservedAllocation reports a node that received its podCIDR from
+// someone else, kube-controller-manager presumably, while the controller
+// was observing. The allocator already mirrors the block.
+func (c *Controller) reportObservedAllocation(old, new interface{}) {
+	if !c.observing.Load() {
+		return
+	}
+	oldNode, ok := old.(*corev1.Node)
+	if !ok {
+		return
+	}
+	node, ok := new.(*corev1.Node)
+	if !ok || oldNode.Spec.PodCIDR != "" || node.Spec.PodCIDR == "" {
+		return
+	}
+
+	pool := c.poolOf(node.Spec.PodCIDR)
+	c.observedAllocations.Inc(pool)
+	if pool == "" {
+		klog.Warningf("Node %s was allocated %s outside every pool while observing", node.Name, node.Spec.PodCIDR)
+		if c.leading.Load() {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, ReasonAllocatedOutsidePools,
+				"Allocated %s outside every pool of podcidr-controller while it was observing", node.Spec.PodCIDR)
+		}
+		return
+	}
+	klog.Infof("Node %s was allocated %s from pool %s while observing", node.Name, node.Spec.PodCIDR, pool)
+	if c.leading.Load() {
+		c.recorder.Eventf(node, corev1.EventTypeNormal, ReasonObservedAllocation,
+			"Allocated %s by another allocator while podcidr-controller was observing", node.Spec.PodCIDR)
+	}
+}
@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+)
+
+const ReasonNodeAddressInPool = "NodeAddressInPodCIDRRange"
+
+// protectedRange is a range that overlap protection keeps out of the pools
+type protectedRange struct {
+	cidr string
+	// source names where the range comes from, e.g. "node node-1"
+	source string
+}
+
+// WatchServiceCIDRs makes overlap protection follow the networking.k8s.io
+// ServiceCIDR objects. It must be called before the informer factory is
+// started, and only if the API server serves them.
+func (c *Controller) WatchServiceCIDRs(factory informers.SharedInformerFactory) {
+	informer := factory.Networking().V1beta1().ServiceCIDRs()
+	c.serviceCIDRLister = informer.Lister()
+	c.serviceCIDRsSynced = informer.Informer().HasSynced
+
+	_, _ = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.syncOverlaps() },
+		UpdateFunc: func(old, new interface{}) { c.syncOverlaps() },
+		DeleteFunc: func(interface{}) { c.syncOverlaps() },
+	})
+}
+
+// protectedRanges returns the IPv4 ranges of the ServiceCIDR objects and
+// the addresses of every node
+func (c *Controller) protectedRanges() []protectedRange {
+	var ranges []protectedRange
+	if c.serviceCIDRLister != nil {
+		serviceCIDRs, err := c.serviceCIDRLister.List(labels.Everything())
+		if err != nil {
+			runtime.HandleError(err)
+		}
+		for _, sc := range serviceCIDRs {
+			for _, cidrBlock := range sc.Spec.CIDRs {
+				if ip, _, err := net.ParseCIDR(cidrBlock); err == nil && ip.To4() != nil {
+					ranges = append(ranges, protectedRange{cidr: cidrBlock, source: "ServiceCIDR " + sc.Name})
+				}
+			}
+		}
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+	}
+	for _, node := range nodes {
+		for _, ip := range nodeIPs(node) {
+			ranges = append(ranges, protectedRange{cidr: ip + "/32", source: "node " + node.Name})
+		}
+	}
+	slices.SortFunc(ranges, func(a, b protectedRange) int {
+		return strings.Compare(a.source+" "+a.cidr, b.source+" "+b.cidr)
+	})
+	return ranges
+}
+
+// nodeIPs returns the IPv4 internal and external addresses of a node
+func nodeIPs(node *corev1.Node) []string {
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP && addr.Type != corev1.NodeExternalIP {
+			continue
+		}
+		if ip := net.ParseIP(addr.Address); ip != nil && ip.To4() != nil && !slices.Contains(ips, ip.String()) {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+// syncOverlaps excludes the protected ranges from every pool and returns a
+// description of each one that overlaps a pool. Blocks already held keep
+// their nodes. Newly found overlaps are logged.
+func (c *Controller) syncOverlaps() []string {
+	if c.Config().OverlapProtection == "" {
+		return nil
+	}
+	ranges := c.protectedRanges()
+	cidrs := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		cidrs = append(cidrs, r.cidr)
+	}
+
+	var overlaps []string
+	for _, p := range c.getPools() {
+		if err := p.setOverlapExcluded(cidrs); err != nil {
+			runtime.HandleError(fmt.Errorf("pool %s: %w", p.name, err))
+			continue
+		}
+		clusterCIDR := p.settings.Load().ClusterCIDR
+		for _, r := range ranges {
+			if config.Contains(clusterCIDR, r.cidr) || config.Contains(r.cidr, clusterCIDR) {
+				overlaps = append(overlaps, fmt.Sprintf("%s %s overlaps pool %s (%s)", r.source, r.cidr, p.name, clusterCIDR))
+			}
+		}
+	}
+
+	c.overlapsMu.Lock()
+	defer c.overlapsMu.Unlock()
+	known := make(map[string]bool, len(overlaps))
+	for _, o := range overlaps {
+		if !c.overlaps[o] {
+			klog.Warningf("Excluding from allocation: %s", o)
+		}
+		known[o] = true
+	}
+	c.overlaps = known
+	return overlaps
+}
+
+// observeNodeAddresses refreshes the exclusions when a node address enters
+// or leaves a pool, and warns on a node whose new address is inside one
+func (c *Controller) observeNodeAddresses(old, new interface{}) {
+	if c.Config().OverlapProtection == "" {
+		return
+	}
+	var before, after []string
+	if node, ok := old.(*corev1.Node); ok {
+		before = nodeIPs(node)
+	}
+	node, ok := new.(*corev1.Node)
+	if ok {
+		after = nodeIPs(node)
+	}
+	if slices.Equal(before, after) {
+		return
+	}
+
+	type hit struct{ ip, pool, clusterCIDR string }
+	var hits []hit
+	changed := false
+	for _, p := range c.getPools() {
+		clusterCIDR := p.settings.Load().ClusterCIDR
+		for _, ip := range append(slices.Clone(before), after...) {
+			if !config.Contains(clusterCIDR, ip+"/32") {
+				continue
+			}
+			changed = true
+			if slices.Contains(after, ip) && !slices.Contains(before, ip) {
+				hits = append(hits, hit{ip: ip, pool: p.name, clusterCIDR: clusterCIDR})
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	c.syncOverlaps()
+
+	if !ok || !c.leading.Load() {
+		return
+	}
+	for _, h := range hits {
+		if holder := c.ownerOf("", h.ip+"/32"); holder != "" {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, ReasonNodeAddressInPool,
+				"Address %s is inside the podCIDR of node %s, from pool %s (%s)", h.ip, holder, h.pool, h.clusterCIDR)
+			continue
+		}
+		c.recorder.Eventf(node, corev1.EventTypeWarning, ReasonNodeAddressInPool,
+			"Address %s is inside pool %s (%s), its block is excluded from allocation", h.ip, h.pool, h.clusterCIDR)
+	}
+}
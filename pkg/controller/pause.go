@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PauseAllocationAnnotation on the state ConfigMap stops CIDR
+	// allocation while present. Its value is a free-form reason.
+	PauseAllocationAnnotation = "pause.podcidr.imroc.io/allocation"
+
+	// PauseTaintRemovalAnnotation on the state ConfigMap stops taint
+	// removal while present
+	PauseTaintRemovalAnnotation = "pause.podcidr.imroc.io/taint-removal"
+
+	ReasonPaused  = "Paused"
+	ReasonResumed = "Resumed"
+)
+
+// observePause follows the pause annotations of the state ConfigMap. Only
+// writes are paused: the allocator keeps mirroring nodes, and conditions
+// and metrics stay current. Resuming requeues every node.
+func (c *Controller) observePause(cm *corev1.ConfigMap) {
+	resumed := false
+	for _, sw := range []struct {
+		annotation string
+		operation  string
+		paused     *atomic.Bool
+	}{
+		{PauseAllocationAnnotation, "CIDR allocation", &c.allocationPaused},
+		{PauseTaintRemovalAnnotation, "taint removal", &c.taintRemovalPaused},
+	} {
+		reason, paused := cm.Annotations[sw.annotation]
+		if sw.paused.Swap(paused) == paused {
+			continue
+		}
+		if paused {
+			klog.Warningf("Paused %s by annotation %s: %s", sw.operation, sw.annotation, reason)
+			if c.leading.Load() {
+				c.recorder.Eventf(c.eventRef, corev1.EventTypeNormal, ReasonPaused, "Paused %s: %s", sw.operation, reason)
+			}
+			continue
+		}
+		klog.Infof("Resumed %s", sw.operation)
+		if c.leading.Load() {
+			c.recorder.Eventf(c.eventRef, corev1.EventTypeNormal, ReasonResumed, "Resumed %s", sw.operation)
+		}
+		resumed = true
+	}
+	if resumed {
+		c.enqueueAll()
+	}
+}
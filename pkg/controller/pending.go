@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// pendingResyncPeriod wakes pending nodes even without a release, in case
+// capacity was freed in a way the controller did not observe
+const pendingResyncPeriod = 5 * time.Minute
+
+// pendingNodes holds nodes that are waiting for a block to be freed. They
+// are parked instead of rate-limit requeued, and woken in FIFO order by
+// creation time when capacity comes back.
+type pendingNodes struct {
+	mu    sync.Mutex
+	nodes map[string]time.Time
+}
+
+func newPendingNodes() *pendingNodes {
+	return &pendingNodes{nodes: map[string]time.Time{}}
+}
+
+func (p *pendingNodes) park(name string, created time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodes[name] = created
+}
+
+func (p *pendingNodes) remove(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.nodes, name)
+}
+
+func (p *pendingNodes) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.nodes)
+}
+
+// drain empties the set and returns the nodes oldest first
+func (p *pendingNodes) drain() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.nodes))
+	for name := range p.nodes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ti, tj := p.nodes[names[i]], p.nodes[names[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return names[i] < names[j]
+	})
+	p.nodes = map[string]time.Time{}
+	return names
+}
@@ -0,0 +1,289 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/apis/v1alpha1"
+	"github.com/imroc/podcidr-controller/pkg/config"
+)
+
+// poolStatusPeriod is how often the leader refreshes the status of
+// PodCIDRPool objects
+const poolStatusPeriod = 30 * time.Second
+
+// getPools returns the pools in the order nodes try them. The slice is
+// replaced as a whole when the pools change, never modified in place.
+func (c *Controller) getPools() []*pool {
+	c.poolsMu.RLock()
+	defer c.poolsMu.RUnlock()
+	return c.pools
+}
+
+// setPools reconciles the pools with configs, given in the order nodes
+// should try them. New pools take the CIDRs of existing nodes, and pools
+// missing from configs are dropped; their nodes keep their CIDRs. A config
+// that is invalid, overlaps a pool earlier in the order or cannot be
+// applied live is rejected, and a pool that already existed keeps its
+// previous settings. Rejected configs are returned by pool name.
+func (c *Controller) setPools(configs []config.Pool) map[string]error {
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+
+	current := map[string]*pool{}
+	for _, p := range c.pools {
+		current[p.name] = p
+	}
+
+	rejected := map[string]error{}
+	var accepted []config.Pool
+	var next []*pool
+	for _, pc := range configs {
+		existing := current[pc.Name]
+		pc, err := acceptPool(accepted, pc)
+		if err == nil && existing != nil {
+			err = config.CheckReload(
+				&config.Configuration{Pools: []config.Pool{*existing.settings.Load()}},
+				&config.Configuration{Pools: []config.Pool{pc}})
+		}
+		if err != nil {
+			rejected[pc.Name] = err
+			if existing == nil {
+				continue
+			}
+			if previous, err := acceptPool(accepted, *existing.settings.Load()); err == nil {
+				accepted = append(accepted, previous)
+				next = append(next, existing)
+			}
+			continue
+		}
+		accepted = append(accepted, pc)
+
+		if existing != nil {
+			if err := existing.apply(pc); err != nil {
+				rejected[pc.Name] = err
+			}
+			next = append(next, existing)
+			continue
+		}
+
+		p, err := newPool(pc)
+		if err != nil {
+			rejected[pc.Name] = err
+			continue
+		}
+		c.reserveExisting(p)
+		for _, s := range p.shards {
+			s.setOwned(c.leading.Load())
+		}
+		klog.Infof("Added pool %s with cluster CIDR %s", p.name, pc.ClusterCIDR)
+		next = append(next, p)
+	}
+
+	for name := range current {
+		if !slices.ContainsFunc(next, func(p *pool) bool { return p.name == name }) {
+			klog.Infof("Dropped pool %s, its nodes keep their CIDRs", name)
+		}
+	}
+	for name, err := range rejected {
+		klog.Warningf("Rejected settings of pool %s: %v", name, err)
+	}
+	c.pools = next
+	c.publishPoolsLocked()
+	return rejected
+}
+
+// acceptPool defaults and validates a pool together with the pools
+// accepted before it
+func acceptPool(accepted []config.Pool, pc config.Pool) (config.Pool, error) {
+	cfg := &config.Configuration{
+		Controllers: []string{config.CIDRAllocator},
+		Pools:       append(slices.Clone(accepted), pc),
+	}
+	cfg.SetDefaults()
+	pc = cfg.Pools[len(cfg.Pools)-1]
+	return pc, cfg.Validate()
+}
+
+// reserveExisting marks the CIDRs of existing nodes in a new pool
+func (c *Controller) reserveExisting(p *pool) {
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, node := range nodes {
+		for _, cidrBlock := range nodeCIDRs(node) {
+			_ = p.markAllocated(cidrBlock)
+		}
+	}
+}
+
+// WatchPodCIDRPools makes the controller read its pools from PodCIDRPool
+// objects, with poolSource PodCIDRPool. It must be called before the
+// informer factory is started and before Prepare.
+func (c *Controller) WatchPodCIDRPools(client dynamic.Interface, factory dynamicinformer.DynamicSharedInformerFactory) {
+	informer := factory.ForResource(v1alpha1.PodCIDRPoolResource)
+	c.poolClient = client
+	c.poolLister = informer.Lister()
+	c.poolObjectsSynced = informer.Informer().HasSynced
+
+	_, _ = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { c.syncPodCIDRPools() },
+		UpdateFunc: func(old, new interface{}) {
+			// Status updates do not change the generation
+			if o, ok := old.(*unstructured.Unstructured); ok {
+				if n, ok := new.(*unstructured.Unstructured); ok && o.GetGeneration() == n.GetGeneration() {
+					return
+				}
+			}
+			c.syncPodCIDRPools()
+		},
+		DeleteFunc: func(interface{}) { c.syncPodCIDRPools() },
+	})
+}
+
+// listPodCIDRPools returns the PodCIDRPool objects, highest priority first
+func (c *Controller) listPodCIDRPools() ([]*v1alpha1.PodCIDRPool, error) {
+	objs, err := c.poolLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	pools := make([]*v1alpha1.PodCIDRPool, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		p, err := v1alpha1.PodCIDRPoolFromUnstructured(u)
+		if err != nil {
+			runtime.HandleError(fmt.Errorf("failed to decode PodCIDRPool %s: %w", u.GetName(), err))
+			continue
+		}
+		pools = append(pools, p)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].Spec.Priority != pools[j].Spec.Priority {
+			return pools[i].Spec.Priority > pools[j].Spec.Priority
+		}
+		return pools[i].Name < pools[j].Name
+	})
+	return pools, nil
+}
+
+// syncPodCIDRPools rebuilds the pools from the PodCIDRPool objects
+func (c *Controller) syncPodCIDRPools() {
+	objs, err := c.listPodCIDRPools()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	configs := make([]config.Pool, 0, len(objs))
+	for _, obj := range objs {
+		configs = append(configs, config.Pool{
+			Name:             obj.Name,
+			ClusterCIDR:      obj.Spec.ClusterCIDR,
+			NodeCIDRMaskSize: obj.Spec.NodeCIDRMaskSize,
+			NodeSelector:     obj.Spec.NodeSelector,
+		})
+	}
+
+	rejected := c.setPools(configs)
+	c.poolsMu.Lock()
+	c.poolErrors = rejected
+	c.poolsMu.Unlock()
+	c.syncOverlaps()
+
+	if c.allocation != nil {
+		c.enqueueAll(c.allocation)
+	}
+}
+
+// updatePodCIDRPoolStatus writes the usage and conditions of every
+// PodCIDRPool object that changed. Leader only.
+func (c *Controller) updatePodCIDRPoolStatus(ctx context.Context) {
+	if !c.leading.Load() {
+		return
+	}
+	objs, err := c.listPodCIDRPools()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	c.poolsMu.RLock()
+	pools, rejected := c.pools, c.poolErrors
+	c.poolsMu.RUnlock()
+
+	for _, obj := range objs {
+		status := obj.Status
+		status.Conditions = slices.Clone(obj.Status.Conditions)
+		status.ObservedGeneration = obj.Generation
+
+		i := slices.IndexFunc(pools, func(p *pool) bool { return p.name == obj.Name })
+		if i >= 0 {
+			used, total := pools[i].usage()
+			status.TotalBlocks, status.UsedBlocks, status.FreeBlocks = total, used, total-used
+		} else {
+			status.TotalBlocks, status.UsedBlocks, status.FreeBlocks = 0, 0, 0
+		}
+
+		switch err := rejected[obj.Name]; {
+		case err != nil && i >= 0:
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type: v1alpha1.ConditionReady, Status: metav1.ConditionFalse, Reason: "InvalidSpec",
+				Message: fmt.Sprintf("%v; allocating with the previous settings", err),
+			})
+		case err != nil:
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type: v1alpha1.ConditionReady, Status: metav1.ConditionFalse, Reason: "InvalidSpec", Message: err.Error(),
+			})
+		default:
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type: v1alpha1.ConditionReady, Status: metav1.ConditionTrue, Reason: "Allocating",
+				Message: "Nodes matching the selector receive CIDRs from this pool",
+			})
+		}
+		if i >= 0 && status.FreeBlocks == 0 {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type: v1alpha1.ConditionExhausted, Status: metav1.ConditionTrue, Reason: "NoFreeBlocks",
+				Message: fmt.Sprintf("All %d blocks are in use", status.TotalBlocks),
+			})
+		} else {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type: v1alpha1.ConditionExhausted, Status: metav1.ConditionFalse, Reason: "FreeBlocks",
+				Message: fmt.Sprintf("%d of %d blocks are free", status.FreeBlocks, status.TotalBlocks),
+			})
+		}
+		for j := range status.Conditions {
+			status.Conditions[j].ObservedGeneration = obj.Generation
+		}
+
+		if reflect.DeepEqual(status, obj.Status) {
+			continue
+		}
+		obj.Status = status
+		u, err := v1alpha1.ToUnstructured(obj)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		if _, err := c.poolClient.Resource(v1alpha1.PodCIDRPoolResource).UpdateStatus(ctx, u, metav1.UpdateOptions{}); err != nil {
+			klog.Warningf("Failed to update status of PodCIDRPool %s: %v", obj.Name, err)
+		}
+	}
+}
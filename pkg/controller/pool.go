@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/cidr"
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/masksize"
+	"github.com/imroc/podcidr-controller/pkg/selector"
+	"github.com/imroc/podcidr-controller/pkg/shard"
+)
+
+// pool is a cluster CIDR that nodes receive their podCIDR from. A pool is
+// split into one or more shards, each owned by exactly one replica.
+type pool struct {
+	name       string
+	shards     []*cidrShard
+	extraCIDRs *config.ExtraCIDRs
+
+	capacity capacityState
+
+	// excludeMu guards the excluded ranges, the configured ones merged with
+	// those found by overlap protection
+	excludeMu         sync.Mutex
+	excludedByConfig  []*net.IPNet
+	excludedByOverlap []*net.IPNet
+
+	// settings, selector and maskSize are swapped on configuration reload
+	settings atomic.Pointer[config.Pool]
+	selector atomic.Pointer[selector.NodeSelector]
+	maskSize atomic.Pointer[masksize.Policy]
+}
+
+// cidrShard is a contiguous range of a pool with its own allocator.
+// Only the replica that owns a shard may allocate from it.
+type cidrShard struct {
+	name      string
+	allocator *cidr.Allocator
+
+	// mu is held for reading across an allocation and the node update, so
+	// that dropping ownership waits for in-flight writes to finish.
+	mu    sync.RWMutex
+	owned bool
+	// generation tells a catch-up whether the ownership change it
+	// completes was superseded
+	generation atomic.Uint64
+}
+
+func newPool(cfg config.Pool) (*pool, error) {
+	shardCount := cfg.Shards
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	ranges, err := cidr.Split(cfg.ClusterCIDR, shardCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to shard cluster CIDR: %w", err)
+	}
+
+	p := &pool{name: cfg.Name, extraCIDRs: cfg.ExtraCIDRs}
+	_, maxMaskSize := cfg.MaskSizeRange()
+	for i, r := range ranges {
+		allocator, err := cidr.NewVariableAllocator(r, cfg.NodeCIDRMaskSize, maxMaskSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CIDR allocator: %w", err)
+		}
+		p.shards = append(p.shards, &cidrShard{
+			name:      fmt.Sprintf("%s-%d", cfg.Name, i),
+			allocator: allocator,
+		})
+	}
+	if err := p.apply(cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// apply swaps in the settings of a pool that can change without
+// rebuilding it
+func (p *pool) apply(cfg config.Pool) error {
+	u, err := p.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	p.commit(u)
+	return nil
+}
+
+// poolUpdate is a checked change of a pool's settings that commit applies
+// without failing
+type poolUpdate struct {
+	cfg      config.Pool
+	expand   bool
+	excluded []*net.IPNet
+	maskSize *masksize.Policy
+}
+
+// prepare checks new settings of the pool, including a wider cluster CIDR,
+// without changing the pool
+func (p *pool) prepare(cfg config.Pool) (*poolUpdate, error) {
+	excluded, err := cidr.ParseExclusions(cfg.ExcludeCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exclude CIDRs: %w", err)
+	}
+	u := &poolUpdate{cfg: cfg, excluded: excluded, maskSize: newMaskSizePolicy(cfg)}
+
+	if current := p.settings.Load(); current != nil && current.ClusterCIDR != cfg.ClusterCIDR {
+		if len(p.shards) != 1 {
+			return nil, fmt.Errorf("cannot expand sharded pool %s", p.name)
+		}
+		if err := p.shards[0].allocator.CheckExpand(cfg.ClusterCIDR); err != nil {
+			return nil, fmt.Errorf("failed to expand pool %s to %s: %w", p.name, cfg.ClusterCIDR, err)
+		}
+		u.expand = true
+	}
+	return u, nil
+}
+
+// commit applies settings checked by prepare
+func (p *pool) commit(u *poolUpdate) {
+	if u.expand {
+		old := p.settings.Load().ClusterCIDR
+		if err := p.shards[0].allocator.Expand(u.cfg.ClusterCIDR); err != nil {
+			// Checked by prepare, only a concurrent change of the range
+			// gets here
+			runtime.HandleError(fmt.Errorf("failed to expand pool %s to %s: %w", p.name, u.cfg.ClusterCIDR, err))
+		} else {
+			klog.Infof("Expanded pool %s from %s to %s", p.name, old, u.cfg.ClusterCIDR)
+		}
+	}
+	p.setExcluded(u.excluded)
+	p.settings.Store(&u.cfg)
+	p.selector.Store(&selector.NodeSelector{MatchExpressions: u.cfg.NodeSelector})
+	p.maskSize.Store(u.maskSize)
+}
+
+// newMaskSizePolicy builds the per-node mask size policy of a pool
+func newMaskSizePolicy(cfg config.Pool) *masksize.Policy {
+	mp := cfg.MaskSizePolicy
+	if mp == nil {
+		return masksize.Fixed(cfg.NodeCIDRMaskSize)
+	}
+	return &masksize.Policy{
+		Default:         cfg.NodeCIDRMaskSize,
+		Min:             mp.MinNodeCIDRMaskSize,
+		Max:             mp.MaxNodeCIDRMaskSize,
+		InstanceTypes:   mp.InstanceTypes,
+		FromPodCapacity: mp.FromPodCapacity,
+	}
+}
+
+// shardFor returns the shard a node allocates from. Nodes are spread by a
+// hash of their name and never fall back to another shard, so a shard can
+// run out while others still have free blocks.
+func (p *pool) shardFor(node *corev1.Node) *cidrShard {
+	return p.shards[shard.ForNode(node.Name, len(p.shards))]
+}
+
+// markAllocated reserves a CIDR in whichever shard contains it
+func (p *pool) markAllocated(cidrBlock string) error {
+	for _, s := range p.shards {
+		err := s.allocator.MarkAllocated(cidrBlock)
+		if !errors.Is(err, cidr.ErrCIDROutOfRange) {
+			return err
+		}
+	}
+	return cidr.ErrCIDROutOfRange
+}
+
+// release frees a CIDR in whichever shard contains it
+func (p *pool) release(cidrBlock string) error {
+	for _, s := range p.shards {
+		err := s.allocator.Release(cidrBlock)
+		if !errors.Is(err, cidr.ErrCIDROutOfRange) {
+			return err
+		}
+	}
+	return cidr.ErrCIDROutOfRange
+}
+
+// isAllocated reports whether a CIDR is reserved in any shard
+func (p *pool) isAllocated(cidrBlock string) bool {
+	for _, s := range p.shards {
+		if s.allocator.IsAllocated(cidrBlock) {
+			return true
+		}
+	}
+	return false
+}
+
+// setExcluded replaces the configured ranges that are never allocated
+func (p *pool) setExcluded(excluded []*net.IPNet) {
+	p.excludeMu.Lock()
+	defer p.excludeMu.Unlock()
+	p.excludedByConfig = excluded
+	p.applyExcluded()
+}
+
+// setOverlapExcluded replaces the ranges excluded by overlap protection
+func (p *pool) setOverlapExcluded(cidrs []string) error {
+	excluded, err := cidr.ParseExclusions(cidrs)
+	if err != nil {
+		return fmt.Errorf("failed to exclude CIDRs: %w", err)
+	}
+	p.excludeMu.Lock()
+	defer p.excludeMu.Unlock()
+	p.excludedByOverlap = excluded
+	p.applyExcluded()
+	return nil
+}
+
+// applyExcluded excludes both kinds of ranges in every shard. excludeMu
+// must be held.
+func (p *pool) applyExcluded() {
+	excluded := append(slices.Clone(p.excludedByConfig), p.excludedByOverlap...)
+	for _, s := range p.shards {
+		s.allocator.SetExclusions(excluded)
+	}
+}
+
+// usage returns the used and total default-size blocks across all shards
+func (p *pool) usage() (int, int) {
+	used, total := 0, 0
+	for _, s := range p.shards {
+		u, t := s.allocator.Usage()
+		used += u
+		total += t
+	}
+	return used, total
+}
+
+func (s *cidrShard) setOwned(owned bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owned = owned
+}
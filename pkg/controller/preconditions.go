@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/metrics"
+	"github.com/imroc/podcidr-controller/pkg/taint"
+)
+
+// Reasons a node waits for its allocation preconditions, used as the
+// reason label of podcidr_nodes_awaiting_preconditions
+const (
+	PreconditionProviderID = "NoProviderID"
+	PreconditionTaint      = "Tainted"
+	PreconditionLabel      = "MissingLabel"
+	PreconditionNodeAge    = "TooYoung"
+)
+
+var preconditionReasons = []string{PreconditionProviderID, PreconditionTaint, PreconditionLabel, PreconditionNodeAge}
+
+// preconditionRecheckPeriod requeues nodes waiting for a precondition
+// other than their age, in case the node update that meets it is missed
+const preconditionRecheckPeriod = time.Minute
+
+// unmetPrecondition returns the reason of the first allocation
+// precondition the node does not meet, a description, and how long until
+// it is met if that only depends on time. The reason is empty when all are
+// met.
+func unmetPrecondition(pre *config.AllocationPreconditions, node *corev1.Node, now time.Time) (string, string, time.Duration) {
+	if pre == nil {
+		return "", "", 0
+	}
+	if pre.RequireProviderID && node.Spec.ProviderID == "" {
+		return PreconditionProviderID, "spec.providerID is not set", preconditionRecheckPeriod
+	}
+	if len(pre.AbsentTaints) > 0 {
+		// Validated with the configuration
+		matcher, _ := taint.NewTaintRemoverFromList(pre.AbsentTaints)
+		if taints := matcher.GetTaintsToRemove(node); len(taints) > 0 {
+			return PreconditionTaint, fmt.Sprintf("tainted with %s", strings.Join(taint.TaintKeys(taints), ", ")),
+				preconditionRecheckPeriod
+		}
+	}
+	for _, l := range pre.RequiredLabels {
+		key, value, hasValue := strings.Cut(l, "=")
+		got, ok := node.Labels[key]
+		if !ok || (hasValue && got != value) {
+			return PreconditionLabel, fmt.Sprintf("label %s is missing", l), preconditionRecheckPeriod
+		}
+	}
+	// A node being admitted has no creation time yet
+	created := node.CreationTimestamp.Time
+	if created.IsZero() {
+		created = now
+	}
+	if age := now.Sub(created); age < pre.MinNodeAge.Duration {
+		return PreconditionNodeAge, fmt.Sprintf("created %s ago, less than %s", age.Round(time.Second), pre.MinNodeAge.Duration),
+			pre.MinNodeAge.Duration - age
+	}
+	return "", "", 0
+}
+
+// awaitingPreconditions counts the nodes without a podCIDR that match a
+// pool but do not meet the allocation preconditions yet, per reason
+func (c *Controller) awaitingPreconditions() []metrics.Sample {
+	pre := c.Config().AllocationPreconditions
+	if pre == nil || c.allocation == nil {
+		return nil
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return nil
+	}
+	counts := map[string]int{}
+	now := time.Now()
+	for _, node := range nodes {
+		if node.Spec.PodCIDR != "" || c.poolFor(node) == nil {
+			continue
+		}
+		if reason, _, _ := unmetPrecondition(pre, node, now); reason != "" {
+			counts[reason]++
+		}
+	}
+	samples := make([]metrics.Sample, 0, len(preconditionReasons))
+	for _, reason := range preconditionReasons {
+		samples = append(samples, metrics.Sample{LabelValues: []string{reason}, Value: float64(counts[reason])})
+	}
+	return samples
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/imroc/podcidr-controller/pkg/selector"
+)
+
+// nodeRank is the position of a node in the allocation queue: higher
+// priorities first, then older nodes if created is set
+type nodeRank struct {
+	priority int
+	created  time.Time
+}
+
+// before reports whether a node of rank r is allocated before one of
+// rank o
+func (r nodeRank) before(o nodeRank) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	return r.created.Before(o.created)
+}
+
+type queuedNode struct {
+	key  string
+	rank nodeRank
+	// seq keeps nodes of equal rank in the order they were queued
+	seq uint64
+}
+
+// priorityQueue orders the keys of the allocation workqueue by the rank of
+// their node. It implements workqueue.Queue and is only called under the
+// workqueue's lock, so rank must not take locks that are held while
+// queueing.
+type priorityQueue struct {
+	rank  func(key string) nodeRank
+	nodes []*queuedNode
+	index map[string]int
+	seq   uint64
+}
+
+func newPriorityQueue(rank func(key string) nodeRank) *priorityQueue {
+	return &priorityQueue{rank: rank, index: map[string]int{}}
+}
+
+// Push queues a key behind the keys of the same rank
+func (q *priorityQueue) Push(key string) {
+	q.seq++
+	heap.Push((*nodeHeap)(q), &queuedNode{key: key, rank: q.rank(key), seq: q.seq})
+}
+
+// Pop returns the key of the highest ranked node
+func (q *priorityQueue) Pop() string {
+	return heap.Pop((*nodeHeap)(q)).(*queuedNode).key
+}
+
+// Touch re-ranks a key that is queued again, e.g. after its labels or the
+// priority rules changed. It keeps its place among keys of the same rank.
+func (q *priorityQueue) Touch(key string) {
+	i, ok := q.index[key]
+	if !ok {
+		return
+	}
+	q.nodes[i].rank = q.rank(key)
+	heap.Fix((*nodeHeap)(q), i)
+}
+
+func (q *priorityQueue) Len() int {
+	return len(q.nodes)
+}
+
+// nodeHeap is the container/heap view of a priorityQueue
+type nodeHeap priorityQueue
+
+func (h *nodeHeap) Len() int { return len(h.nodes) }
+
+func (h *nodeHeap) Less(i, j int) bool {
+	a, b := h.nodes[i], h.nodes[j]
+	if a.rank.before(b.rank) {
+		return true
+	}
+	if b.rank.before(a.rank) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+func (h *nodeHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
+	h.index[h.nodes[i].key] = i
+	h.index[h.nodes[j].key] = j
+}
+
+func (h *nodeHeap) Push(x interface{}) {
+	n := x.(*queuedNode)
+	h.index[n.key] = len(h.nodes)
+	h.nodes = append(h.nodes, n)
+}
+
+func (h *nodeHeap) Pop() interface{} {
+	n := h.nodes[len(h.nodes)-1]
+	h.nodes[len(h.nodes)-1] = nil
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	delete(h.index, n.key)
+	return n
+}
+
+// rankNode ranks a node by the allocation priority policy. Nodes that are
+// gone or without a policy share rank 0 and keep their queue order. It runs
+// under the queue's lock, so the policy and the pools are read from their
+// lock-free snapshots.
+func (c *Controller) rankNode(key string) nodeRank {
+	policy := c.priority.Load()
+	if policy == nil {
+		return nodeRank{}
+	}
+	node, err := c.nodeLister.Get(key)
+	if err != nil {
+		return nodeRank{}
+	}
+
+	var r nodeRank
+	if policy.OldestFirst {
+		r.created = node.CreationTimestamp.Time
+	}
+	var poolName string
+	if p := c.poolFor(node); p != nil {
+		poolName = p.name
+	}
+	for _, rule := range policy.Rules {
+		if rule.Pool != "" && rule.Pool != poolName {
+			continue
+		}
+		if (&selector.NodeSelector{MatchExpressions: rule.NodeSelector}).Matches(node) {
+			r.priority = rule.Priority
+			break
+		}
+	}
+	return r
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/selector"
+)
+
+const ReasonQuotaExceeded = "QuotaExceeded"
+
+// errQuotaExceeded holds a node back until its group frees blocks
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaState serializes quota decisions. Blocks granted by this replica
+// are reserved until the informer shows them on the node, so that two
+// allocations in a row cannot both fit in the last free slot.
+type quotaState struct {
+	mu       sync.Mutex
+	reserved map[string]reservation
+}
+
+// reservation is the number of blocks a node was granted. The node is
+// kept to count it against its quotas before the informer has seen it,
+// as with nodes admitted by the webhook.
+type reservation struct {
+	blocks int
+	node   *corev1.Node
+}
+
+func newQuotaState() *quotaState {
+	return &quotaState{reserved: map[string]reservation{}}
+}
+
+// observe drops the reservation of a node once the informer caught up
+func (s *quotaState) observe(node *corev1.Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.reserved[node.Name]; ok && len(nodeCIDRs(node)) >= r.blocks {
+		delete(s.reserved, node.Name)
+	}
+}
+
+func (s *quotaState) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, name)
+}
+
+// matchingQuotas returns the quotas whose selector matches the node
+func matchingQuotas(quotas []config.Quota, node *corev1.Node) []config.Quota {
+	var matched []config.Quota
+	for _, q := range quotas {
+		sel := &selector.NodeSelector{MatchExpressions: q.NodeSelector}
+		if sel.Matches(node) {
+			matched = append(matched, q)
+		}
+	}
+	return matched
+}
+
+// heldLocked returns the blocks a node holds, including a reservation
+func (s *quotaState) heldLocked(node *corev1.Node) int {
+	return max(len(nodeCIDRs(node)), s.reserved[node.Name].blocks)
+}
+
+// quotaUsageLocked returns the blocks held by the nodes matching a quota
+func (c *Controller) quotaUsageLocked(q config.Quota) (int, error) {
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return 0, err
+	}
+	sel := &selector.NodeSelector{MatchExpressions: q.NodeSelector}
+	used := 0
+	listed := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		listed[node.Name] = true
+		if sel.Matches(node) {
+			used += c.quotas.heldLocked(node)
+		}
+	}
+	for name, r := range c.quotas.reserved {
+		if !listed[name] && sel.Matches(r.node) {
+			used += r.blocks
+		}
+	}
+	return used, nil
+}
+
+// quotaUsage returns the blocks held by the nodes matching a quota
+func (c *Controller) quotaUsage(q config.Quota) (int, error) {
+	c.quotas.mu.Lock()
+	defer c.quotas.mu.Unlock()
+	return c.quotaUsageLocked(q)
+}
+
+// reserveQuota reserves room for a node to hold wanted blocks in every
+// quota it matches. The returned function undoes the reservation if the
+// allocation fails. A node over quota gets a Warning Event and an error
+// wrapping errQuotaExceeded.
+func (c *Controller) reserveQuota(node *corev1.Node, wanted int) (func(), error) {
+	quotas := matchingQuotas(c.Config().Quotas, node)
+	if len(quotas) == 0 {
+		return func() {}, nil
+	}
+
+	c.quotas.mu.Lock()
+	defer c.quotas.mu.Unlock()
+
+	held := c.quotas.heldLocked(node)
+	for _, q := range quotas {
+		used, err := c.quotaUsageLocked(q)
+		if err != nil {
+			return nil, err
+		}
+		if used-held+wanted > q.MaxBlocks {
+			err := fmt.Errorf("%w: quota %s holds %d of %d blocks", errQuotaExceeded, q.Name, used, q.MaxBlocks)
+			klog.V(2).Infof("Node %s cannot get a block: %v", node.Name, err)
+			c.recorder.Eventf(node, corev1.EventTypeWarning, ReasonQuotaExceeded,
+				"Quota %s holds %d of %d blocks, node %s stays without a new block", q.Name, used, q.MaxBlocks, node.Name)
+			return nil, err
+		}
+	}
+
+	previous, hadPrevious := c.quotas.reserved[node.Name]
+	c.quotas.reserved[node.Name] = reservation{blocks: wanted, node: node}
+	return func() {
+		c.quotas.mu.Lock()
+		defer c.quotas.mu.Unlock()
+		if hadPrevious {
+			c.quotas.reserved[node.Name] = previous
+		} else {
+			delete(c.quotas.reserved, node.Name)
+		}
+	}, nil
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/imroc/podcidr-controller/pkg/metrics"
+)
+
+// reconciler is a sub-controller: a queue of node names and the function
+// that syncs a node from it. Each sub-controller has its own queue, so an
+// error in one does not hold back the other for the same node.
+type reconciler struct {
+	name  string
+	queue workqueue.TypedRateLimitingInterface[string]
+	sync  func(ctx context.Context, key string) error
+
+	// park takes a failed key out of the queue instead of requeueing it
+	// with backoff, and reports whether it did. Optional.
+	park func(key string, err error) bool
+
+	syncs *metrics.CounterVec
+}
+
+// newReconciler creates a sub-controller. order sets the order in which
+// queued nodes are synced, FIFO if nil.
+func newReconciler(name string, syncs *metrics.CounterVec, sync func(context.Context, string) error, order workqueue.Queue[string]) *reconciler {
+	return &reconciler{
+		name: name,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{
+				Name: name,
+				DelayingQueue: workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{
+					Name:  name,
+					Queue: workqueue.NewTypedWithConfig(workqueue.TypedQueueConfig[string]{Name: name, Queue: order}),
+				}),
+			},
+		),
+		sync:  sync,
+		syncs: syncs,
+	}
+}
+
+func (r *reconciler) run(ctx context.Context) {
+	for r.processNextWorkItem(ctx) {
+	}
+}
+
+func (r *reconciler) processNextWorkItem(ctx context.Context) bool {
+	key, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.sync(ctx, key)
+	if err == nil {
+		r.queue.Forget(key)
+		r.syncs.Inc(r.name, "success")
+		return true
+	}
+
+	if r.park != nil && r.park(key, err) {
+		r.queue.Forget(key)
+		r.syncs.Inc(r.name, "parked")
+		return true
+	}
+
+	runtime.HandleError(fmt.Errorf("%s: error syncing node %s: %v", r.name, key, err))
+	r.syncs.Inc(r.name, "error")
+	r.queue.AddRateLimited(key)
+	return true
+}
@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/apis/v1alpha1"
+)
+
+// recordSweepPeriod is how often the leader marks the records of blocks
+// that are no longer held as released and deletes expired ones
+const recordSweepPeriod = time.Minute
+
+// recordName names the record of a block held by a node. The node UID
+// keeps records apart when a recreated node gets the same block again.
+func recordName(cidrBlock string, uid string) string {
+	return strings.NewReplacer(".", "-", "/", "-").Replace(cidrBlock) + "-" + uid
+}
+
+// WatchAllocationRecords makes the controller keep a NodeCIDRAllocation
+// object per allocation, with allocationRecords set. It must be called
+// before the informer factory is started and before Prepare.
+func (c *Controller) WatchAllocationRecords(client dynamic.Interface, factory dynamicinformer.DynamicSharedInformerFactory) {
+	informer := factory.ForResource(v1alpha1.NodeCIDRAllocationResource)
+	c.recordClient = client
+	c.recordLister = informer.Lister()
+	c.recordsSynced = informer.Informer().HasSynced
+}
+
+// listRecords returns the NodeCIDRAllocation objects
+func (c *Controller) listRecords() ([]*v1alpha1.NodeCIDRAllocation, error) {
+	objs, err := c.recordLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*v1alpha1.NodeCIDRAllocation, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		r, err := v1alpha1.NodeCIDRAllocationFromUnstructured(u)
+		if err != nil {
+			runtime.HandleError(fmt.Errorf("failed to decode NodeCIDRAllocation %s: %w", u.GetName(), err))
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// restoreFromRecords reserves the blocks of unreleased records, so that a
+// block assigned to a node the informer has not shown yet is not handed
+// out twice. The sweep releases the blocks whose node is gone.
+func (c *Controller) restoreFromRecords() error {
+	records, err := c.listRecords()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Spec.ReleasedAt != nil {
+			continue
+		}
+		if err := c.markAllocated(r.Spec.CIDR); err != nil {
+			klog.V(4).Infof("Ignoring CIDR %s recorded for node %s: %v", r.Spec.CIDR, r.Spec.NodeName, err)
+		}
+	}
+	return nil
+}
+
+// recordAllocations creates the missing records of a node's blocks. Leader
+// only.
+func (c *Controller) recordAllocations(ctx context.Context, node *corev1.Node) error {
+	if c.recordClient == nil || node.UID == "" {
+		return nil
+	}
+	for _, cidrBlock := range nodeCIDRs(node) {
+		name := recordName(cidrBlock, string(node.UID))
+		if _, err := c.recordLister.Get(name); err == nil {
+			continue
+		} else if !errors.IsNotFound(err) {
+			return err
+		}
+
+		record := &v1alpha1.NodeCIDRAllocation{
+			TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.Group + "/" + v1alpha1.Version, Kind: "NodeCIDRAllocation"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.NodeCIDRAllocationSpec{
+				NodeName:    node.Name,
+				NodeUID:     node.UID,
+				CIDR:        cidrBlock,
+				Pool:        c.poolOf(cidrBlock),
+				AllocatedAt: metav1.Now(),
+			},
+		}
+		if len(validation.IsValidLabelValue(node.Name)) == 0 {
+			record.Labels = map[string]string{v1alpha1.NodeLabel: node.Name}
+		}
+		u, err := v1alpha1.ToUnstructured(record)
+		if err != nil {
+			return err
+		}
+		_, err = c.recordClient.Resource(v1alpha1.NodeCIDRAllocationResource).Create(ctx, u, metav1.CreateOptions{})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to record CIDR %s of node %s: %w", cidrBlock, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// sweepRecords marks the records of blocks their node no longer holds as
+// released, and deletes released records past the retention. Blocks that
+// were only reserved by restoreFromRecords are released in the allocator
+// too. Leader only.
+func (c *Controller) sweepRecords(ctx context.Context) {
+	if !c.leading.Load() {
+		return
+	}
+	records, err := c.listRecords()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	client := c.recordClient.Resource(v1alpha1.NodeCIDRAllocationResource)
+	retention := c.Config().AllocationRecords.Retention.Duration
+
+	released := false
+	for _, r := range records {
+		if r.Spec.ReleasedAt != nil {
+			if time.Since(r.Spec.ReleasedAt.Time) < retention {
+				continue
+			}
+			if err := client.Delete(ctx, r.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				klog.Warningf("Failed to delete expired NodeCIDRAllocation %s: %v", r.Name, err)
+			}
+			continue
+		}
+
+		node, err := c.nodeLister.Get(r.Spec.NodeName)
+		if err == nil && node.UID == r.Spec.NodeUID && hasCIDR(node, r.Spec.CIDR) {
+			continue
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			runtime.HandleError(err)
+			continue
+		}
+
+		now := metav1.Now()
+		r.Spec.ReleasedAt = &now
+		u, err := v1alpha1.ToUnstructured(r)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		if _, err := client.Update(ctx, u, metav1.UpdateOptions{}); err != nil {
+			klog.Warningf("Failed to mark NodeCIDRAllocation %s as released: %v", r.Name, err)
+			continue
+		}
+		klog.Infof("Recorded the release of CIDR %s by node %s", r.Spec.CIDR, r.Spec.NodeName)
+
+		// The block may have been handed to another node since
+		if c.ownerOf("", r.Spec.CIDR) != "" || c.assignments.pending(r.Spec.CIDR) {
+			continue
+		}
+		if err := c.release(r.Spec.CIDR); err == nil {
+			released = true
+		}
+	}
+	if released {
+		c.wakePending()
+	}
+}
+
+// poolOf returns the name of the pool a block belongs to, or an empty
+// string
+func (c *Controller) poolOf(cidrBlock string) string {
+	for _, p := range c.getPools() {
+		for _, s := range p.shards {
+			if _, err := s.allocator.InUse(cidrBlock); err == nil {
+				return p.name
+			}
+		}
+	}
+	return ""
+}
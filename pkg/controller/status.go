@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/cidr"
+	"github.com/imroc/podcidr-controller/pkg/taint"
+)
+
+const (
+	// ConditionPodCIDRAllocated reports whether a node has received a CIDR
+	ConditionPodCIDRAllocated corev1.NodeConditionType = "PodCIDRAllocated"
+
+	// UnallocatedTaintKey marks nodes that could not get a CIDR
+	UnallocatedTaintKey = "podcidr.imroc.io/unallocated"
+
+	ReasonCIDRAllocated    = "CIDRAllocated"
+	ReasonCIDRExhausted    = "CIDRExhausted"
+	ReasonAllocationFailed = "AllocationFailed"
+)
+
+var unallocatedTaint = corev1.Taint{Key: UnallocatedTaintKey, Effect: corev1.TaintEffectNoSchedule}
+
+// reportsFor tells whether this replica reports the allocation outcome of a
+// node. The owner of the node's shard allocates to it, so it reports both
+// failures and success; nodes outside every pool are left to the leader.
+func (c *Controller) reportsFor(p *pool, node *corev1.Node) bool {
+	if p == nil {
+		return c.leading.Load()
+	}
+	s := p.shardFor(node)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.owned
+}
+
+// reportAllocationFailure sets PodCIDRAllocated=False on a node and, if
+// configured, taints it so that pods are not scheduled without a network
+func (c *Controller) reportAllocationFailure(ctx context.Context, node *corev1.Node, allocErr error) error {
+	reason := ReasonAllocationFailed
+	if errors.Is(allocErr, cidr.ErrCIDRExhausted) {
+		reason = ReasonCIDRExhausted
+	}
+
+	if c.Config().NodeStatus.TaintUnallocated && !taint.HasTaint(node.Spec.Taints, unallocatedTaint) {
+		nodeCopy := node.DeepCopy()
+		nodeCopy.Spec.Taints = append(nodeCopy.Spec.Taints, unallocatedTaint)
+		updated, err := c.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to taint node %s: %w", node.Name, err)
+		}
+		node = updated
+		klog.Infof("Tainted node %s with %s", node.Name, UnallocatedTaintKey)
+	}
+
+	return c.updateConditions(ctx, node, corev1.NodeCondition{
+		Type:    ConditionPodCIDRAllocated,
+		Status:  corev1.ConditionFalse,
+		Reason:  reason,
+		Message: allocErr.Error(),
+	})
+}
+
+// reportAllocated clears what reportAllocationFailure set once a node has
+// a CIDR. The condition is only written if an earlier failure set it, so
+// healthy nodes are not touched; NetworkUnavailable is cleared if
+// configured and not already False.
+func (c *Controller) reportAllocated(ctx context.Context, node *corev1.Node) error {
+	if taint.HasTaint(node.Spec.Taints, unallocatedTaint) {
+		nodeCopy := node.DeepCopy()
+		nodeCopy.Spec.Taints = taint.FilterOutTaints(nodeCopy.Spec.Taints, []corev1.Taint{unallocatedTaint})
+		updated, err := c.clientset.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to remove taint %s from node %s: %w", UnallocatedTaintKey, node.Name, err)
+		}
+		node = updated
+		klog.Infof("Removed taint %s from node %s", UnallocatedTaintKey, node.Name)
+	}
+
+	var conditions []corev1.NodeCondition
+	if findCondition(node.Status.Conditions, ConditionPodCIDRAllocated) != nil {
+		conditions = append(conditions, corev1.NodeCondition{
+			Type:    ConditionPodCIDRAllocated,
+			Status:  corev1.ConditionTrue,
+			Reason:  ReasonCIDRAllocated,
+			Message: fmt.Sprintf("Allocated CIDR %s", node.Spec.PodCIDR),
+		})
+	}
+	if c.Config().NodeStatus.SetNetworkAvailable {
+		existing := findCondition(node.Status.Conditions, corev1.NodeNetworkUnavailable)
+		if existing == nil || existing.Status != corev1.ConditionFalse {
+			conditions = append(conditions, corev1.NodeCondition{
+				Type:    corev1.NodeNetworkUnavailable,
+				Status:  corev1.ConditionFalse,
+				Reason:  ReasonCIDRAllocated,
+				Message: "podcidr-controller allocated a pod CIDR to the node",
+			})
+		}
+	}
+	return c.updateConditions(ctx, node, conditions...)
+}
+
+// updateConditions writes the conditions to the node status if any differs
+func (c *Controller) updateConditions(ctx context.Context, node *corev1.Node, conditions ...corev1.NodeCondition) error {
+	nodeCopy := node.DeepCopy()
+	changed := false
+	for _, cond := range conditions {
+		changed = setCondition(&nodeCopy.Status.Conditions, cond) || changed
+	}
+	if !changed {
+		return nil
+	}
+
+	if _, err := c.clientset.CoreV1().Nodes().UpdateStatus(ctx, nodeCopy, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update conditions of node %s: %w", node.Name, err)
+	}
+	return nil
+}
+
+func findCondition(conditions []corev1.NodeCondition, condType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i := range conditions {
+		if conditions[i].Type == condType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition adds or updates a condition and reports whether it changed.
+// The transition time only moves when the status changes.
+func setCondition(conditions *[]corev1.NodeCondition, cond corev1.NodeCondition) bool {
+	now := metav1.Now()
+	existing := findCondition(*conditions, cond.Type)
+	if existing == nil {
+		cond.LastHeartbeatTime = now
+		cond.LastTransitionTime = now
+		*conditions = append(*conditions, cond)
+		return true
+	}
+	if existing.Status == cond.Status && existing.Reason == cond.Reason && existing.Message == cond.Message {
+		return false
+	}
+	if existing.Status != cond.Status {
+		existing.LastTransitionTime = now
+	}
+	existing.Status = cond.Status
+	existing.Reason = cond.Reason
+	existing.Message = cond.Message
+	existing.LastHeartbeatTime = now
+	return true
+}
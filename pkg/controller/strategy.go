@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+)
+
+const ReasonCIDRCollision = "CIDRCollision"
+
+// errNoNodeAddress holds a node of a NodeIP pool until the kubelet reports
+// its InternalIP. The node update requeues it.
+var errNoNodeAddress = errors.New("node has no IPv4 InternalIP yet")
+
+// preferredBlock returns the block a deterministic strategy derives from a
+// node, counted in blocks of the node's size
+func preferredBlock(settings *config.Pool, node *corev1.Node) (uint64, error) {
+	if settings.Strategy == config.StrategyNameHash {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(node.Name))
+		return h.Sum64(), nil
+	}
+
+	var ip net.IP
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			if ip = net.ParseIP(addr.Address).To4(); ip != nil {
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return 0, errNoNodeAddress
+	}
+	_, subnet, err := net.ParseCIDR(settings.NodeIP.Subnet)
+	if err != nil {
+		return 0, err
+	}
+	if !subnet.Contains(ip) {
+		return 0, fmt.Errorf("InternalIP %s is outside nodeIP.subnet %s", ip, settings.NodeIP.Subnet)
+	}
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(subnet.IP.To4())
+	return uint64(offset >> settings.NodeIP.HostBits), nil
+}
+
+// reportCollision reports a node whose derived block was taken, so that it
+// got the next free one instead. Leader only.
+func (c *Controller) reportCollision(p *pool, node *corev1.Node, cidrBlock string, probed int) {
+	c.collisions.Inc(p.name)
+	klog.Warningf("The block derived for node %s in pool %s was taken, allocated %s after %d probes",
+		node.Name, p.name, cidrBlock, probed)
+	c.recorder.Eventf(node, corev1.EventTypeWarning, ReasonCIDRCollision,
+		"The block derived from the node with strategy %s was taken, allocated %s after %d probes",
+		p.settings.Load().Strategy, cidrBlock, probed)
+}
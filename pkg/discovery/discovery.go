@@ -0,0 +1,239 @@
+// Package discovery finds the cluster CIDR and node mask size of a cluster
+// from the places that already hold them, so they need not be repeated in
+// the controller's flags
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/imroc/podcidr-controller/pkg/kcm"
+)
+
+// Sources, in the order they are consulted
+const (
+	SourceKubeadm               = "kubeadm-config"
+	SourceKubeControllerManager = "kube-controller-manager"
+	SourceNodes                 = "nodes"
+)
+
+// defaultMaskSize is the IPv4 node mask size of kube-controller-manager,
+// used when no source sets one
+const defaultMaskSize = 24
+
+// Finding is what one source says. Empty fields are unknown to it.
+type Finding struct {
+	Source           string
+	ClusterCIDR      string
+	NodeCIDRMaskSize int
+}
+
+// Result is the agreed cluster CIDR and mask size, with the sources that
+// gave them
+type Result struct {
+	ClusterCIDR        string
+	NodeCIDRMaskSize   int
+	ClusterCIDRSources []string
+	MaskSizeSources    []string
+}
+
+// Discover reads the kubeadm ClusterConfiguration, the flags of the
+// kube-controller-manager pods and the podCIDRs of existing nodes. It fails
+// if no source knows the cluster CIDR, if the sources disagree, or if a node
+// holds a block outside the discovered range.
+func Discover(ctx context.Context, client kubernetes.Interface) (*Result, error) {
+	var findings []Finding
+
+	cm, err := client.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(ctx, "kubeadm-config", metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read the kubeadm-config ConfigMap: %w", err)
+	default:
+		f, err := FromKubeadm(cm.Data["ClusterConfiguration"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the kubeadm ClusterConfiguration: %w", err)
+		}
+		findings = append(findings, *f)
+	}
+
+	settings, err := kcm.Find(ctx, client)
+	switch {
+	case errors.Is(err, kcm.ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read the kube-controller-manager settings: %w", err)
+	case settings.ClusterCIDR != "":
+		findings = append(findings, Finding{
+			Source:           SourceKubeControllerManager,
+			ClusterCIDR:      settings.ClusterCIDR,
+			NodeCIDRMaskSize: settings.NodeCIDRMaskSize,
+		})
+	}
+
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var blocks []string
+	for _, node := range nodes.Items {
+		cidrs := node.Spec.PodCIDRs
+		if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+		blocks = append(blocks, cidrs...)
+	}
+	findings = append(findings, FromNodeCIDRs(blocks))
+
+	result, err := Merge(findings)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlocks(result.ClusterCIDR, blocks); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// clusterConfiguration is the part of the kubeadm ClusterConfiguration the
+// discovery reads
+type clusterConfiguration struct {
+	Networking struct {
+		PodSubnet string `json:"podSubnet"`
+	} `json:"networking"`
+	ControllerManager struct {
+		// A map up to v1beta3, a list of name and value since v1beta4
+		ExtraArgs json.RawMessage `json:"extraArgs"`
+	} `json:"controllerManager"`
+}
+
+// FromKubeadm reads the pod subnet and the kube-controller-manager mask
+// size of a kubeadm ClusterConfiguration
+func FromKubeadm(data string) (*Finding, error) {
+	var cc clusterConfiguration
+	if err := yaml.Unmarshal([]byte(data), &cc); err != nil {
+		return nil, err
+	}
+
+	args := map[string]string{}
+	if len(cc.ControllerManager.ExtraArgs) > 0 && string(cc.ControllerManager.ExtraArgs) != "null" {
+		if err := json.Unmarshal(cc.ControllerManager.ExtraArgs, &args); err != nil {
+			var list []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			}
+			if err := json.Unmarshal(cc.ControllerManager.ExtraArgs, &list); err != nil {
+				return nil, fmt.Errorf("controllerManager.extraArgs: %w", err)
+			}
+			for _, arg := range list {
+				args[arg.Name] = arg.Value
+			}
+		}
+	}
+
+	f := &Finding{Source: SourceKubeadm, ClusterCIDR: firstIPv4(cc.Networking.PodSubnet)}
+	for _, name := range []string{"node-cidr-mask-size", "node-cidr-mask-size-ipv4"} {
+		if size, err := strconv.Atoi(args[name]); err == nil {
+			f.NodeCIDRMaskSize = size
+		}
+	}
+	return f, nil
+}
+
+// FromNodeCIDRs reads the mask size shared by the IPv4 blocks of existing
+// nodes. Blocks do not reveal the cluster CIDR, and blocks of different
+// sizes give no mask size.
+func FromNodeCIDRs(blocks []string) Finding {
+	f := Finding{Source: SourceNodes}
+	for _, block := range blocks {
+		_, ipnet, err := net.ParseCIDR(block)
+		if err != nil || ipnet.IP.To4() == nil {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		if f.NodeCIDRMaskSize != 0 && f.NodeCIDRMaskSize != ones {
+			return Finding{Source: SourceNodes}
+		}
+		f.NodeCIDRMaskSize = ones
+	}
+	return f
+}
+
+// Merge combines the findings of several sources. Every source that knows
+// the cluster CIDR or the mask size must agree on it.
+func Merge(findings []Finding) (*Result, error) {
+	r := &Result{}
+	var cidrs, masks []string
+	for _, f := range findings {
+		if f.ClusterCIDR != "" {
+			cidrs = append(cidrs, fmt.Sprintf("%s from %s", f.ClusterCIDR, f.Source))
+			if r.ClusterCIDR == "" {
+				r.ClusterCIDR = f.ClusterCIDR
+			}
+			if f.ClusterCIDR == r.ClusterCIDR {
+				r.ClusterCIDRSources = append(r.ClusterCIDRSources, f.Source)
+			}
+		}
+		if f.NodeCIDRMaskSize != 0 {
+			masks = append(masks, fmt.Sprintf("/%d from %s", f.NodeCIDRMaskSize, f.Source))
+			if r.NodeCIDRMaskSize == 0 {
+				r.NodeCIDRMaskSize = f.NodeCIDRMaskSize
+			}
+			if f.NodeCIDRMaskSize == r.NodeCIDRMaskSize {
+				r.MaskSizeSources = append(r.MaskSizeSources, f.Source)
+			}
+		}
+	}
+
+	if r.ClusterCIDR == "" {
+		return nil, fmt.Errorf("no source knows the cluster CIDR, neither %s nor %s", SourceKubeadm, SourceKubeControllerManager)
+	}
+	if len(r.ClusterCIDRSources) != len(cidrs) {
+		return nil, fmt.Errorf("the sources disagree on the cluster CIDR: %s", strings.Join(cidrs, ", "))
+	}
+	if len(r.MaskSizeSources) != len(masks) {
+		return nil, fmt.Errorf("the sources disagree on the node mask size: %s", strings.Join(masks, ", "))
+	}
+	if r.NodeCIDRMaskSize == 0 {
+		r.NodeCIDRMaskSize = defaultMaskSize
+	}
+	return r, nil
+}
+
+// checkBlocks fails if an IPv4 node block lies outside the cluster CIDR
+func checkBlocks(clusterCIDR string, blocks []string) error {
+	_, cluster, err := net.ParseCIDR(clusterCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid discovered cluster CIDR %q: %w", clusterCIDR, err)
+	}
+	for _, block := range blocks {
+		ip, _, err := net.ParseCIDR(block)
+		if err != nil || ip.To4() == nil {
+			continue
+		}
+		if !cluster.Contains(ip) {
+			return fmt.Errorf("node CIDR %s is outside the discovered cluster CIDR %s", block, clusterCIDR)
+		}
+	}
+	return nil
+}
+
+// firstIPv4 returns the first IPv4 range of a comma-separated list
+func firstIPv4(list string) string {
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if ip, _, err := net.ParseCIDR(c); err == nil && ip.To4() != nil {
+			return c
+		}
+	}
+	return ""
+}
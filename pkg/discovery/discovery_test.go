@@ -0,0 +1,181 @@
+package discovery
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newKubeadmConfig(clusterConfiguration string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubeadm-config", Namespace: "kube-system"},
+		Data:       map[string]string{"ClusterConfiguration": clusterConfiguration},
+	}
+}
+
+func newKubeControllerManager(args ...string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-controller-manager-master-1",
+			Namespace: "kube-system",
+			Labels:    map[string]string{"component": "kube-controller-manager"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:    "kube-controller-manager",
+			Command: append([]string{"kube-controller-manager"}, args...),
+		}}},
+	}
+}
+
+func newNode(name string, podCIDRs ...string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+	}
+}
+
+func TestFromKubeadm(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Finding
+	}{
+		{
+			name: "v1beta3 extraArgs map",
+			data: "apiVersion: kubeadm.k8s.io/v1beta3\nkind: ClusterConfiguration\nnetworking:\n  podSubnet: 10.244.0.0/16\ncontrollerManager:\n  extraArgs:\n    node-cidr-mask-size: \"25\"\n",
+			want: Finding{Source: SourceKubeadm, ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 25},
+		},
+		{
+			name: "v1beta4 extraArgs list",
+			data: "apiVersion: kubeadm.k8s.io/v1beta4\nkind: ClusterConfiguration\nnetworking:\n  podSubnet: 10.244.0.0/16\ncontrollerManager:\n  extraArgs:\n  - name: node-cidr-mask-size-ipv4\n    value: \"26\"\n",
+			want: Finding{Source: SourceKubeadm, ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 26},
+		},
+		{
+			name: "dual-stack without mask size",
+			data: "networking:\n  podSubnet: fd00::/48,10.244.0.0/16\n",
+			want: Finding{Source: SourceKubeadm, ClusterCIDR: "10.244.0.0/16"},
+		},
+		{
+			name: "no pod subnet",
+			data: "networking:\n  serviceSubnet: 10.96.0.0/12\n",
+			want: Finding{Source: SourceKubeadm},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromKubeadm(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+func TestFromNodeCIDRs(t *testing.T) {
+	if got := FromNodeCIDRs([]string{"10.244.0.0/24", "fd00::/64", "10.244.1.0/24"}); got.NodeCIDRMaskSize != 24 {
+		t.Errorf("expected /24, got %+v", got)
+	}
+	if got := FromNodeCIDRs([]string{"10.244.0.0/24", "10.244.1.0/25"}); got.NodeCIDRMaskSize != 0 {
+		t.Errorf("expected no mask size for mixed blocks, got %+v", got)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	kubeadm := newKubeadmConfig("networking:\n  podSubnet: 10.244.0.0/16\n")
+	tests := []struct {
+		name    string
+		objs    []runtime.Object
+		want    Result
+		wantErr string
+	}{
+		{
+			name: "all sources agree",
+			objs: []runtime.Object{
+				kubeadm,
+				newKubeControllerManager("--allocate-node-cidrs=true", "--cluster-cidr=10.244.0.0/16"),
+				newNode("node-1", "10.244.3.0/24"),
+			},
+			want: Result{
+				ClusterCIDR:        "10.244.0.0/16",
+				NodeCIDRMaskSize:   24,
+				ClusterCIDRSources: []string{SourceKubeadm, SourceKubeControllerManager},
+				MaskSizeSources:    []string{SourceKubeControllerManager, SourceNodes},
+			},
+		},
+		{
+			name: "mask size from nodes",
+			objs: []runtime.Object{kubeadm, newNode("node-1", "10.244.0.0/26")},
+			want: Result{
+				ClusterCIDR:        "10.244.0.0/16",
+				NodeCIDRMaskSize:   26,
+				ClusterCIDRSources: []string{SourceKubeadm},
+				MaskSizeSources:    []string{SourceNodes},
+			},
+		},
+		{
+			name: "default mask size",
+			objs: []runtime.Object{kubeadm},
+			want: Result{
+				ClusterCIDR:        "10.244.0.0/16",
+				NodeCIDRMaskSize:   24,
+				ClusterCIDRSources: []string{SourceKubeadm},
+			},
+		},
+		{
+			name: "cluster CIDR conflict",
+			objs: []runtime.Object{
+				kubeadm,
+				newKubeControllerManager("--allocate-node-cidrs=true", "--cluster-cidr=10.245.0.0/16"),
+			},
+			wantErr: "disagree on the cluster CIDR",
+		},
+		{
+			name: "mask size conflict",
+			objs: []runtime.Object{
+				kubeadm,
+				newKubeControllerManager("--allocate-node-cidrs=true", "--cluster-cidr=10.244.0.0/16", "--node-cidr-mask-size=25"),
+				newNode("node-1", "10.244.0.0/24"),
+			},
+			wantErr: "disagree on the node mask size",
+		},
+		{
+			name:    "node outside the cluster CIDR",
+			objs:    []runtime.Object{kubeadm, newNode("node-1", "10.245.0.0/24")},
+			wantErr: "outside the discovered cluster CIDR",
+		},
+		{
+			name:    "no source",
+			objs:    []runtime.Object{newNode("node-1", "10.244.0.0/24")},
+			wantErr: "no source knows the cluster CIDR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Discover(context.Background(), fake.NewSimpleClientset(tt.objs...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.ClusterCIDR != tt.want.ClusterCIDR || got.NodeCIDRMaskSize != tt.want.NodeCIDRMaskSize ||
+				strings.Join(got.ClusterCIDRSources, ",") != strings.Join(tt.want.ClusterCIDRSources, ",") ||
+				strings.Join(got.MaskSizeSources, ",") != strings.Join(tt.want.MaskSizeSources, ",") {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
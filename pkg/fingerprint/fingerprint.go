@@ -0,0 +1,186 @@
+package fingerprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/state"
+)
+
+const (
+	// Key is the state ConfigMap key holding the fingerprint
+	Key = "fingerprint"
+	// LayoutKey is the state ConfigMap key holding the readable layout
+	LayoutKey = "layout"
+)
+
+// Layout returns a readable description of the settings that determine
+// where node CIDRs live: every pool's cluster CIDR and mask size, followed
+// by the range of per-node mask sizes when it is wider than the mask size
+func Layout(cfg *config.Configuration) string {
+	parts := make([]string, 0, len(cfg.Pools))
+	for _, p := range cfg.Pools {
+		part := fmt.Sprintf("%s=%s/%d", p.Name, p.ClusterCIDR, p.NodeCIDRMaskSize)
+		if minMaskSize, maxMaskSize := p.MaskSizeRange(); minMaskSize != maxMaskSize {
+			part += fmt.Sprintf(":%d-%d", minMaskSize, maxMaskSize)
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Compute returns the fingerprint of a configuration's layout
+func Compute(cfg *config.Configuration) string {
+	sum := sha256.Sum256([]byte(Layout(cfg)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Reason explains why a node is affected by a layout change
+type Reason string
+
+const (
+	// ReasonOutOfRange means the node's podCIDR is outside every pool
+	ReasonOutOfRange Reason = "OutOfRange"
+	// ReasonOverlap means the node's podCIDR lies in a pool but does not
+	// match its block layout, so new allocations can overlap it
+	ReasonOverlap Reason = "Overlap"
+)
+
+// Conflict is a node whose existing podCIDR does not fit the layout
+type Conflict struct {
+	Node    string
+	PodCIDR string
+	Reason  Reason
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("node %s podCIDR %s: %s", c.Node, c.PodCIDR, c.Reason)
+}
+
+// ParseLayout reverses Layout into the pools it describes
+func ParseLayout(layout string) ([]config.Pool, error) {
+	var pools []config.Pool
+	for _, part := range strings.Split(layout, ",") {
+		if part == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(part, "=")
+		rest, maskRange, hasRange := strings.Cut(rest, ":")
+		idx := strings.LastIndex(rest, "/")
+		if !ok || idx == -1 {
+			return nil, fmt.Errorf("invalid layout entry %q", part)
+		}
+		var maskSize int
+		if _, err := fmt.Sscanf(rest[idx+1:], "%d", &maskSize); err != nil {
+			return nil, fmt.Errorf("invalid layout entry %q: %w", part, err)
+		}
+		pool := config.Pool{Name: name, ClusterCIDR: rest[:idx], NodeCIDRMaskSize: maskSize}
+		if hasRange {
+			mp := &config.MaskSizePolicy{}
+			if _, err := fmt.Sscanf(maskRange, "%d-%d", &mp.MinNodeCIDRMaskSize, &mp.MaxNodeCIDRMaskSize); err != nil {
+				return nil, fmt.Errorf("invalid layout entry %q: %w", part, err)
+			}
+			pool.MaskSizePolicy = mp
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// Diff returns the nodes that fit the previous layout but would be out of
+// range or overlap under cfg. Nodes that already did not fit, such as nodes
+// whose podCIDR was assigned by another component, are not reported.
+func Diff(previousLayout string, cfg *config.Configuration, nodes []*corev1.Node) ([]Conflict, error) {
+	previous, err := ParseLayout(previousLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, c := range Check(previous, nodes) {
+		existing[c.Node] = true
+	}
+
+	var conflicts []Conflict
+	for _, c := range Check(cfg.Pools, nodes) {
+		if !existing[c.Node] {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts, nil
+}
+
+// Check returns the nodes whose podCIDR would not be a valid block of any
+// of the pools
+func Check(pools []config.Pool, nodes []*corev1.Node) []Conflict {
+	type poolNet struct {
+		ipnet       *net.IPNet
+		minMaskSize int
+		maxMaskSize int
+	}
+	nets := make([]poolNet, 0, len(pools))
+	for _, p := range pools {
+		if _, ipnet, err := net.ParseCIDR(p.ClusterCIDR); err == nil {
+			minMaskSize, maxMaskSize := p.MaskSizeRange()
+			nets = append(nets, poolNet{ipnet: ipnet, minMaskSize: minMaskSize, maxMaskSize: maxMaskSize})
+		}
+	}
+
+	var conflicts []Conflict
+	for _, node := range nodes {
+		if node.Spec.PodCIDR == "" {
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(node.Spec.PodCIDR)
+		if err != nil || ip.To4() == nil {
+			continue
+		}
+		maskSize, _ := ipnet.Mask.Size()
+
+		reason := ReasonOutOfRange
+		for _, p := range nets {
+			if !p.ipnet.Contains(ipnet.IP) && !ipnet.Contains(p.ipnet.IP) {
+				continue
+			}
+			if p.ipnet.Contains(ipnet.IP) && maskSize >= p.minMaskSize && maskSize <= p.maxMaskSize {
+				reason = ""
+			} else {
+				reason = ReasonOverlap
+			}
+			break
+		}
+		if reason != "" {
+			conflicts = append(conflicts, Conflict{Node: node.Name, PodCIDR: node.Spec.PodCIDR, Reason: reason})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Node < conflicts[j].Node })
+	return conflicts
+}
+
+// Load returns the stored fingerprint and layout, empty if none is stored
+func Load(ctx context.Context, store *state.Store) (string, string, error) {
+	cm, err := store.Get(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return cm.Data[Key], cm.Data[LayoutKey], nil
+}
+
+// Save stores the fingerprint of cfg
+func Save(ctx context.Context, store *state.Store, cfg *config.Configuration) error {
+	fp, layout := Compute(cfg), Layout(cfg)
+	return store.Update(ctx, func(cm *corev1.ConfigMap) {
+		cm.Data[Key] = fp
+		cm.Data[LayoutKey] = layout
+	})
+}
@@ -0,0 +1,152 @@
+package fingerprint
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/imroc/podcidr-controller/pkg/config"
+	"github.com/imroc/podcidr-controller/pkg/state"
+)
+
+func newConfig(clusterCIDR string, maskSize int) *config.Configuration {
+	cfg := &config.Configuration{
+		Pools: []config.Pool{{Name: "default", ClusterCIDR: clusterCIDR, NodeCIDRMaskSize: maskSize}},
+	}
+	cfg.SetDefaults()
+	return cfg
+}
+
+func newNode(name, podCIDR string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+	}
+}
+
+func TestCompute(t *testing.T) {
+	a := Compute(newConfig("10.244.0.0/16", 24))
+	if a != Compute(newConfig("10.244.0.0/16", 24)) {
+		t.Error("expected fingerprint to be stable")
+	}
+	if a == Compute(newConfig("10.244.0.0/16", 25)) {
+		t.Error("expected mask size change to change the fingerprint")
+	}
+	if a == Compute(newConfig("10.245.0.0/16", 24)) {
+		t.Error("expected cluster CIDR change to change the fingerprint")
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	cfg := newConfig("10.244.0.0/16", 24)
+	pools, err := ParseLayout(Layout(cfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pools) != 1 || pools[0].Name != "default" || pools[0].ClusterCIDR != "10.244.0.0/16" || pools[0].NodeCIDRMaskSize != 24 {
+		t.Errorf("unexpected pools %+v", pools)
+	}
+
+	cfg.Pools[0].MaskSizePolicy = &config.MaskSizePolicy{MinNodeCIDRMaskSize: 23, MaxNodeCIDRMaskSize: 26}
+	pools, err = ParseLayout(Layout(cfg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if minMaskSize, maxMaskSize := pools[0].MaskSizeRange(); minMaskSize != 23 || maxMaskSize != 26 {
+		t.Errorf("expected mask size range 23-26, got %d-%d", minMaskSize, maxMaskSize)
+	}
+
+	if _, err := ParseLayout("garbage"); err == nil {
+		t.Error("expected error for invalid layout")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg := newConfig("10.244.0.0/16", 24)
+	nodes := []*corev1.Node{
+		newNode("in-range", "10.244.1.0/24"),
+		newNode("no-cidr", ""),
+		newNode("out-of-range", "10.100.0.0/24"),
+		newNode("wrong-mask", "10.244.2.0/23"),
+	}
+
+	conflicts := Check(cfg.Pools, nodes)
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, got %v", conflicts)
+	}
+	if conflicts[0].Node != "out-of-range" || conflicts[0].Reason != ReasonOutOfRange {
+		t.Errorf("unexpected conflict %v", conflicts[0])
+	}
+	if conflicts[1].Node != "wrong-mask" || conflicts[1].Reason != ReasonOverlap {
+		t.Errorf("unexpected conflict %v", conflicts[1])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	previous := newConfig("10.244.0.0/16", 24)
+	nodes := []*corev1.Node{
+		newNode("node-1", "10.244.1.0/24"),
+		newNode("node-2", "10.244.200.0/24"),
+		newNode("external", "172.16.0.0/24"),
+	}
+
+	// Shrinking the range leaves node-2 out of range; the external node
+	// never fitted and is not reported
+	conflicts, err := Diff(Layout(previous), newConfig("10.244.0.0/17", 24), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Node != "node-2" || conflicts[0].Reason != ReasonOutOfRange {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+
+	// Changing the mask size makes every allocated node overlap
+	conflicts, _ = Diff(Layout(previous), newConfig("10.244.0.0/16", 25), nodes)
+	if len(conflicts) != 2 {
+		t.Errorf("expected 2 conflicts, got %v", conflicts)
+	}
+
+	// Allowing other mask sizes is safe for existing nodes
+	variable := newConfig("10.244.0.0/16", 24)
+	variable.Pools[0].MaskSizePolicy = &config.MaskSizePolicy{MinNodeCIDRMaskSize: 23, MaxNodeCIDRMaskSize: 26}
+	conflicts, _ = Diff(Layout(previous), variable, nodes)
+	if len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, got %v", conflicts)
+	}
+
+	// Expanding the range is safe
+	conflicts, _ = Diff(Layout(previous), newConfig("10.244.0.0/15", 24), nodes)
+	if len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, got %v", conflicts)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStore(fake.NewSimpleClientset(), "kube-system")
+
+	fp, layout, err := Load(ctx, store)
+	if err != nil || fp != "" || layout != "" {
+		t.Fatalf("expected empty fingerprint, got %q %q %v", fp, layout, err)
+	}
+
+	cfg := newConfig("10.244.0.0/16", 24)
+	if err := Save(ctx, store, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Saving again updates the existing ConfigMap
+	if err := Save(ctx, store, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fp, layout, err = Load(ctx, store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fp != Compute(cfg) || layout != Layout(cfg) {
+		t.Errorf("unexpected fingerprint %q layout %q", fp, layout)
+	}
+}
@@ -0,0 +1,113 @@
+// Package kcm reads the range allocator settings of kube-controller-manager
+// from its static pod
+package kcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrNotFound is returned when no kube-controller-manager pod is visible,
+// e.g. on managed control planes
+var ErrNotFound = errors.New("no kube-controller-manager pod found")
+
+// defaultMaskSize is the IPv4 node mask size of kube-controller-manager
+const defaultMaskSize = 24
+
+// Settings are the range allocator flags of a kube-controller-manager pod
+type Settings struct {
+	Pod               string
+	AllocateNodeCIDRs bool
+	// ClusterCIDR is the IPv4 range of --cluster-cidr, empty if unset
+	ClusterCIDR      string
+	NodeCIDRMaskSize int
+}
+
+// Find returns the settings of the kube-controller-manager pods in
+// kube-system, found by the component label of kubeadm and most static
+// pod manifests. All pods must agree.
+func Find(ctx context.Context, client kubernetes.Interface) (*Settings, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{
+		LabelSelector: "component=kube-controller-manager",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var found *Settings
+	for i := range pods.Items {
+		s, ok := FromPod(&pods.Items[i])
+		if !ok {
+			continue
+		}
+		if found != nil && (found.ClusterCIDR != s.ClusterCIDR || found.NodeCIDRMaskSize != s.NodeCIDRMaskSize ||
+			found.AllocateNodeCIDRs != s.AllocateNodeCIDRs) {
+			return nil, fmt.Errorf("kube-controller-manager pods %s and %s have different settings", found.Pod, s.Pod)
+		}
+		found = s
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// FromPod returns the settings of a kube-controller-manager pod, and false
+// if it has no kube-controller-manager container
+func FromPod(pod *corev1.Pod) (*Settings, bool) {
+	for _, container := range pod.Spec.Containers {
+		args := append(append([]string(nil), container.Command...), container.Args...)
+		if len(args) == 0 || !strings.HasSuffix(args[0], "kube-controller-manager") {
+			continue
+		}
+		s := Parse(args[1:])
+		s.Pod = pod.Name
+		return s, true
+	}
+	return nil, false
+}
+
+// Parse reads the range allocator settings from kube-controller-manager
+// arguments
+func Parse(args []string) *Settings {
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		name, ok := strings.CutPrefix(args[i], "--")
+		if !ok {
+			continue
+		}
+		if name, value, ok := strings.Cut(name, "="); ok {
+			flags[name] = value
+			continue
+		}
+		// Booleans may omit the value; others take the next argument
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") && name != "allocate-node-cidrs" {
+			flags[name] = args[i+1]
+			i++
+			continue
+		}
+		flags[name] = "true"
+	}
+
+	s := &Settings{NodeCIDRMaskSize: defaultMaskSize}
+	s.AllocateNodeCIDRs, _ = strconv.ParseBool(flags["allocate-node-cidrs"])
+	for _, c := range strings.Split(flags["cluster-cidr"], ",") {
+		if ip, _, err := net.ParseCIDR(strings.TrimSpace(c)); err == nil && ip.To4() != nil {
+			s.ClusterCIDR = strings.TrimSpace(c)
+			break
+		}
+	}
+	for _, name := range []string{"node-cidr-mask-size", "node-cidr-mask-size-ipv4"} {
+		if size, err := strconv.Atoi(flags[name]); err == nil {
+			s.NodeCIDRMaskSize = size
+		}
+	}
+	return s
+}
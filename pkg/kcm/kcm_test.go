@@ -0,0 +1,77 @@
+package kcm
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want Settings
+	}{
+		{
+			name: "defaults",
+			args: nil,
+			want: Settings{NodeCIDRMaskSize: 24},
+		},
+		{
+			name: "equals form",
+			args: []string{"--allocate-node-cidrs=true", "--cluster-cidr=10.244.0.0/16", "--node-cidr-mask-size=25"},
+			want: Settings{AllocateNodeCIDRs: true, ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 25},
+		},
+		{
+			name: "separate values and bare boolean",
+			args: []string{"--allocate-node-cidrs", "--cluster-cidr", "10.244.0.0/16", "--v", "2"},
+			want: Settings{AllocateNodeCIDRs: true, ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 24},
+		},
+		{
+			name: "dual-stack",
+			args: []string{"--allocate-node-cidrs=true", "--cluster-cidr=fd00::/48,10.244.0.0/16",
+				"--node-cidr-mask-size-ipv4=26", "--node-cidr-mask-size-ipv6=64"},
+			want: Settings{AllocateNodeCIDRs: true, ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 26},
+		},
+		{
+			name: "allocation disabled",
+			args: []string{"--allocate-node-cidrs=false", "--cluster-cidr=10.244.0.0/16"},
+			want: Settings{ClusterCIDR: "10.244.0.0/16", NodeCIDRMaskSize: 24},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.args); *got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+func TestFromPod(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-controller-manager-master-1"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "sidecar", Command: []string{"/bin/sh"}},
+			{
+				Name:    "kube-controller-manager",
+				Command: []string{"/usr/local/bin/kube-controller-manager"},
+				Args:    []string{"--allocate-node-cidrs=true", "--cluster-cidr=10.244.0.0/16"},
+			},
+		}},
+	}
+	s, ok := FromPod(pod)
+	if !ok {
+		t.Fatal("expected the kube-controller-manager container to be found")
+	}
+	if s.Pod != pod.Name || !s.AllocateNodeCIDRs || s.ClusterCIDR != "10.244.0.0/16" {
+		t.Errorf("unexpected settings %+v", *s)
+	}
+
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	if _, ok := FromPod(pod); ok {
+		t.Error("expected no settings without a kube-controller-manager container")
+	}
+}
@@ -0,0 +1,100 @@
+package masksize
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Key is the annotation or label that requests a node CIDR mask size
+	Key = "podcidr.imroc.io/node-cidr-mask-size"
+
+	// InstanceTypeLabel is the well-known label matched against Policy.InstanceTypes
+	InstanceTypeLabel = corev1.LabelInstanceTypeStable
+)
+
+// Source tells which rule of a Policy decided a node's mask size
+type Source string
+
+const (
+	SourceAnnotation   Source = "annotation"
+	SourceLabel        Source = "label"
+	SourceInstanceType Source = "instance-type"
+	SourcePodCapacity  Source = "pod-capacity"
+	SourceDefault      Source = "default"
+)
+
+// Policy decides the mask size of each node's CIDR. Rules are evaluated in
+// order: the annotation, the label, the instance type table, the node's pod
+// capacity and finally the default.
+type Policy struct {
+	Default int
+	// Min and Max bound the sizes a node can receive. Min is the largest
+	// block (smallest mask), Max the smallest block.
+	Min int
+	Max int
+
+	InstanceTypes   map[string]int
+	FromPodCapacity bool
+}
+
+// Fixed returns a Policy that gives every node the same mask size
+func Fixed(maskSize int) *Policy {
+	return &Policy{Default: maskSize, Min: maskSize, Max: maskSize}
+}
+
+// For returns the mask size for a node and the rule that decided it.
+// An annotation or label outside [Min, Max] is an error rather than being
+// silently replaced, since the node explicitly asked for it.
+func (p *Policy) For(node *corev1.Node) (int, Source, error) {
+	if v, ok := node.Annotations[Key]; ok {
+		size, err := p.parse(v)
+		return size, SourceAnnotation, err
+	}
+	if v, ok := node.Labels[Key]; ok {
+		size, err := p.parse(v)
+		return size, SourceLabel, err
+	}
+	if size, ok := p.InstanceTypes[node.Labels[InstanceTypeLabel]]; ok {
+		return size, SourceInstanceType, nil
+	}
+	if p.FromPodCapacity {
+		if pods, ok := node.Status.Capacity[corev1.ResourcePods]; ok && pods.Value() > 0 {
+			return p.clamp(ForPods(pods.Value())), SourcePodCapacity, nil
+		}
+	}
+	return p.Default, SourceDefault, nil
+}
+
+func (p *Policy) parse(v string) (int, error) {
+	size, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", Key, v)
+	}
+	if size < p.Min || size > p.Max {
+		return 0, fmt.Errorf("%s %d is outside the allowed range /%d-/%d", Key, size, p.Min, p.Max)
+	}
+	return size, nil
+}
+
+func (p *Policy) clamp(size int) int {
+	if size < p.Min {
+		return p.Min
+	}
+	if size > p.Max {
+		return p.Max
+	}
+	return size
+}
+
+// ForPods returns the longest mask whose block leaves an address for every
+// pod after the network and broadcast addresses
+func ForPods(pods int64) int {
+	size := 32
+	for size > 0 && int64(1)<<(32-size)-2 < pods {
+		size--
+	}
+	return size
+}
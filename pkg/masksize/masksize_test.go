@@ -0,0 +1,65 @@
+package masksize
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newNode(annotations, labels map[string]string, pods string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: annotations, Labels: labels}}
+	if pods != "" {
+		node.Status.Capacity = corev1.ResourceList{corev1.ResourcePods: resource.MustParse(pods)}
+	}
+	return node
+}
+
+func TestFor(t *testing.T) {
+	policy := &Policy{
+		Default:         24,
+		Min:             23,
+		Max:             26,
+		InstanceTypes:   map[string]int{"edge.small": 26},
+		FromPodCapacity: true,
+	}
+
+	tests := []struct {
+		name     string
+		node     *corev1.Node
+		expected int
+		source   Source
+		wantErr  bool
+	}{
+		{"default", newNode(nil, nil, ""), 24, SourceDefault, false},
+		{"annotation", newNode(map[string]string{Key: "25"}, map[string]string{InstanceTypeLabel: "edge.small"}, ""), 25, SourceAnnotation, false},
+		{"label", newNode(nil, map[string]string{Key: "23"}, ""), 23, SourceLabel, false},
+		{"instance type", newNode(nil, map[string]string{InstanceTypeLabel: "edge.small"}, "500"), 26, SourceInstanceType, false},
+		{"pod capacity", newNode(nil, nil, "300"), 23, SourcePodCapacity, false},
+		{"pod capacity clamped", newNode(nil, nil, "10"), 26, SourcePodCapacity, false},
+		{"annotation out of range", newNode(map[string]string{Key: "20"}, nil, ""), 0, SourceAnnotation, true},
+		{"annotation invalid", newNode(map[string]string{Key: "big"}, nil, ""), 0, SourceAnnotation, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, source, err := policy.For(tt.node)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if size != tt.expected || source != tt.source {
+				t.Errorf("expected /%d from %s, got /%d from %s", tt.expected, tt.source, size, source)
+			}
+		})
+	}
+}
+
+func TestForPods(t *testing.T) {
+	tests := map[int64]int{110: 25, 126: 25, 127: 24, 254: 24, 255: 23, 500: 23}
+	for pods, expected := range tests {
+		if got := ForPods(pods); got != expected {
+			t.Errorf("ForPods(%d): expected /%d, got /%d", pods, expected, got)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type is the Prometheus type of a metric
+type Type string
+
+const (
+	Gauge   Type = "gauge"
+	Counter Type = "counter"
+)
+
+// Desc describes a metric family
+type Desc struct {
+	Name   string
+	Help   string
+	Type   Type
+	Labels []string
+}
+
+// Sample is one value of a metric family, with label values in the order
+// of Desc.Labels
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Collector produces the samples of a metric family when scraped
+type Collector interface {
+	Describe() Desc
+	Collect() []Sample
+}
+
+// GaugeFunc is a gauge whose samples are computed at scrape time, for
+// values the controller already tracks such as pool usage
+type GaugeFunc struct {
+	desc    Desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc creates a gauge computed by collect
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    Desc{Name: name, Help: help, Type: Gauge, Labels: labels},
+		collect: collect,
+	}
+}
+
+func (g *GaugeFunc) Describe() Desc {
+	return g.desc
+}
+
+func (g *GaugeFunc) Collect() []Sample {
+	return g.collect()
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	desc Desc
+
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+// NewCounterVec creates a counter with the given labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		desc:   Desc{Name: name, Help: help, Type: Counter, Labels: labels},
+		values: map[string]*Sample{},
+	}
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter with the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &Sample{LabelValues: append([]string(nil), labelValues...)}
+		c.values[key] = s
+	}
+	s.Value += v
+}
+
+// Value returns the counter with the given label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return s.Value
+	}
+	return 0
+}
+
+func (c *CounterVec) Describe() Desc {
+	return c.desc
+}
+
+func (c *CounterVec) Collect() []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	return samples
+}
+
+// Registry holds collectors and serves them in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// MustRegister adds collectors, panicking on a duplicate metric name
+func (r *Registry) MustRegister(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range collectors {
+		name := c.Describe().Name
+		for _, existing := range r.collectors {
+			if existing.Describe().Name == name {
+				panic(fmt.Sprintf("metric %s is already registered", name))
+			}
+		}
+		r.collectors = append(r.collectors, c)
+	}
+}
+
+// ServeHTTP writes every registered metric family, sorted by name
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].Describe().Name < collectors[j].Describe().Name
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		writeFamily(bw, c.Describe(), c.Collect())
+	}
+	_ = bw.Flush()
+}
+
+func writeFamily(w *bufio.Writer, desc Desc, samples []Sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", desc.Name, escapeHelp(desc.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", desc.Name, desc.Type)
+
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		var b strings.Builder
+		b.WriteString(desc.Name)
+		if len(desc.Labels) > 0 {
+			b.WriteByte('{')
+			for i, label := range desc.Labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				value := ""
+				if i < len(s.LabelValues) {
+					value = s.LabelValues[i]
+				}
+				fmt.Fprintf(&b, "%s=\"%s\"", label, escapeLabelValue(value))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		lines = append(lines, b.String())
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
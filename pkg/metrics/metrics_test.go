@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(
+		NewGaugeFunc("test_used", "Blocks in use", []string{"pool"}, func() []Sample {
+			return []Sample{
+				{LabelValues: []string{"b"}, Value: 2},
+				{LabelValues: []string{`a"1`}, Value: 0.5},
+			}
+		}),
+		NewGaugeFunc("test_info", "Line one\nline two", nil, func() []Sample {
+			return []Sample{{Value: 1}}
+		}),
+	)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_info Line one\nline two
+# TYPE test_info gauge
+test_info 1
+# HELP test_used Blocks in use
+# TYPE test_used gauge
+test_used{pool="a\"1"} 0.5
+test_used{pool="b"} 2
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMustRegisterDuplicate(t *testing.T) {
+	r := NewRegistry()
+	g := NewGaugeFunc("test_used", "", nil, func() []Sample { return nil })
+	r.MustRegister(g)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on duplicate registration")
+		}
+	}()
+	r.MustRegister(g)
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_syncs_total", "Syncs", "controller", "result")
+	c.Inc("a", "success")
+	c.Add(2, "a", "success")
+	c.Inc("a", "error")
+
+	if v := c.Value("a", "success"); v != 3 {
+		t.Errorf("expected 3, got %v", v)
+	}
+
+	r := NewRegistry()
+	r.MustRegister(c)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP test_syncs_total Syncs
+# TYPE test_syncs_total counter
+test_syncs_total{controller="a",result="error"} 1
+test_syncs_total{controller="a",result="success"} 3
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package selector
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	corev1 "k8s.io/api/core/v1"
@@ -35,6 +36,36 @@ func Parse(jsonStr string) (*NodeSelector, error) {
 	return s, nil
 }
 
+// Validate checks that every expression uses a known operator with the
+// values it requires
+func (s *NodeSelector) Validate() error {
+	for i, expr := range s.MatchExpressions {
+		if expr.Key == "" {
+			return fmt.Errorf("expression %d: empty key", i)
+		}
+		switch expr.Operator {
+		case "In", "NotIn":
+			if len(expr.Values) == 0 {
+				return fmt.Errorf("expression %d: operator %s requires values", i, expr.Operator)
+			}
+		case "Exists", "DoesNotExist":
+			if len(expr.Values) != 0 {
+				return fmt.Errorf("expression %d: operator %s takes no values", i, expr.Operator)
+			}
+		case "Gt", "Lt":
+			if len(expr.Values) != 1 {
+				return fmt.Errorf("expression %d: operator %s requires a single value", i, expr.Operator)
+			}
+			if _, err := strconv.ParseInt(expr.Values[0], 10, 64); err != nil {
+				return fmt.Errorf("expression %d: operator %s requires an integer value", i, expr.Operator)
+			}
+		default:
+			return fmt.Errorf("expression %d: unknown operator %q", i, expr.Operator)
+		}
+	}
+	return nil
+}
+
 // Matches returns true if the node matches all expressions (AND logic)
 // Empty selector matches all nodes
 func (s *NodeSelector) Matches(node *corev1.Node) bool {
@@ -218,3 +218,33 @@ func TestMatchesMultipleExpressions(t *testing.T) {
 		t.Error("expected node failing second condition to not match")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"empty", ``, false},
+		{"valid In", `[{"key":"a","operator":"In","values":["x"]}]`, false},
+		{"valid Exists", `[{"key":"a","operator":"Exists"}]`, false},
+		{"valid Gt", `[{"key":"a","operator":"Gt","values":["3"]}]`, false},
+		{"unknown operator", `[{"key":"a","operator":"Equals","values":["x"]}]`, true},
+		{"In without values", `[{"key":"a","operator":"In"}]`, true},
+		{"Exists with values", `[{"key":"a","operator":"Exists","values":["x"]}]`, true},
+		{"Gt with non-integer", `[{"key":"a","operator":"Gt","values":["x"]}]`, true},
+		{"empty key", `[{"key":"","operator":"Exists"}]`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.json)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if err := s.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MemberLabel marks the Leases that replicas use to announce themselves
+	MemberLabel = "podcidr.imroc.io/member"
+)
+
+// Callbacks are invoked when this replica gains or loses a shard.
+// OnStoppedLeading is always called before the shard Lease is released.
+type Callbacks struct {
+	OnStartedLeading func(shard string)
+	OnStoppedLeading func(shard string)
+}
+
+// Config holds the settings for a Manager
+type Config struct {
+	Client        kubernetes.Interface
+	Namespace     string
+	Identity      string
+	LeasePrefix   string
+	Shards        []string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+	Callbacks     Callbacks
+}
+
+// Manager spreads shard ownership across live replicas. Every replica
+// heartbeats a member Lease; the preferred owner of each shard, chosen by
+// rendezvous hashing over live members, campaigns for that shard's Lease.
+// The shard Lease guarantees a single owner at any time.
+type Manager struct {
+	config Config
+
+	mu        sync.Mutex
+	campaigns map[string]*campaign
+}
+
+type campaign struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopping is set once the shard is being handed over, guarded by the
+	// Manager's mu
+	stopping bool
+
+	// mu orders the callbacks of a campaign. It is never held with the
+	// Manager's mu, so a slow callback does not stall heartbeats.
+	mu    sync.Mutex
+	owned bool
+}
+
+// NewManager creates a Manager
+func NewManager(config Config) *Manager {
+	return &Manager{
+		config:    config,
+		campaigns: make(map[string]*campaign),
+	}
+}
+
+// Run heartbeats membership and rebalances shards until ctx is cancelled
+func (m *Manager) Run(ctx context.Context) {
+	klog.Infof("Starting shard manager for %d shards as %s", len(m.config.Shards), m.config.Identity)
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := m.heartbeat(ctx); err != nil {
+			klog.Warningf("Failed to renew member lease: %v", err)
+		}
+		members, err := m.liveMembers(ctx)
+		if err != nil {
+			klog.Warningf("Failed to list members: %v", err)
+			return
+		}
+		m.rebalance(ctx, members)
+	}, m.config.RetryPeriod)
+
+	m.stopAll()
+
+	// Leave the member set so the remaining replicas pick up our shards immediately
+	deleteCtx, cancel := context.WithTimeout(context.Background(), m.config.RenewDeadline)
+	defer cancel()
+	err := m.config.Client.CoordinationV1().Leases(m.config.Namespace).Delete(deleteCtx, m.memberLeaseName(), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Warningf("Failed to delete member lease: %v", err)
+	}
+}
+
+func (m *Manager) memberLeaseName() string {
+	return fmt.Sprintf("%s-member-%s", m.config.LeasePrefix, strings.ToLower(m.config.Identity))
+}
+
+func (m *Manager) heartbeat(ctx context.Context) error {
+	leases := m.config.Client.CoordinationV1().Leases(m.config.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(m.config.LeaseDuration.Seconds())
+
+	lease, err := leases.Get(ctx, m.memberLeaseName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.memberLeaseName(),
+				Namespace: m.config.Namespace,
+				Labels:    map[string]string{MemberLabel: m.config.LeasePrefix},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.config.Identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = &m.config.Identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (m *Manager) liveMembers(ctx context.Context) ([]string, error) {
+	list, err := m.config.Client.CoordinationV1().Leases(m.config.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", MemberLabel, m.config.LeasePrefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	members := []string{m.config.Identity}
+	for _, lease := range list.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		if *spec.HolderIdentity == m.config.Identity {
+			continue
+		}
+		expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if expiry.After(now) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (m *Manager) rebalance(ctx context.Context, members []string) {
+	for _, name := range m.config.Shards {
+		preferred := Preferred(name, members) == m.config.Identity
+
+		m.mu.Lock()
+		c, running := m.campaigns[name]
+		m.mu.Unlock()
+
+		switch {
+		case preferred && !running:
+			m.start(ctx, name)
+		case !preferred && running:
+			m.mu.Lock()
+			stopping := c.stopping
+			c.stopping = true
+			m.mu.Unlock()
+			if stopping {
+				continue
+			}
+			// Dropping ownership waits for in-flight allocations; the
+			// heartbeat goes on meanwhile
+			klog.Infof("Handing over shard %s", name)
+			go m.stop(name, c)
+		}
+	}
+}
+
+func (m *Manager) start(ctx context.Context, name string) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &campaign{cancel: cancel, done: make(chan struct{})}
+
+	m.mu.Lock()
+	m.campaigns[name] = c
+	m.mu.Unlock()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%s", m.config.LeasePrefix, name),
+			Namespace: m.config.Namespace,
+		},
+		Client: m.config.Client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: m.config.Identity,
+		},
+	}
+
+	go func() {
+		defer close(c.done)
+		defer func() {
+			m.mu.Lock()
+			if m.campaigns[name] == c {
+				delete(m.campaigns, name)
+			}
+			m.mu.Unlock()
+		}()
+
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   m.config.LeaseDuration,
+			RenewDeadline:   m.config.RenewDeadline,
+			RetryPeriod:     m.config.RetryPeriod,
+			Name:            name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					if ctx.Err() != nil || c.owned {
+						return
+					}
+					c.owned = true
+					klog.Infof("Acquired shard %s", name)
+					m.config.Callbacks.OnStartedLeading(name)
+				},
+				OnStoppedLeading: func() {
+					m.release(name, c)
+				},
+			},
+		})
+	}()
+}
+
+// stop gives up a shard: ownership is dropped before the Lease is released
+// so that the next owner never overlaps with in-flight allocations here.
+func (m *Manager) stop(name string, c *campaign) {
+	m.release(name, c)
+	c.cancel()
+	<-c.done
+}
+
+func (m *Manager) release(name string, c *campaign) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.owned {
+		return
+	}
+	c.owned = false
+	klog.Infof("Released shard %s", name)
+	m.config.Callbacks.OnStoppedLeading(name)
+}
+
+func (m *Manager) stopAll() {
+	m.mu.Lock()
+	campaigns := make(map[string]*campaign, len(m.campaigns))
+	for name, c := range m.campaigns {
+		campaigns[name] = c
+	}
+	m.mu.Unlock()
+
+	for name, c := range campaigns {
+		m.stop(name, c)
+	}
+}
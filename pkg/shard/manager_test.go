@@ -0,0 +1,236 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// owners records which shards each test replica owns
+type owners struct {
+	mu    sync.Mutex
+	owned map[string]string
+	// block makes OnStoppedLeading wait until it is closed
+	block chan struct{}
+}
+
+func (o *owners) callbacks(id string) Callbacks {
+	return Callbacks{
+		OnStartedLeading: func(shard string) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.owned[shard] = id
+		},
+		OnStoppedLeading: func(shard string) {
+			if o.block != nil {
+				<-o.block
+			}
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			if o.owned[shard] == id {
+				delete(o.owned, shard)
+			}
+		},
+	}
+}
+
+func (o *owners) get() map[string]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	owned := make(map[string]string, len(o.owned))
+	for shard, id := range o.owned {
+		owned[shard] = id
+	}
+	return owned
+}
+
+func newTestManager(client kubernetes.Interface, id string, shards []string, o *owners) *Manager {
+	return NewManager(Config{
+		Client:        client,
+		Namespace:     "kube-system",
+		Identity:      id,
+		LeasePrefix:   "podcidr-controller",
+		Shards:        shards,
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+		Callbacks:     o.callbacks(id),
+	})
+}
+
+func waitFor(cond func() bool) error {
+	return wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 10*time.Second, true,
+		func(context.Context) (bool, error) { return cond(), nil })
+}
+
+func TestLiveMembers(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	m := newTestManager(client, "a", nil, &owners{owned: map[string]string{}})
+
+	if err := m.heartbeat(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lease, err := client.CoordinationV1().Leases("kube-system").Get(ctx, "podcidr-controller-member-a", metav1.GetOptions{})
+	if err != nil || lease.Labels[MemberLabel] != "podcidr-controller" {
+		t.Fatalf("expected a labelled member lease, got %+v, %v", lease, err)
+	}
+	// Renewing updates the same lease
+	if err := m.heartbeat(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	member := func(id string, renewed time.Time) *coordinationv1.Lease {
+		duration := int32(10)
+		renewTime := metav1.NewMicroTime(renewed)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "podcidr-controller-member-" + id,
+				Namespace: "kube-system",
+				Labels:    map[string]string{MemberLabel: "podcidr-controller"},
+			},
+			Spec: coordinationv1.LeaseSpec{HolderIdentity: &id, LeaseDurationSeconds: &duration, RenewTime: &renewTime},
+		}
+	}
+	for _, lease := range []*coordinationv1.Lease{member("c", time.Now()), member("b", time.Now().Add(-time.Minute))} {
+		if _, err := client.CoordinationV1().Leases("kube-system").Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	members, err := m.liveMembers(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := fmt.Sprint(members); got != "[a c]" {
+		t.Errorf("expected the live members [a c], got %s", got)
+	}
+}
+
+func TestManagerHandsOverShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	shards := []string{"default-0", "default-1", "default-2", "default-3"}
+	o := &owners{owned: map[string]string{}}
+
+	runA, stopA := context.WithCancel(ctx)
+	defer stopA()
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		newTestManager(client, "a", shards, o).Run(runA)
+	}()
+	if err := waitFor(func() bool { return len(o.get()) == len(shards) }); err != nil {
+		t.Fatalf("expected a single replica to own every shard, got %v", o.get())
+	}
+
+	// A joining replica takes over the shards it is preferred for
+	runB, stopB := context.WithCancel(ctx)
+	doneB := make(chan struct{})
+	go func() {
+		defer close(doneB)
+		newTestManager(client, "b", shards, o).Run(runB)
+	}()
+	if err := waitFor(func() bool {
+		owned := o.get()
+		for _, s := range shards {
+			if owned[s] != Preferred(s, []string{"a", "b"}) {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("expected shards to be spread by rendezvous hashing, got %v", o.get())
+	}
+
+	// A leaving replica hands its shards back
+	stopB()
+	<-doneB
+	if err := waitFor(func() bool {
+		owned := o.get()
+		for _, s := range shards {
+			if owned[s] != "a" {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("expected the remaining replica to own every shard, got %v", o.get())
+	}
+	if _, err := client.CoordinationV1().Leases("kube-system").Get(ctx, "podcidr-controller-member-b", metav1.GetOptions{}); err == nil {
+		t.Error("expected the leaving replica to delete its member lease")
+	}
+
+	stopA()
+	<-doneA
+	if owned := o.get(); len(owned) != 0 {
+		t.Errorf("expected every shard to be released on shutdown, got %v", owned)
+	}
+}
+
+func TestManagerHeartbeatsDuringHandover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	o := &owners{owned: map[string]string{}, block: make(chan struct{})}
+	m := newTestManager(client, "a", []string{"default-0"}, o)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	if err := waitFor(func() bool { return o.get()["default-0"] == "a" }); err != nil {
+		t.Fatal("expected the shard to be acquired")
+	}
+
+	// A preferred member joins, and releasing the shard is slow
+	id := "b"
+	for Preferred("default-0", []string{"a", id}) != id {
+		id += "b"
+	}
+	duration := int32(60)
+	renewTime := metav1.NewMicroTime(time.Now())
+	if _, err := client.CoordinationV1().Leases("kube-system").Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "podcidr-controller-member-" + id,
+			Namespace: "kube-system",
+			Labels:    map[string]string{MemberLabel: "podcidr-controller"},
+		},
+		Spec: coordinationv1.LeaseSpec{HolderIdentity: &id, LeaseDurationSeconds: &duration, RenewTime: &renewTime},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	renewed := func() time.Time {
+		lease, err := client.CoordinationV1().Leases("kube-system").Get(ctx, "podcidr-controller-member-a", metav1.GetOptions{})
+		if err != nil || lease.Spec.RenewTime == nil {
+			return time.Time{}
+		}
+		return lease.Spec.RenewTime.Time
+	}
+	time.Sleep(300 * time.Millisecond)
+	before := renewed()
+	if err := waitFor(func() bool { return renewed().After(before.Add(200 * time.Millisecond)) }); err != nil {
+		t.Error("expected heartbeats to go on while the shard is being released")
+	}
+
+	close(o.block)
+	if err := waitFor(func() bool { return o.get()["default-0"] == "" }); err != nil {
+		t.Error("expected the shard to be released")
+	}
+}
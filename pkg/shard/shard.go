@@ -0,0 +1,37 @@
+package shard
+
+import (
+	"hash/fnv"
+)
+
+// ForNode returns the index of the shard that a node belongs to.
+// Nodes are spread across shards by a hash of their name.
+func ForNode(nodeName string, count int) int {
+	if count <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(nodeName))
+	return int(h.Sum32() % uint32(count))
+}
+
+// Preferred returns the member that should own a shard using rendezvous
+// hashing, so that only the shards of a joining or leaving member move.
+// Returns empty string if there are no members.
+func Preferred(shardName string, members []string) string {
+	var (
+		best      string
+		bestScore uint64
+	)
+	for _, m := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(shardName))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(m))
+		score := h.Sum64()
+		if best == "" || score > bestScore || (score == bestScore && m < best) {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
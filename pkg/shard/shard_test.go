@@ -0,0 +1,67 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestForNode(t *testing.T) {
+	if got := ForNode("node-1", 1); got != 0 {
+		t.Errorf("expected shard 0 with a single shard, got %d", got)
+	}
+
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		idx := ForNode(fmt.Sprintf("node-%d", i), 4)
+		if idx < 0 || idx >= 4 {
+			t.Fatalf("shard index %d out of range", idx)
+		}
+		counts[idx]++
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Errorf("shard %d received no nodes", i)
+		}
+	}
+
+	if ForNode("node-42", 4) != ForNode("node-42", 4) {
+		t.Error("expected shard assignment to be stable")
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	if got := Preferred("default-0", nil); got != "" {
+		t.Errorf("expected no owner without members, got %q", got)
+	}
+
+	members := []string{"a", "b", "c"}
+	owner := Preferred("default-0", members)
+	if owner == "" {
+		t.Fatal("expected an owner")
+	}
+
+	// Order of members must not matter
+	if got := Preferred("default-0", []string{"c", "a", "b"}); got != owner {
+		t.Errorf("expected %q regardless of member order, got %q", owner, got)
+	}
+}
+
+func TestPreferredMinimalMovement(t *testing.T) {
+	shards := make([]string, 32)
+	for i := range shards {
+		shards[i] = fmt.Sprintf("default-%d", i)
+	}
+
+	before := map[string]string{}
+	for _, s := range shards {
+		before[s] = Preferred(s, []string{"a", "b", "c"})
+	}
+
+	// Removing member "c" must only move the shards that "c" owned
+	for _, s := range shards {
+		after := Preferred(s, []string{"a", "b"})
+		if before[s] != "c" && after != before[s] {
+			t.Errorf("shard %s moved from %s to %s", s, before[s], after)
+		}
+	}
+}
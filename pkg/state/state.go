@@ -0,0 +1,75 @@
+package state
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Name is the name of the ConfigMap that holds the controller's state
+const Name = "podcidr-controller"
+
+// Store reads and writes the controller's state ConfigMap
+type Store struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewStore creates a Store for the state ConfigMap in namespace
+func NewStore(client kubernetes.Interface, namespace string) *Store {
+	return &Store{client: client, namespace: namespace}
+}
+
+// Namespace returns the namespace of the state ConfigMap
+func (s *Store) Namespace() string {
+	return s.namespace
+}
+
+// Get returns the state ConfigMap, or an empty one if it does not exist yet
+func (s *Store) Get(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm, _, err := s.get(ctx)
+	return cm, err
+}
+
+func (s *Store) get(ctx context.Context) (*corev1.ConfigMap, bool, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: Name, Namespace: s.namespace},
+		}, false, nil
+	}
+	return cm, err == nil, err
+}
+
+// Update applies mutate to the state ConfigMap, creating it if needed and
+// retrying on conflicts
+func (s *Store) Update(ctx context.Context, mutate func(cm *corev1.ConfigMap)) error {
+	conflict := func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, conflict, func() error {
+		cm, exists, err := s.get(ctx)
+		if err != nil {
+			return err
+		}
+		cm = cm.DeepCopy()
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		mutate(cm)
+
+		if !exists {
+			_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
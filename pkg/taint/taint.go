@@ -28,7 +28,13 @@ func NewTaintRemover(config string) (*TaintRemover, error) {
 		return nil, nil
 	}
 
-	parts := strings.Split(config, ",")
+	return NewTaintRemoverFromList(strings.Split(config, ","))
+}
+
+// NewTaintRemoverFromList creates TaintRemover from a list of rule strings
+// in the same formats accepted by NewTaintRemover
+// Returns nil if the list contains no rules
+func NewTaintRemoverFromList(parts []string) (*TaintRemover, error) {
 	rules := make([]TaintRule, 0, len(parts))
 
 	for _, part := range parts {
@@ -171,6 +177,17 @@ func FilterOutTaints(taints []corev1.Taint, toRemove []corev1.Taint) []corev1.Ta
 	return result
 }
 
+// HasTaint reports whether taints contains a taint with the same key, value
+// and effect
+func HasTaint(taints []corev1.Taint, taint corev1.Taint) bool {
+	for _, t := range taints {
+		if taintKey(t) == taintKey(taint) {
+			return true
+		}
+	}
+	return false
+}
+
 // taintKey returns a unique key for a taint
 func taintKey(t corev1.Taint) string {
 	return fmt.Sprintf("%s=%s:%s", t.Key, t.Value, t.Effect)
@@ -81,6 +81,25 @@ func TestNewTaintRemover(t *testing.T) {
 	}
 }
 
+func TestNewTaintRemoverFromList(t *testing.T) {
+	remover, err := NewTaintRemoverFromList([]string{"key1", " key2:NoSchedule ", ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if remover == nil || len(remover.rules) != 2 {
+		t.Fatalf("expected 2 rules, got %+v", remover)
+	}
+
+	remover, err = NewTaintRemoverFromList(nil)
+	if err != nil || remover != nil {
+		t.Errorf("expected nil remover for empty list, got %+v, %v", remover, err)
+	}
+
+	if _, err := NewTaintRemoverFromList([]string{"=value:NoSchedule"}); err == nil {
+		t.Error("expected error for rule with empty key")
+	}
+}
+
 func TestParseRule(t *testing.T) {
 	noSchedule := corev1.TaintEffectNoSchedule
 	noExecute := corev1.TaintEffectNoExecute
@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// MutateNodePath is where the node mutating webhook is served
+const MutateNodePath = "/mutate-node"
+
+// maxRequestBytes bounds the AdmissionReview bodies the server reads
+const maxRequestBytes = 3 << 20
+
+// Assigner picks a podCIDR for a node that is being created. It returns
+// an empty string when it does not assign one, in which case the node is
+// admitted unchanged and allocated by the regular sync.
+type Assigner interface {
+	AssignCIDR(ctx context.Context, node *corev1.Node) (string, error)
+}
+
+// MutateNode returns the handler of the node mutating webhook. It never
+// rejects a node: when no CIDR can be assigned inline, the node is admitted
+// as is.
+func MutateNode(assigner Assigner) http.Handler {
+	return reviewHandler(func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+		resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+		if req.Operation != admissionv1.Create || req.Kind.Kind != "Node" || (req.DryRun != nil && *req.DryRun) {
+			return resp
+		}
+
+		node := &corev1.Node{}
+		if err := json.Unmarshal(req.Object.Raw, node); err != nil {
+			klog.Warningf("Admitting node without a CIDR, failed to decode it: %v", err)
+			return resp
+		}
+		if node.Spec.PodCIDR != "" {
+			return resp
+		}
+
+		cidrBlock, err := assigner.AssignCIDR(ctx, node)
+		if err != nil {
+			klog.Warningf("Admitting node %s without a CIDR: %v", node.Name, err)
+			return resp
+		}
+		if cidrBlock == "" {
+			return resp
+		}
+
+		// Only the CIDR fields are added, so that spec fields this client
+		// does not know about reach the API server untouched
+		var ops []map[string]interface{}
+		if !hasSpec(req.Object.Raw) {
+			ops = append(ops, map[string]interface{}{"op": "add", "path": "/spec", "value": map[string]interface{}{}})
+		}
+		ops = append(ops,
+			map[string]interface{}{"op": "add", "path": "/spec/podCIDR", "value": cidrBlock},
+			map[string]interface{}{"op": "add", "path": "/spec/podCIDRs", "value": []string{cidrBlock}},
+		)
+		patch, err := json.Marshal(ops)
+		if err != nil {
+			klog.Warningf("Admitting node %s without a CIDR, failed to encode the patch: %v", node.Name, err)
+			return resp
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.Patch = patch
+		resp.PatchType = &patchType
+		return resp
+	})
+}
+
+// hasSpec reports whether a raw node carries a spec object the patch can
+// add fields to
+func hasSpec(raw []byte) bool {
+	var obj struct {
+		Spec json.RawMessage `json:"spec"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false
+	}
+	spec := bytes.TrimSpace(obj.Spec)
+	return len(spec) > 0 && spec[0] == '{'
+}
+
+// reviewHandler decodes an AdmissionReview, answers it with review and
+// encodes the response
+func reviewHandler(review func(context.Context, *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		in := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, in); err != nil || in.Request == nil {
+			http.Error(w, "expected an AdmissionReview request", http.StatusBadRequest)
+			return
+		}
+
+		out := &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+			Response: review(r.Context(), in.Request),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			klog.Errorf("Failed to write admission response: %v", err)
+		}
+	})
+}
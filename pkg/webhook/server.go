@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// CertFile and KeyFile are the names of the serving certificate and key
+	// in the certificate directory, as mounted from a kubernetes.io/tls
+	// Secret
+	CertFile = "tls.crt"
+	KeyFile  = "tls.key"
+
+	// DefaultCertReloadInterval is how often the certificate directory is
+	// checked for a rotated certificate
+	DefaultCertReloadInterval = 10 * time.Second
+)
+
+// certReloader serves the certificate in a directory and picks up a
+// rotated one without a restart, e.g. when cert-manager renews the Secret
+type certReloader struct {
+	dir string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	sum  [sha256.Size]byte
+}
+
+func newCertReloader(dir string) (*certReloader, error) {
+	r := &certReloader{dir: dir}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate if the files changed and reports whether
+// they did
+func (r *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(filepath.Join(r.dir, CertFile))
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(r.dir, KeyFile))
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM}, nil))
+	r.mu.RLock()
+	unchanged := r.cert != nil && sum == r.sum
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("failed to load certificate from %s: %w", r.dir, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.sum = sum
+	return true, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate every interval until ctx is done. A
+// broken rotation keeps the previous certificate in use.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		changed, err := r.reload()
+		if err != nil {
+			klog.Errorf("Failed to reload webhook certificate, keeping the current one: %v", err)
+			return
+		}
+		if changed {
+			klog.Infof("Reloaded webhook certificate from %s", r.dir)
+		}
+	}, interval)
+}
+
+// Server serves admission webhooks over TLS
+type Server struct {
+	Addr    string
+	CertDir string
+	// CertReloadInterval defaults to DefaultCertReloadInterval
+	CertReloadInterval time.Duration
+
+	mux *http.ServeMux
+}
+
+// NewServer creates a Server for addr with the certificate in certDir
+func NewServer(addr, certDir string) *Server {
+	return &Server{Addr: addr, CertDir: certDir, mux: http.NewServeMux()}
+}
+
+// Handle registers a webhook handler for a path
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// Run serves until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	certs, err := newCertReloader(s.CertDir)
+	if err != nil {
+		return err
+	}
+	interval := s.CertReloadInterval
+	if interval == 0 {
+		interval = DefaultCertReloadInterval
+	}
+	go certs.watch(ctx, interval)
+
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	klog.Infof("Serving admission webhooks on %s", s.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// ValidateNodePath is where the node validating webhook is served
+const ValidateNodePath = "/validate-node"
+
+// Validator checks the podCIDRs a node is created or updated with. user
+// is the requester and cidrs are the blocks the node did not hold before.
+// ExtraPodCIDRs returns the blocks a node holds beyond its spec, which are
+// checked like its podCIDRs.
+type Validator interface {
+	ValidatePodCIDRs(ctx context.Context, user authenticationv1.UserInfo, node *corev1.Node, cidrs []string) error
+	ExtraPodCIDRs(node *corev1.Node) []string
+}
+
+// ValidateNode returns the handler of the node validating webhook. It
+// rejects a node create or update that sets a podCIDR or an extra block the
+// validator refuses; other changes are allowed.
+func ValidateNode(validator Validator) http.Handler {
+	return reviewHandler(func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+		resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+		if (req.Operation != admissionv1.Create && req.Operation != admissionv1.Update) || req.Kind.Kind != "Node" {
+			return resp
+		}
+
+		node := &corev1.Node{}
+		if err := json.Unmarshal(req.Object.Raw, node); err != nil {
+			klog.Warningf("Admitting node without validating its podCIDRs, failed to decode it: %v", err)
+			return resp
+		}
+		var held []string
+		if req.Operation == admissionv1.Update {
+			old := &corev1.Node{}
+			if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+				klog.Warningf("Admitting node %s without validating its podCIDRs, failed to decode the old object: %v", node.Name, err)
+				return resp
+			}
+			held = append(podCIDRs(old), validator.ExtraPodCIDRs(old)...)
+		}
+
+		var added []string
+		for _, cidrBlock := range append(podCIDRs(node), validator.ExtraPodCIDRs(node)...) {
+			if !slices.Contains(held, cidrBlock) {
+				added = append(added, cidrBlock)
+			}
+		}
+		if len(added) == 0 {
+			return resp
+		}
+
+		if err := validator.ValidatePodCIDRs(ctx, req.UserInfo, node, added); err != nil {
+			klog.Infof("Rejected podCIDRs %v of node %s set by %s: %v", added, node.Name, req.UserInfo.Username, err)
+			resp.Allowed = false
+			resp.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+				Message: err.Error(),
+			}
+		}
+		return resp
+	})
+}
+
+// podCIDRs returns the blocks in a node's spec
+func podCIDRs(node *corev1.Node) []string {
+	cidrs := slices.Clone(node.Spec.PodCIDRs)
+	if node.Spec.PodCIDR != "" && !slices.Contains(cidrs, node.Spec.PodCIDR) {
+		cidrs = append(cidrs, node.Spec.PodCIDR)
+	}
+	return cidrs
+}
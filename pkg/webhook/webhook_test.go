@@ -0,0 +1,372 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type fakeAssigner struct {
+	cidr  string
+	calls int
+}
+
+func (f *fakeAssigner) AssignCIDR(_ context.Context, _ *corev1.Node) (string, error) {
+	f.calls++
+	return f.cidr, nil
+}
+
+type fakeValidator struct {
+	refuse string
+	added  []string
+}
+
+func (f *fakeValidator) ExtraPodCIDRs(node *corev1.Node) []string {
+	if v := node.Annotations["podcidr.imroc.io/extra-pod-cidrs"]; v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+func (f *fakeValidator) ValidatePodCIDRs(_ context.Context, _ authenticationv1.UserInfo, _ *corev1.Node, cidrs []string) error {
+	f.added = cidrs
+	for _, c := range cidrs {
+		if c == f.refuse {
+			return fmt.Errorf("podCIDR %s is taken", c)
+		}
+	}
+	return nil
+}
+
+// newReview encodes an AdmissionReview of a node, with the old node for
+// updates
+func newReview(t *testing.T, op admissionv1.Operation, node *corev1.Node, old ...*corev1.Node) []byte {
+	t.Helper()
+	var oldRaw []byte
+	if len(old) > 0 {
+		oldRaw = mustMarshal(t, old[0])
+	}
+	return newRawReview(t, op, mustMarshal(t, node), oldRaw)
+}
+
+// newRawReview encodes an AdmissionReview of a raw node, with the old raw
+// node for updates
+func newRawReview(t *testing.T, op admissionv1.Operation, raw []byte, old ...[]byte) []byte {
+	t.Helper()
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid-1",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Node"},
+			Operation: op,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	if len(old) > 0 && old[0] != nil {
+		review.Request.OldObject.Raw = old[0]
+	}
+	return mustMarshal(t, review)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return raw
+}
+
+// applyPatch applies the JSON patch of resp to a raw node and decodes the
+// result
+func applyPatch(t *testing.T, raw []byte, resp *admissionv1.AdmissionResponse) *corev1.Node {
+	t.Helper()
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatalf("failed to apply patch %s: %v", resp.Patch, err)
+	}
+	node := &corev1.Node{}
+	if err := json.Unmarshal(patched, node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return node
+}
+
+func decodeResponse(t *testing.T, body []byte) *admissionv1.AdmissionResponse {
+	t.Helper()
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if review.Response == nil || review.Response.UID != "uid-1" {
+		t.Fatalf("unexpected response %+v", review.Response)
+	}
+	return review.Response
+}
+
+func TestMutateNode(t *testing.T) {
+	assigner := &fakeAssigner{cidr: "10.244.1.0/24"}
+	handler := MutateNode(assigner)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", MutateNodePath, bytes.NewReader(newReview(t, admissionv1.Create, node))))
+	resp := decodeResponse(t, rec.Body.Bytes())
+	if !resp.Allowed || resp.PatchType == nil {
+		t.Fatalf("expected an allowed response with a patch, got %+v", resp)
+	}
+	patched := applyPatch(t, mustMarshal(t, node), resp)
+	if patched.Spec.PodCIDR != "10.244.1.0/24" || len(patched.Spec.PodCIDRs) != 1 {
+		t.Errorf("unexpected patch %s", resp.Patch)
+	}
+
+	// Updates and nodes that already have a CIDR are left alone
+	node.Spec.PodCIDR = "10.244.2.0/24"
+	for _, op := range []admissionv1.Operation{admissionv1.Create, admissionv1.Update} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", MutateNodePath, bytes.NewReader(newReview(t, op, node))))
+		if resp := decodeResponse(t, rec.Body.Bytes()); !resp.Allowed || resp.Patch != nil {
+			t.Errorf("%s: expected an allowed response without a patch, got %+v", op, resp)
+		}
+	}
+	if assigner.calls != 1 {
+		t.Errorf("expected 1 assignment, got %d", assigner.calls)
+	}
+
+	// No assignment admits the node unchanged
+	assigner.cidr = ""
+	node.Spec.PodCIDR = ""
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", MutateNodePath, bytes.NewReader(newReview(t, admissionv1.Create, node))))
+	if resp := decodeResponse(t, rec.Body.Bytes()); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected an allowed response without a patch, got %+v", resp)
+	}
+}
+
+func TestMutateNodeKeepsUnknownSpecFields(t *testing.T) {
+	handler := MutateNode(&fakeAssigner{cidr: "10.244.1.0/24"})
+	for _, raw := range []string{
+		`{"metadata":{"name":"node-1"},"spec":{"providerID":"fake://node-1","futureField":{"enabled":true}}}`,
+		`{"metadata":{"name":"node-1"}}`,
+	} {
+		body := newRawReview(t, admissionv1.Create, []byte(raw))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", MutateNodePath, bytes.NewReader(body)))
+		resp := decodeResponse(t, rec.Body.Bytes())
+		if !resp.Allowed || resp.PatchType == nil {
+			t.Fatalf("expected an allowed response with a patch, got %+v", resp)
+		}
+
+		out, err := jsonpatch.DecodePatch(resp.Patch)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		patched, err := out.Apply([]byte(raw))
+		if err != nil {
+			t.Fatalf("failed to apply patch %s to %s: %v", resp.Patch, raw, err)
+		}
+		var obj struct {
+			Spec map[string]interface{} `json:"spec"`
+		}
+		if err := json.Unmarshal(patched, &obj); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if obj.Spec["podCIDR"] != "10.244.1.0/24" {
+			t.Errorf("expected podCIDR to be set in %s", patched)
+		}
+		var orig struct {
+			Spec map[string]interface{} `json:"spec"`
+		}
+		if err := json.Unmarshal([]byte(raw), &orig); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for field, value := range orig.Spec {
+			if !reflect.DeepEqual(obj.Spec[field], value) {
+				t.Errorf("spec field %s was not kept by the patch: %s", field, patched)
+			}
+		}
+	}
+}
+
+func TestValidateNode(t *testing.T) {
+	validator := &fakeValidator{refuse: "10.244.1.0/24"}
+	handler := ValidateNode(validator)
+	review := func(body []byte) *admissionv1.AdmissionResponse {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", ValidateNodePath, bytes.NewReader(body)))
+		return decodeResponse(t, rec.Body.Bytes())
+	}
+
+	withCIDR := func(cidr string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+			Spec:       corev1.NodeSpec{PodCIDR: cidr, PodCIDRs: []string{cidr}},
+		}
+	}
+
+	resp := review(newReview(t, admissionv1.Create, withCIDR("10.244.1.0/24")))
+	if resp.Allowed || resp.Result == nil || resp.Result.Code != http.StatusForbidden {
+		t.Errorf("expected a forbidden response, got %+v", resp)
+	}
+	if resp := review(newReview(t, admissionv1.Create, withCIDR("10.244.2.0/24"))); !resp.Allowed {
+		t.Errorf("expected an allowed response, got %+v", resp)
+	}
+
+	// Only blocks the node did not hold are validated
+	validator.added = nil
+	if resp := review(newReview(t, admissionv1.Update, withCIDR("10.244.1.0/24"), withCIDR("10.244.1.0/24"))); !resp.Allowed || validator.added != nil {
+		t.Errorf("expected an unchanged podCIDR to be allowed without validation, got %+v", resp)
+	}
+	if resp := review(newReview(t, admissionv1.Update, withCIDR("10.244.1.0/24"), &corev1.Node{})); resp.Allowed {
+		t.Error("expected a podCIDR set by an update to be validated")
+	}
+	if resp := review(newReview(t, admissionv1.Create, &corev1.Node{})); !resp.Allowed {
+		t.Errorf("expected a node without podCIDR to be allowed, got %+v", resp)
+	}
+
+	// Extra blocks are validated like podCIDRs
+	withExtra := func(extra string) *corev1.Node {
+		node := withCIDR("10.244.0.0/24")
+		node.Annotations = map[string]string{"podcidr.imroc.io/extra-pod-cidrs": extra}
+		return node
+	}
+	if resp := review(newReview(t, admissionv1.Update, withExtra("10.244.2.0/24,10.244.1.0/24"), withExtra("10.244.2.0/24"))); resp.Allowed {
+		t.Error("expected an extra block set by an update to be validated")
+	}
+	if got := fmt.Sprint(validator.added); got != "[10.244.1.0/24]" {
+		t.Errorf("expected only the new extra block to be validated, got %s", got)
+	}
+}
+
+// writeCert writes a self-signed serving certificate for 127.0.0.1 and
+// returns it
+func writeCert(t *testing.T, dir, commonName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, KeyFile), keyPEM, 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, CertFile), certPEM, 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestServerRotatesCertificate plays the API server: it calls the webhook
+// over TLS, trusting only the current certificate, before and after the
+// certificate is rotated on disk
+func TestServerRotatesCertificate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	first := writeCert(t, dir, "first")
+
+	server := NewServer(freeAddr(t), dir)
+	server.CertReloadInterval = 10 * time.Millisecond
+	server.Handle(MutateNodePath, MutateNode(&fakeAssigner{cidr: "10.244.1.0/24"}))
+	go func() { _ = server.Run(ctx) }()
+
+	call := func(trusted *x509.Certificate) (*admissionv1.AdmissionResponse, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(trusted)
+		client := &http.Client{
+			Timeout:   time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+		body := newReview(t, admissionv1.Create, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}})
+		resp, err := client.Post("https://"+server.Addr+MutateNodePath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(resp.Body)
+		return decodeResponse(t, buf.Bytes()), nil
+	}
+
+	poll := func(trusted *x509.Certificate) error {
+		return wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+			resp, err := call(trusted)
+			return err == nil && resp.Allowed && resp.Patch != nil, nil
+		})
+	}
+
+	if err := poll(first); err != nil {
+		t.Fatal("expected the webhook to answer with the first certificate")
+	}
+
+	second := writeCert(t, dir, "second")
+	if err := poll(second); err != nil {
+		t.Fatal("expected the webhook to serve the rotated certificate")
+	}
+	if _, err := call(first); err == nil {
+		t.Error("expected the first certificate to be retired")
+	}
+}